@@ -2,11 +2,16 @@
 package app
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"math/big"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
 	"github.com/ardanlabs/usdl/chat/foundation/signature"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gorilla/websocket"
@@ -17,21 +22,60 @@ type MyAccount struct {
 	Name string
 }
 
+// User represents a contact. Every device of a contact sends its own nonces,
+// the nonces of contacts that don't send a device are kept in LastNonce.
 type User struct {
 	ID           common.Address
 	Name         string
+	IsGroup      bool
 	AppLastNonce uint64
 	LastNonce    uint64
+	DeviceNonces map[string]uint64
 	Key          string
 	Messages     []string
 }
 
+// peer identifies a device of a contact.
+type peer struct {
+	id     common.Address
+	device string
+}
+
+// MessageState represents how far a sent message has progressed.
+type MessageState int
+
+// Set of states a sent message moves through.
+const (
+	StateSent      MessageState = 1
+	StateDelivered MessageState = 2
+	StateRead      MessageState = 3
+)
+
+// Marker returns the text displayed next to a sent message for the state.
+func (ms MessageState) Marker() string {
+	switch ms {
+	case StateSent:
+		return " (sent)"
+	case StateDelivered:
+		return " (delivered)"
+	case StateRead:
+		return " (read)"
+	}
+
+	return ""
+}
+
 type Storage interface {
+	Contacts() []User
 	QueryContactByID(id common.Address) (User, error)
 	InsertContact(id common.Address, name string) (User, error)
+	InsertGroup(id common.Address, name string) (User, error)
 	InsertMessage(id common.Address, msg string) error
+	InsertSentMessage(id common.Address, nonce uint64, msg string) error
+	UpdateMessageState(id common.Address, nonce uint64, state MessageState) error
 	UpdateAppNonce(id common.Address, nonce uint64) error
 	UpdateContactNonce(id common.Address, nonce uint64) error
+	UpdateDeviceNonce(id common.Address, device string, nonce uint64) error
 	UpdateContactKey(id common.Address, key string) error
 }
 
@@ -39,50 +83,52 @@ type UI interface {
 	Run() error
 	WriteText(id string, msg string)
 	UpdateContact(id string, name string)
-}
-
-// =============================================================================
-
-type outgoingMessage struct {
-	ToID      common.Address `json:"toID"`
-	Msg       string         `json:"msg"`
-	FromNonce uint64         `json:"fromNonce"`
-	V         *big.Int       `json:"v"`
-	R         *big.Int       `json:"r"`
-	S         *big.Int       `json:"s"`
-}
-
-type usr struct {
-	ID    common.Address `json:"id"`
-	Name  string         `json:"name"`
-	Nonce uint64         `json:"nonce"`
-}
-
-type incomingMessage struct {
-	From usr    `json:"from"`
-	Msg  string `json:"msg"`
+	Refresh(id string)
+	UpdateStatus(id string, status string, lastSeen time.Time)
+	UpdateConnection(state ConnState)
+	Progress(id string, label string, done int64, total int64)
 }
 
 // =============================================================================
 
 type App struct {
-	db   Storage
-	ui   UI
-	id   ID
-	url  string
-	conn *websocket.Conn
+	db          Storage
+	ui          UI
+	id          ID
+	url         string
+	filePath    string
+	acct        MyAccount
+	conn        *websocket.Conn
+	connected   bool
+	closed      bool
+	queue       []queued
+	pacer       *pacer
+	muWrite     sync.Mutex
+	muSend      sync.Mutex
+	lastRead    map[peer]uint64
+	muRead      sync.Mutex
+	transfers   map[string]*transfer
+	muTransfers sync.Mutex
 }
 
-func NewApp(db Storage, ui UI, id ID, url string) *App {
+func NewApp(db Storage, ui UI, id ID, url string, filePath string) *App {
 	return &App{
-		db:  db,
-		ui:  ui,
-		id:  id,
-		url: url,
+		db:        db,
+		ui:        ui,
+		id:        id,
+		url:       url,
+		filePath:  filePath,
+		lastRead:  make(map[peer]uint64),
+		transfers: make(map[string]*transfer),
 	}
 }
 
 func (app *App) Close() error {
+	app.muWrite.Lock()
+	defer app.muWrite.Unlock()
+
+	app.closed = true
+
 	if app.conn == nil {
 		return nil
 	}
@@ -95,56 +141,109 @@ func (app *App) Run() error {
 }
 
 func (app *App) Handshake(acct MyAccount) error {
+	app.acct = acct
+
+	return app.connect()
+}
+
+// connect dials the cap and performs the handshake. Once the cap welcomed us
+// the frames queued while we were not connected are written.
+func (app *App) connect() error {
 	conn, _, err := websocket.DefaultDialer.Dial(app.url, nil)
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 
-	app.conn = conn
+	welcome, err := app.hello(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 
-	// -------------------------------------------------------------------------
+	keepAlive(conn)
 
-	_, msg, err := conn.ReadMessage()
+	n, err := app.resume(conn, newPacer(welcome.Limits))
 	if err != nil {
-		return fmt.Errorf("read: %w", err)
+		conn.Close()
+		return err
 	}
 
-	if string(msg) != "HELLO" {
-		return fmt.Errorf("unexpected message: %s", msg)
+	app.ui.UpdateConnection(ConnConnected)
+
+	if n > 0 {
+		app.ui.WriteText("system", fmt.Sprintf("** %d queued message(s) sent **", n))
 	}
 
 	// -------------------------------------------------------------------------
 
-	user := struct {
-		ID   common.Address
-		Name string
-	}{
-		ID:   app.id.MyAccountID,
-		Name: acct.Name,
+	go func() {
+		app.ReceiveCapMessage(conn)
+	}()
+
+	// -------------------------------------------------------------------------
+	// Ask the cap to keep us posted about which contacts are connected.
+
+	var ids []common.Address
+	for _, user := range app.db.Contacts() {
+		if !user.IsGroup {
+			ids = append(ids, user.ID)
+		}
 	}
 
-	data, err := json.Marshal(user)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+	if err := app.subscribePresence(ids...); err != nil {
+		return fmt.Errorf("presence: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		return fmt.Errorf("write: %w", err)
+	return nil
+}
+
+// hello proves we own the account by signing the cap's challenge. The cap
+// welcomes us with the limits our frames must stay within.
+func (app *App) hello(conn *websocket.Conn) (protocol.Welcome, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeWait))
+
+	var chlg protocol.Challenge
+	if err := readFrame(conn, protocol.TypeChallenge, &chlg); err != nil {
+		return protocol.Welcome{}, err
+	}
+
+	if !slices.Contains(chlg.Versions, protocol.Version) {
+		return protocol.Welcome{}, fmt.Errorf("%w %d: cap supports %v", protocol.ErrUnsupportedVersion, protocol.Version, chlg.Versions)
 	}
 
 	// -------------------------------------------------------------------------
 
-	if _, _, err = conn.ReadMessage(); err != nil {
-		return fmt.Errorf("read: %w", err)
+	hello := protocol.Hello{
+		ID:     app.id.MyAccountID,
+		Name:   app.acct.Name,
+		Device: app.id.Device,
+	}
+
+	v, r, s, err := signature.Sign(hello.SignedData(chlg.Challenge), app.id.PrivKeyECDSA)
+	if err != nil {
+		return protocol.Welcome{}, fmt.Errorf("signing: %w", err)
+	}
+
+	hello.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	data, err := protocol.Encode(protocol.TypeHello, hello)
+	if err != nil {
+		return protocol.Welcome{}, fmt.Errorf("encode %s: %w", protocol.TypeHello, err)
+	}
+
+	// Nothing else writes to the connection until the handshake is done.
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return protocol.Welcome{}, fmt.Errorf("write: %w", err)
 	}
 
 	// -------------------------------------------------------------------------
 
-	go func() {
-		app.ReceiveCapMessage(conn)
-	}()
+	var welcome protocol.Welcome
+	if err := readFrame(conn, protocol.TypeWelcome, &welcome); err != nil {
+		return protocol.Welcome{}, err
+	}
 
-	return nil
+	return welcome, nil
 }
 
 // =============================================================================
@@ -154,73 +253,110 @@ func (app *App) ReceiveCapMessage(conn *websocket.Conn) {
 		_, rawMsg, err := conn.ReadMessage()
 		if err != nil {
 			app.ui.WriteText("system", fmt.Sprintf("read: %s", err))
+
+			// The cap may have closed the connection for good, connecting
+			// again wouldn't change that.
+			if !reconnectable(err) {
+				app.stop(closeNote(err))
+			}
+
+			app.disconnected(conn)
 			return
 		}
 
-		var inMsg incomingMessage
-		if err := json.Unmarshal(rawMsg, &inMsg); err != nil {
-			app.ui.WriteText("system", fmt.Sprintf("unmarshal: %s", err))
-			return
+		conn.SetReadDeadline(time.Now().Add(pingWait))
+
+		env, err := protocol.Decode(rawMsg)
+		if err != nil {
+			app.ui.WriteText("system", fmt.Sprintf("decode: %s", err))
+			continue
 		}
 
-		user, err := app.db.QueryContactByID(inMsg.From.ID)
-		switch {
-		case err != nil:
-			user, err = app.db.InsertContact(inMsg.From.ID, inMsg.From.Name)
-			if err != nil {
-				app.ui.WriteText("system", fmt.Sprintf("add contact: %s", err))
-				return
-			}
+		// A bad frame is reported and dropped, the connection stays up for
+		// the frames that follow.
 
-			app.ui.UpdateContact(inMsg.From.ID.Hex(), inMsg.From.Name)
+		switch env.Type {
+		case protocol.TypeChat:
+			if err := app.receiveChat(env); err != nil {
+				app.ui.WriteText("system", err.Error())
+			}
 
-		default:
-			inMsg.From.Name = user.Name
-		}
+		case protocol.TypeCommand:
+			if err := app.receiveCommand(env); err != nil {
+				app.ui.WriteText("system", err.Error())
+			}
 
-		// -----------------------------------------------------------------
+		case protocol.TypeFile:
+			if err := app.receiveFile(env); err != nil {
+				app.ui.WriteText("system", err.Error())
+			}
 
-		expNonce := user.LastNonce + 1
-		if inMsg.From.Nonce != expNonce {
-			app.ui.WriteText("system", fmt.Sprintf("invalid nonce: possible security issue with contact: got: %d, exp: %d", inMsg.From.Nonce, expNonce))
-			return
-		}
+		case protocol.TypeReceipt:
+			if err := app.receiveReceipt(env); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("receipt: %s", err))
+			}
 
-		if err := app.db.UpdateContactNonce(inMsg.From.ID, expNonce); err != nil {
-			app.ui.WriteText("system", fmt.Sprintf("update app nonce: %s", err))
-			return
-		}
+		case protocol.TypeStatus:
+			if err := app.receiveStatus(env); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("status: %s", err))
+			}
 
-		// ---------------------------------------------------------------------
+		case protocol.TypeError:
+			if err := app.receiveError(env); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("error: %s", err))
+			}
 
-		inMsg, err = app.preprocessRecvMessage(inMsg)
-		if err != nil {
-			app.ui.WriteText("system", fmt.Sprintf("preprocessed: %s: %s", inMsg.Msg, err))
-			return
-		}
+		case protocol.TypePresence:
+			if err := app.receivePresence(env); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("presence: %s", err))
+			}
 
-		// ---------------------------------------------------------------------
+		case protocol.TypeSent:
+			if err := app.receiveSent(env); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("sent: %s", err))
+			}
 
-		fm := formatMessage(user.Name, inMsg.Msg)
+		case protocol.TypeDevice:
+			if err := app.receiveDevices(env); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("devices: %s", err))
+			}
 
-		if err := app.db.InsertMessage(inMsg.From.ID, fm); err != nil {
-			app.ui.WriteText("system", fmt.Sprintf("add message: %s", err))
-			return
+		default:
+			app.ui.WriteText("system", fmt.Sprintf("unexpected %s frame", env.Type))
 		}
-
-		app.ui.WriteText(inMsg.From.ID.Hex(), fm)
 	}
 }
 
 func (app *App) SendMessageHandler(to common.Address, msg string) error {
-	if app.conn == nil {
-		return fmt.Errorf("no connection")
-	}
-
 	if len(msg) == 0 {
 		return fmt.Errorf("message cannot be empty")
 	}
 
+	if strings.HasPrefix(msg, "/group ") {
+		return app.sendGroupCommand(to, msg)
+	}
+
+	if strings.HasPrefix(msg, "/status ") {
+		return app.sendStatus(msg)
+	}
+
+	if strings.HasPrefix(msg, "/send ") {
+		return app.sendFile(to, msg)
+	}
+
+	if msg == "/devices" || strings.HasPrefix(msg, "/revoke ") {
+		return app.sendDevice(msg)
+	}
+
+	if msg[0] == '/' {
+		return app.sendCommand(to, msg)
+	}
+
+	// Files are sent in the background, the nonce must not be handed out
+	// twice.
+	app.muSend.Lock()
+	defer app.muSend.Unlock()
+
 	usr, err := app.db.QueryContactByID(to)
 	if err != nil {
 		return fmt.Errorf("query contact: %w", err)
@@ -230,115 +366,630 @@ func (app *App) SendMessageHandler(to common.Address, msg string) error {
 
 	nonce := usr.AppLastNonce + 1
 
-	msg, err = app.preprocessSendMessage(msg)
-	if err != nil {
-		return fmt.Errorf("preprocess message: %w", err)
+	wireMsg := msg
+	encrypted := usr.Key != ""
+
+	if encrypted {
+		wireMsg, err = encryptMessage(usr.Key, msg)
+		if err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
 	}
 
 	// -------------------------------------------------------------------------
 
-	dataToSign := struct {
-		ToID      common.Address
-		Msg       string
-		FromNonce uint64
-	}{
+	req := protocol.ChatRequest{
 		ToID:      to,
-		Msg:       msg,
+		Msg:       wireMsg,
+		Encrypted: encrypted,
 		FromNonce: nonce,
 	}
 
-	v, r, s, err := signature.Sign(dataToSign, app.id.PrivKeyECDSA)
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
 	if err != nil {
 		return fmt.Errorf("signing: %w", err)
 	}
 
-	outMsg := outgoingMessage{
-		ToID:      to,
-		Msg:       msg,
-		FromNonce: nonce,
-		V:         v,
-		R:         r,
-		S:         s,
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	if err := app.writeSigned(protocol.TypeChat, to, nonce, req); err != nil {
+		return err
+	}
+
+	// -------------------------------------------------------------------------
+
+	return app.recordSent(usr, nonce, formatMessage("You", msg, encrypted))
+}
+
+// MarkRead tells the contact their messages up to the last one received
+// have been shown to the user. Every device of the contact is told about the
+// messages it sent.
+func (app *App) MarkRead(id common.Address) error {
+	if !app.isConnected() {
+		return nil
+	}
+
+	user, err := app.db.QueryContactByID(id)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
 	}
 
-	data, err := json.Marshal(outMsg)
+	if user.IsGroup {
+		return nil
+	}
+
+	nonces := maps.Clone(user.DeviceNonces)
+	if nonces == nil {
+		nonces = make(map[string]uint64)
+	}
+
+	nonces[""] = user.LastNonce
+
+	app.muRead.Lock()
+	defer app.muRead.Unlock()
+
+	for device, nonce := range nonces {
+		p := peer{id: id, device: device}
+
+		if nonce == 0 || app.lastRead[p] >= nonce {
+			continue
+		}
+
+		if err := app.sendReceipt(id, device, nonce, protocol.ReceiptRead); err != nil {
+			return err
+		}
+
+		app.lastRead[p] = nonce
+	}
+
+	return nil
+}
+
+func (app *App) writeFrame(typ protocol.Type, payload any) error {
+	data, err := protocol.Encode(typ, payload)
 	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+		return fmt.Errorf("encode %s: %w", typ, err)
+	}
+
+	app.pace(len(data))
+
+	// Receipts are written by the receive loop while messages are written by
+	// the UI, and the connection only supports one writer at a time.
+	app.muWrite.Lock()
+	defer app.muWrite.Unlock()
+
+	if !app.connected {
+		return fmt.Errorf("not connected")
 	}
 
 	if err := app.conn.WriteMessage(websocket.TextMessage, data); err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
 
-	// -------------------------------------------------------------------------
+	return nil
+}
+
+// readFrame reads the next frame during the handshake and decodes it into v.
+// An error frame from the cap is returned as an error.
+func readFrame(conn *websocket.Conn, typ protocol.Type, v any) error {
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
 
-	if err := app.db.UpdateAppNonce(to, nonce); err != nil {
+	env, err := protocol.Decode(msg)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	switch env.Type {
+	case typ:
+		return env.Unmarshal(v)
+
+	case protocol.TypeError:
+		var em protocol.ErrorMessage
+		if err := env.Unmarshal(&em); err != nil {
+			return err
+		}
+
+		// The cap closes the connection after refusing us, the close code
+		// tells whether connecting again can help.
+		var ce *websocket.CloseError
+		if _, _, err := conn.ReadMessage(); errors.As(err, &ce) {
+			return fmt.Errorf("cap: %s: %s: %w", em.Code, em.Message, ce)
+		}
+
+		return fmt.Errorf("cap: %s: %s", em.Code, em.Message)
+	}
+
+	return fmt.Errorf("unexpected %s frame: expected %s", env.Type, typ)
+}
+
+// recordSent stores a message we sent to the contact and shows it.
+func (app *App) recordSent(usr User, nonce uint64, msg string) error {
+	if err := app.db.UpdateAppNonce(usr.ID, nonce); err != nil {
 		return fmt.Errorf("update app nonce: %w", err)
 	}
 
-	msg = formatMessage("You", msg)
+	var err error
+
+	switch {
+	case usr.IsGroup:
+		err = app.db.InsertMessage(usr.ID, msg)
+
+	default:
+		err = app.db.InsertSentMessage(usr.ID, nonce, msg)
+		msg += StateSent.Marker()
+	}
 
-	if err := app.db.InsertMessage(to, msg); err != nil {
+	if err != nil {
 		return fmt.Errorf("add message: %w", err)
 	}
 
+	app.ui.WriteText(usr.ID.Hex(), msg)
+
+	return nil
+}
+
+// =============================================================================
+
+// receiveChat stores and shows a message sent to us or to one of our groups.
+func (app *App) receiveChat(env protocol.Envelope) error {
+	var chatMsg protocol.ChatMessage
+	if err := env.Unmarshal(&chatMsg); err != nil {
+		return err
+	}
+
+	if chatMsg.Group != nil {
+		if err := app.receiveGroupMessage(chatMsg); err != nil {
+			return fmt.Errorf("group: %w", err)
+		}
+		return nil
+	}
+
+	user, err := app.acceptNonce(chatMsg.From)
+	if err != nil {
+		return err
+	}
+
 	// -------------------------------------------------------------------------
 
-	app.ui.WriteText(to.Hex(), msg)
+	msg := chatMsg.Msg
+
+	if chatMsg.Encrypted {
+		msg, err = decryptMessage(app.id.PrivKeyRSA, msg)
+		if err != nil {
+			return fmt.Errorf("decrypt: %w", err)
+		}
+	}
+
+	return app.recordReceived(user, chatMsg.From, formatMessage(user.Name, msg, chatMsg.Encrypted))
+}
+
+// receiveCommand executes a command sent to us by a contact.
+func (app *App) receiveCommand(env protocol.Envelope) error {
+	var cmdMsg protocol.CommandMessage
+	if err := env.Unmarshal(&cmdMsg); err != nil {
+		return err
+	}
+
+	user, err := app.acceptNonce(cmdMsg.From)
+	if err != nil {
+		return err
+	}
+
+	switch cmdMsg.Command.Action {
+	case protocol.ActionShareKey:
+		if err := app.db.UpdateContactKey(user.ID, cmdMsg.Command.Key); err != nil {
+			return fmt.Errorf("updating key: %w", err)
+		}
+
+		return app.recordReceived(user, cmdMsg.From, formatMessage(user.Name, "** updated contact's key **", false))
+	}
+
+	return fmt.Errorf("unknown command %q", cmdMsg.Command.Action)
+}
+
+// acceptNonce makes sure the message is the next one we expect from the
+// contact's device, adding the contact if this is the first message.
+func (app *App) acceptNonce(from protocol.From) (User, error) {
+	user, err := app.db.QueryContactByID(from.ID)
+	if err != nil {
+		user, err = app.db.InsertContact(from.ID, from.Name)
+		if err != nil {
+			return User{}, fmt.Errorf("add contact: %w", err)
+		}
+
+		app.ui.UpdateContact(from.ID.Hex(), from.Name)
+
+		if err := app.subscribePresence(from.ID); err != nil {
+			app.ui.WriteText("system", fmt.Sprintf("presence: %s", err))
+		}
+	}
+
+	// A nonce we already saw is a replay and the message is dropped. A gap
+	// means messages were lost on the way, which is worth knowing about but
+	// is no reason to drop the message.
+
+	last := user.LastNonce
+	if from.Device != "" {
+		last = user.DeviceNonces[from.Device]
+	}
+
+	expNonce := last + 1
+
+	switch {
+	case from.Nonce < expNonce:
+		return User{}, fmt.Errorf("invalid nonce: possible security issue with contact: got: %d, exp: %d", from.Nonce, expNonce)
+
+	case from.Nonce > expNonce:
+		app.ui.WriteText(from.ID.Hex(), fmt.Sprintf("** %d message(s) from contact missing **", from.Nonce-expNonce))
+	}
+
+	switch from.Device {
+	case "":
+		err = app.db.UpdateContactNonce(from.ID, from.Nonce)
+	default:
+		err = app.db.UpdateDeviceNonce(from.ID, from.Device, from.Nonce)
+	}
+
+	if err != nil {
+		return User{}, fmt.Errorf("update app nonce: %w", err)
+	}
+
+	return user, nil
+}
+
+// recordReceived stores a message from the contact, acknowledges it to the
+// device that sent it and shows it.
+func (app *App) recordReceived(user User, from protocol.From, msg string) error {
+	if err := app.db.InsertMessage(user.ID, msg); err != nil {
+		return fmt.Errorf("add message: %w", err)
+	}
+
+	if err := app.sendReceipt(user.ID, from.Device, from.Nonce, protocol.ReceiptDelivered); err != nil {
+		app.ui.WriteText("system", fmt.Sprintf("delivery receipt: %s", err))
+	}
+
+	app.ui.WriteText(user.ID.Hex(), msg)
 
 	return nil
 }
 
-// =============================================================================
+// sendReceipt tells the contact how far the messages sent from their device
+// up to the specified nonce have progressed.
+func (app *App) sendReceipt(to common.Address, device string, nonce uint64, state string) error {
+	req := protocol.ReceiptRequest{
+		ToID: to,
+		Receipt: protocol.Receipt{
+			Nonce:  nonce,
+			State:  state,
+			Device: device,
+		},
+	}
 
-func (app *App) preprocessRecvMessage(inMsg incomingMessage) (incomingMessage, error) {
-	msg := inMsg.Msg
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
 
-	if msg[0] != '/' {
-		return inMsg, nil
+	return app.writeFrame(protocol.TypeReceipt, req)
+}
+
+// receiveReceipt records the progress of the messages we sent to a contact.
+// Receipts are sent to every device of the account, the ones about the
+// messages of another device are ignored.
+func (app *App) receiveReceipt(env protocol.Envelope) error {
+	var rctMsg protocol.ReceiptMessage
+	if err := env.Unmarshal(&rctMsg); err != nil {
+		return err
 	}
 
-	parts := strings.Split(msg[1:], " ")
-	if len(parts) < 2 {
-		return incomingMessage{}, fmt.Errorf("invalid command format: parts: %d", len(parts))
+	if rctMsg.Receipt.Device != "" && rctMsg.Receipt.Device != app.id.Device {
+		return nil
+	}
+
+	var state MessageState
+
+	switch rctMsg.Receipt.State {
+	case protocol.ReceiptDelivered:
+		state = StateDelivered
+	case protocol.ReceiptRead:
+		state = StateRead
+	default:
+		return fmt.Errorf("unknown receipt state %q", rctMsg.Receipt.State)
+	}
+
+	from := rctMsg.From.ID
+
+	if err := app.db.UpdateMessageState(from, rctMsg.Receipt.Nonce, state); err != nil {
+		return fmt.Errorf("update message state: %w", err)
+	}
+
+	app.ui.Refresh(from.Hex())
+
+	return nil
+}
+
+// receiveStatus reports what the cap did with a message we sent. Messages for
+// contacts that are not connected are queued by the cap and delivered when
+// they connect again.
+func (app *App) receiveStatus(env protocol.Envelope) error {
+	var st protocol.StatusMessage
+	if err := env.Unmarshal(&st); err != nil {
+		return err
+	}
+
+	switch st.Status {
+	case protocol.StatusQueued:
+		app.ui.WriteText(st.ToID.Hex(), fmt.Sprintf("** message %d queued: contact is offline **", st.Nonce))
+
+	case protocol.StatusFailed:
+		app.ui.WriteText(st.ToID.Hex(), fmt.Sprintf("** message %d could not be delivered **", st.Nonce))
+	}
+
+	return nil
+}
+
+// receiveError reports a frame the cap could not process. Errors about a
+// message we sent are shown in the contact's history.
+func (app *App) receiveError(env protocol.Envelope) error {
+	var em protocol.ErrorMessage
+	if err := env.Unmarshal(&em); err != nil {
+		return err
+	}
+
+	if em.ToID == (common.Address{}) {
+		app.ui.WriteText("system", fmt.Sprintf("cap: %s: %s", em.Code, em.Message))
+		return nil
+	}
+
+	app.ui.WriteText(em.ToID.Hex(), fmt.Sprintf("** message %d rejected: %s **", em.Nonce, em.Message))
+
+	return nil
+}
+
+// receivePresence shows whether a contact is connected.
+func (app *App) receivePresence(env protocol.Envelope) error {
+	var pm protocol.PresenceMessage
+	if err := env.Unmarshal(&pm); err != nil {
+		return err
+	}
+
+	app.ui.UpdateStatus(pm.ID.Hex(), pm.Status, pm.LastSeen)
+
+	return nil
+}
+
+// subscribePresence asks the cap to send the status of the specified contacts
+// now and whenever it changes.
+func (app *App) subscribePresence(ids ...common.Address) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return app.writePresence(protocol.PresenceRequest{Subscribe: ids})
+}
+
+// sendStatus tells our contacts whether we are available.
+//
+//	/status online
+//	/status away
+func (app *App) sendStatus(msg string) error {
+	parts := strings.Fields(strings.ToLower(msg))
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid status command format")
+	}
+
+	switch parts[1] {
+	case protocol.PresenceOnline, protocol.PresenceAway:
+	default:
+		return fmt.Errorf("unknown status %q", parts[1])
 	}
 
-	switch parts[0] {
-	case "key":
-		if err := app.db.UpdateContactKey(inMsg.From.ID, msg[5:]); err != nil {
-			return incomingMessage{}, fmt.Errorf("updating key: %w", err)
+	if err := app.writePresence(protocol.PresenceRequest{Status: parts[1]}); err != nil {
+		return err
+	}
+
+	app.ui.WriteText("system", fmt.Sprintf("** status set to %s **", parts[1]))
+
+	return nil
+}
+
+func (app *App) writePresence(req protocol.PresenceRequest) error {
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	return app.writeFrame(protocol.TypePresence, req)
+}
+
+// receiveGroupMessage stores a message or membership notice sent to a group.
+// Group messages come from many senders, so the per contact nonce check does
+// not apply.
+func (app *App) receiveGroupMessage(chatMsg protocol.ChatMessage) error {
+	grp, err := app.db.QueryContactByID(chatMsg.Group.ID)
+	if err != nil {
+		grp, err = app.db.InsertGroup(chatMsg.Group.ID, chatMsg.Group.Name)
+		if err != nil {
+			return fmt.Errorf("add group: %w", err)
 		}
-		inMsg.Msg = "** updated contact's key **"
-		return inMsg, nil
+
+		app.ui.UpdateContact(chatMsg.Group.ID.Hex(), chatMsg.Group.Name)
+	}
+
+	name := chatMsg.From.Name
+	if chatMsg.From.ID == app.id.MyAccountID {
+		name = "You"
+	}
+
+	if user, err := app.db.QueryContactByID(chatMsg.From.ID); err == nil {
+		name = user.Name
+	}
+
+	fm := formatMessage(name, chatMsg.Msg, false)
+
+	if err := app.db.InsertMessage(grp.ID, fm); err != nil {
+		return fmt.Errorf("add message: %w", err)
 	}
 
-	return incomingMessage{}, fmt.Errorf("unknown command")
+	app.ui.WriteText(grp.ID.Hex(), fm)
+
+	return nil
 }
 
-func (app *App) preprocessSendMessage(msg string) (string, error) {
-	if msg[0] != '/' {
-		return msg, nil
+// sendGroupCommand asks the cap to create a group or change its membership.
+// Invite and remove apply to the currently selected group.
+//
+//	/group create <name>
+//	/group invite <address>
+//	/group remove <address>
+//	/group leave
+func (app *App) sendGroupCommand(to common.Address, msg string) error {
+	parts := strings.Fields(msg)
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid group command format")
 	}
 
+	var cmd protocol.Command
+
+	switch parts[1] {
+	case "create":
+		if len(parts) < 3 {
+			return fmt.Errorf("missing group name")
+		}
+
+		var id common.Address
+		if _, err := rand.Read(id[:]); err != nil {
+			return fmt.Errorf("generating group id: %w", err)
+		}
+
+		cmd = protocol.Command{
+			Action:  protocol.ActionGroupCreate,
+			GroupID: id,
+			Name:    strings.Join(parts[2:], " "),
+		}
+
+	case "invite", "remove":
+		if len(parts) != 3 || !common.IsHexAddress(parts[2]) {
+			return fmt.Errorf("missing or invalid member address")
+		}
+
+		action := protocol.ActionGroupInvite
+		if parts[1] == "remove" {
+			action = protocol.ActionGroupRemove
+		}
+
+		cmd = protocol.Command{
+			Action:   action,
+			GroupID:  to,
+			MemberID: common.HexToAddress(parts[2]),
+		}
+
+	case "leave":
+		cmd = protocol.Command{
+			Action:   protocol.ActionGroupRemove,
+			GroupID:  to,
+			MemberID: app.id.MyAccountID,
+		}
+
+	default:
+		return fmt.Errorf("unknown group command")
+	}
+
+	if cmd.Action != protocol.ActionGroupCreate {
+		grp, err := app.db.QueryContactByID(to)
+		if err != nil || !grp.IsGroup {
+			return fmt.Errorf("select a group first")
+		}
+	}
+
+	// -------------------------------------------------------------------------
+
+	req := protocol.CommandRequest{
+		ToID:    cmd.GroupID,
+		Command: cmd,
+	}
+
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	return app.writeFrame(protocol.TypeCommand, req)
+}
+
+// sendCommand sends a command to the selected contact. Commands are sent in
+// the clear since they carry the keys required for encryption.
+//
+//	/share key
+func (app *App) sendCommand(to common.Address, msg string) error {
 	msg = strings.TrimSpace(msg)
 	msg = strings.ToLower(msg)
 
 	parts := strings.Split(msg[1:], " ")
 	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid command format")
+		return fmt.Errorf("invalid command format")
 	}
 
-	switch parts[0] {
-	case "share":
-		switch parts[1] {
-		case "key":
-			if app.id.PubKeyRSA == "" {
-				return "", fmt.Errorf("no key to share")
-			}
+	var cmd protocol.Command
+	var note string
+
+	switch {
+	case parts[0] == "share" && parts[1] == "key":
+		if app.id.PubKeyRSA == "" {
+			return fmt.Errorf("no key to share")
+		}
 
-			return fmt.Sprintf("/key %s", app.id.PubKeyRSA), nil
+		cmd = protocol.Command{
+			Action: protocol.ActionShareKey,
+			Key:    app.id.PubKeyRSA,
 		}
+		note = "** shared key **"
+
+	default:
+		return fmt.Errorf("unknown command")
+	}
+
+	app.muSend.Lock()
+	defer app.muSend.Unlock()
+
+	usr, err := app.db.QueryContactByID(to)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	if usr.IsGroup {
+		return fmt.Errorf("commands can't be sent to a group")
+	}
+
+	// -------------------------------------------------------------------------
+
+	nonce := usr.AppLastNonce + 1
+
+	req := protocol.CommandRequest{
+		ToID:      to,
+		Command:   cmd,
+		FromNonce: nonce,
+	}
+
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	if err := app.writeSigned(protocol.TypeCommand, to, nonce, req); err != nil {
+		return err
 	}
 
-	return "", fmt.Errorf("unknown command")
+	return app.recordSent(usr, nonce, formatMessage("You", note, false))
 }
@@ -0,0 +1,329 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// ConnState represents the state of the connection to the cap.
+type ConnState string
+
+// Set of states the connection to the cap moves through.
+const (
+	ConnConnected    ConnState = "connected"
+	ConnDisconnected ConnState = "disconnected"
+	ConnReconnecting ConnState = "reconnecting"
+)
+
+// The cap pings every connection on a fixed interval. Missing a few pings in
+// a row means the connection is gone even if the socket looks open.
+const pingWait = 30 * time.Second
+
+// handshakeWait is how long the cap has to answer during the handshake.
+const handshakeWait = 10 * time.Second
+
+// Bounds of the wait between two reconnection attempts.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// pacer keeps the frames written to the cap within the rate limits the cap
+// announced in its welcome. Frames over the limits would be refused, and a
+// refused file chunk aborts the transfer. The cap takes from its buckets when
+// it reads a frame, frames written apart may arrive together, so the pacer
+// only uses half of each burst.
+type pacer struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+func newPacer(l *protocol.Limits) *pacer {
+	if l == nil {
+		return nil
+	}
+
+	var p pacer
+
+	if l.MessageBurst > 0 {
+		p.messages = rate.NewLimiter(rate.Limit(l.MessageRate), max(l.MessageBurst/2, 1))
+	}
+
+	if l.ByteBurst > 0 {
+		p.bytes = rate.NewLimiter(rate.Limit(l.ByteRate), max(l.ByteBurst/2, 1))
+	}
+
+	return &p
+}
+
+// wait blocks until a frame of the specified size can be written. A frame
+// larger than the byte burst is never accepted, it waits for a full bucket.
+func (p *pacer) wait(size int) {
+	if p == nil {
+		return
+	}
+
+	ctx := context.Background()
+
+	if p.messages != nil {
+		p.messages.Wait(ctx)
+	}
+
+	if p.bytes != nil {
+		p.bytes.WaitN(ctx, min(size, p.bytes.Burst()))
+	}
+}
+
+// pace waits until a frame of the specified size can be written to the cap.
+func (app *App) pace(size int) {
+	app.muWrite.Lock()
+	p := app.pacer
+	app.muWrite.Unlock()
+
+	p.wait(size)
+}
+
+// queued represents a signed frame waiting for the connection to come back.
+type queued struct {
+	toID  common.Address
+	nonce uint64
+	data  []byte
+}
+
+// writeSigned writes a frame carrying a nonce for the contact. While the
+// connection is down the frame is queued and written once the handshake is
+// done again. The cap rejects a frame it already accepted, so a frame that
+// failed to write is queued again without risk.
+func (app *App) writeSigned(typ protocol.Type, to common.Address, nonce uint64, payload any) error {
+	data, err := protocol.Encode(typ, payload)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", typ, err)
+	}
+
+	app.pace(len(data))
+
+	app.muWrite.Lock()
+
+	var werr error
+	if app.connected {
+		if werr = app.conn.WriteMessage(websocket.TextMessage, data); werr == nil {
+			app.muWrite.Unlock()
+			return nil
+		}
+	}
+
+	first := len(app.queue) == 0
+	app.queue = append(app.queue, queued{toID: to, nonce: nonce, data: data})
+
+	app.muWrite.Unlock()
+
+	// The UI is told outside the lock, it may call back into the app.
+
+	if werr != nil {
+		app.ui.WriteText("system", fmt.Sprintf("write: %s", werr))
+	}
+
+	if first {
+		app.ui.WriteText("system", "** not connected to the cap: messages are queued until the connection is back **")
+	}
+
+	return nil
+}
+
+// isConnected reports whether frames can be written to the cap.
+func (app *App) isConnected() bool {
+	app.muWrite.Lock()
+	defer app.muWrite.Unlock()
+
+	return app.connected
+}
+
+// resume makes the connection the one frames are written to, after writing
+// the queued frames to it. The frames for a contact are written in nonce
+// order so the cap and the contact accept them. The frames are paced without
+// holding the lock, frames sent in the meantime are queued after them.
+func (app *App) resume(conn *websocket.Conn, p *pacer) (int, error) {
+	app.muWrite.Lock()
+
+	app.pacer = p
+
+	slices.SortStableFunc(app.queue, func(a, b queued) int {
+		if c := cmp.Compare(a.toID.Hex(), b.toID.Hex()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.nonce, b.nonce)
+	})
+
+	app.muWrite.Unlock()
+
+	var n int
+
+	for {
+		app.muWrite.Lock()
+
+		if len(app.queue) == 0 {
+			app.conn = conn
+			app.connected = true
+			app.muWrite.Unlock()
+
+			return n, nil
+		}
+
+		q := app.queue[0]
+
+		app.muWrite.Unlock()
+
+		p.wait(len(q.data))
+
+		// Only resume takes frames off the queue, the frame is still first.
+
+		app.muWrite.Lock()
+
+		if err := conn.WriteMessage(websocket.TextMessage, q.data); err != nil {
+			app.muWrite.Unlock()
+			return 0, fmt.Errorf("flush: %w", err)
+		}
+
+		app.queue = app.queue[1:]
+		n++
+
+		app.muWrite.Unlock()
+	}
+}
+
+// disconnected is called when reading from the connection failed. Unless the
+// app is closing, the handshake is performed again in the background.
+func (app *App) disconnected(conn *websocket.Conn) {
+	app.muWrite.Lock()
+
+	if app.conn != conn || !app.connected {
+		app.muWrite.Unlock()
+		return
+	}
+
+	app.connected = false
+	closed := app.closed
+
+	app.muWrite.Unlock()
+
+	conn.Close()
+
+	if closed {
+		return
+	}
+
+	app.ui.UpdateConnection(ConnDisconnected)
+
+	go app.reconnect()
+}
+
+// reconnect performs the handshake until it succeeds, waiting longer after
+// every failed attempt.
+func (app *App) reconnect() {
+	wait := minBackoff
+
+	for attempt := 1; ; attempt++ {
+		app.ui.UpdateConnection(ConnReconnecting)
+
+		// The jitter keeps clients dropped by the same cap from coming back
+		// all at once.
+		time.Sleep(wait + rand.N(wait/2))
+
+		app.muWrite.Lock()
+		closed := app.closed
+		app.muWrite.Unlock()
+
+		if closed {
+			return
+		}
+
+		err := app.connect()
+		if err == nil {
+			return
+		}
+
+		app.ui.UpdateConnection(ConnDisconnected)
+		app.ui.WriteText("system", fmt.Sprintf("reconnect attempt %d: %s", attempt, err))
+
+		if !reconnectable(err) {
+			app.stop(closeNote(err))
+			return
+		}
+
+		wait = min(2*wait, maxBackoff)
+	}
+}
+
+// stop keeps the app from connecting again and tells the user why.
+func (app *App) stop(note string) {
+	app.muWrite.Lock()
+	app.closed = true
+	app.muWrite.Unlock()
+
+	app.ui.UpdateConnection(ConnDisconnected)
+	app.ui.WriteText("system", fmt.Sprintf("** %s: restart the app to connect again **", note))
+}
+
+// reconnectable reports whether connecting again can help after reading from
+// the cap failed. Only the closes the cap decides on for good are final, a
+// cap that is shutting down, restarting or failing, a connection that broke
+// or went silent, and a client that fell behind are all worth another try.
+func reconnectable(err error) bool {
+	return closeNote(err) == ""
+}
+
+// closeNote explains why the cap closed the connection for good. Nothing is
+// returned when connecting again can help.
+func closeNote(err error) string {
+	if errors.Is(err, protocol.ErrUnsupportedVersion) {
+		return "the cap does not support the app's protocol version"
+	}
+
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return ""
+	}
+
+	switch ce.Code {
+	case protocol.CloseUnsupportedVersion:
+		return "the cap does not support the app's protocol version"
+	case protocol.CloseUnauthenticated:
+		return "the cap could not authenticate this device"
+	case protocol.CloseKicked:
+		return fmt.Sprintf("disconnected by the cap's admin: %s", ce.Text)
+	case protocol.CloseRevoked:
+		return "this device was revoked by another device"
+	}
+
+	return ""
+}
+
+// keepAlive answers the cap's pings and pushes the read deadline back every
+// time one arrives, so a cap that stopped pinging is detected.
+func keepAlive(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(pingWait))
+
+	conn.SetPingHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(pingWait))
+
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+
+		var ne net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || (errors.As(err, &ne) && ne.Timeout()) {
+			return nil
+		}
+
+		return err
+	})
+}
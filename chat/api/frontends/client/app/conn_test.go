@@ -0,0 +1,63 @@
+package app_test
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func Test_Reconnectable(t *testing.T) {
+	closeErr := func(code int) error {
+		return fmt.Errorf("read: %w", &websocket.CloseError{Code: code, Text: "reason"})
+	}
+
+	tests := []struct {
+		name  string
+		err   error
+		final bool
+	}{
+		{"broken", io.ErrUnexpectedEOF, false},
+		{"reconnect", closeErr(protocol.CloseReconnect), false},
+		{"slowconsumer", closeErr(protocol.CloseSlowConsumer), false},
+		{"ratelimited", closeErr(protocol.CloseRateLimited), false},
+		{"alreadyconnected", closeErr(protocol.CloseAlreadyConnected), false},
+		{"handshaketimeout", closeErr(protocol.CloseHandshakeTimeout), false},
+		{"abnormal", closeErr(websocket.CloseAbnormalClosure), false},
+		{"goingaway", closeErr(websocket.CloseGoingAway), false},
+		{"internal", closeErr(websocket.CloseInternalServerErr), false},
+		{"restart", closeErr(websocket.CloseServiceRestart), false},
+		{"unsupportedversion", closeErr(protocol.CloseUnsupportedVersion), true},
+		{"unsupportedversionerr", fmt.Errorf("decode: %w", protocol.ErrUnsupportedVersion), true},
+		{"unauthenticated", closeErr(protocol.CloseUnauthenticated), true},
+		{"kicked", closeErr(protocol.CloseKicked), true},
+		{"revoked", closeErr(protocol.CloseRevoked), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := app.Reconnectable(tt.err); got == tt.final {
+				t.Logf("got: %v", got)
+				t.Logf("exp: %v", !tt.final)
+				t.Fatalf("Should decide whether to reconnect after %v", tt.err)
+			}
+
+			note := app.CloseNote(tt.err)
+			if (note != "") != tt.final {
+				t.Fatalf("Should only explain the final closes, got %q for %v", note, tt.err)
+			}
+		})
+	}
+}
+
+func Test_CloseNoteKicked(t *testing.T) {
+	err := &websocket.CloseError{Code: protocol.CloseKicked, Text: "be nice"}
+
+	note := app.CloseNote(err)
+	if note != "disconnected by the cap's admin: be nice" {
+		t.Fatalf("Should include the admin's reason, got %q", note)
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/signature"
+)
+
+// receiveSent stores and shows a message sent from another device of the
+// account. An encrypted message can only be read by the recipient, so only
+// the fact it was sent is shown.
+func (app *App) receiveSent(env protocol.Envelope) error {
+	var sm protocol.SentMessage
+	if err := env.Unmarshal(&sm); err != nil {
+		return err
+	}
+
+	msg := sm.Msg
+	if sm.Encrypted {
+		msg = "** encrypted message sent from another device **"
+	}
+
+	_, err := app.db.QueryContactByID(sm.ToID)
+	if err != nil {
+		switch sm.Group {
+		case nil:
+			_, err = app.db.InsertContact(sm.ToID, sm.ToID.Hex())
+			if err != nil {
+				return fmt.Errorf("add contact: %w", err)
+			}
+
+			app.ui.UpdateContact(sm.ToID.Hex(), sm.ToID.Hex())
+
+			if err := app.subscribePresence(sm.ToID); err != nil {
+				app.ui.WriteText("system", fmt.Sprintf("presence: %s", err))
+			}
+
+		default:
+			_, err = app.db.InsertGroup(sm.Group.ID, sm.Group.Name)
+			if err != nil {
+				return fmt.Errorf("add group: %w", err)
+			}
+
+			app.ui.UpdateContact(sm.Group.ID.Hex(), sm.Group.Name)
+		}
+	}
+
+	fm := formatMessage("You", msg, sm.Encrypted)
+
+	if err := app.db.InsertMessage(sm.ToID, fm); err != nil {
+		return fmt.Errorf("add message: %w", err)
+	}
+
+	app.ui.WriteText(sm.ToID.Hex(), fm)
+
+	return nil
+}
+
+// receiveDevices shows the devices of the account that are connected.
+func (app *App) receiveDevices(env protocol.Envelope) error {
+	var dm protocol.DevicesMessage
+	if err := env.Unmarshal(&dm); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString("** connected devices **")
+
+	for _, d := range dm.Devices {
+		b.WriteString("\n  ")
+		b.WriteString(d.ID)
+
+		if d.Current {
+			b.WriteString(" (this device)")
+		}
+	}
+
+	app.ui.WriteText("system", b.String())
+
+	return nil
+}
+
+// sendDevice lists the devices of the account that are connected or
+// disconnects one of them. A revoked device doesn't connect again until it
+// is restarted.
+//
+//	/devices
+//	/revoke <device>
+func (app *App) sendDevice(msg string) error {
+	parts := strings.Fields(msg)
+
+	var req protocol.DeviceRequest
+
+	switch {
+	case len(parts) == 1 && parts[0] == "/devices":
+		req.Action = protocol.DeviceList
+
+	case len(parts) == 2 && parts[0] == "/revoke":
+		if parts[1] == app.id.Device {
+			return fmt.Errorf("this device can't be revoked")
+		}
+
+		req.Action = protocol.DeviceRevoke
+		req.Device = parts[1]
+
+	default:
+		return fmt.Errorf("invalid device command format")
+	}
+
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	if err := app.writeFrame(protocol.TypeDevice, req); err != nil {
+		return err
+	}
+
+	if req.Action == protocol.DeviceRevoke {
+		app.ui.WriteText("system", fmt.Sprintf("** revoking device %s **", req.Device))
+	}
+
+	return nil
+}
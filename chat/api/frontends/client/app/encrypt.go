@@ -0,0 +1,125 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// encryptedMessage represents a message encrypted with a hybrid scheme. A
+// random AES key is encrypted with the contact's RSA public key using OAEP and
+// the message itself is encrypted with AES-GCM using that key. This allows
+// messages of any size to be sent.
+type encryptedMessage struct {
+	Key   []byte `json:"key"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func encryptMessage(pubKeyPEM string, msg string) (string, error) {
+	publicKey, err := parsePublicKey(pubKeyPEM)
+	if err != nil {
+		return "", fmt.Errorf("parse public key: %w", err)
+	}
+
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", fmt.Errorf("generating aes key: %w", err)
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+
+	encKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, aesKey, nil)
+	if err != nil {
+		return "", fmt.Errorf("encrypting aes key: %w", err)
+	}
+
+	em := encryptedMessage{
+		Key:   encKey,
+		Nonce: nonce,
+		Data:  gcm.Seal(nil, nonce, []byte(msg), nil),
+	}
+
+	data, err := json.Marshal(em)
+	if err != nil {
+		return "", fmt.Errorf("marshal: %w", err)
+	}
+
+	return string(data), nil
+}
+
+func decryptMessage(privateKey *rsa.PrivateKey, msg string) (string, error) {
+	var em encryptedMessage
+	if err := json.Unmarshal([]byte(msg), &em); err != nil {
+		return "", fmt.Errorf("unmarshal: %w", err)
+	}
+
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, em.Key, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting aes key: %w", err)
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return "", err
+	}
+
+	if len(em.Nonce) != gcm.NonceSize() {
+		return "", errors.New("invalid nonce size")
+	}
+
+	data, err := gcm.Open(nil, em.Nonce, em.Data, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting message: %w", err)
+	}
+
+	return string(data), nil
+}
+
+func newGCM(aesKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %w", err)
+	}
+
+	return gcm, nil
+}
+
+func parsePublicKey(pubKeyPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pubKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid key: Key must be a PEM encoded PKIX public key")
+	}
+
+	parsedKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, ok := parsedKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not a valid RSA public key")
+	}
+
+	return pk, nil
+}
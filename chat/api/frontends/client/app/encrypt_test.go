@@ -0,0 +1,122 @@
+package app_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
+)
+
+func Test_Encrypt(t *testing.T) {
+	pk, pubKeyPEM := newKey(t)
+
+	enc, err := app.EncryptMessage(pubKeyPEM, "hello bob")
+	if err != nil {
+		t.Fatalf("Should be able to encrypt the message: %s", err)
+	}
+
+	if strings.Contains(enc, "hello bob") {
+		t.Fatalf("Should not find the message in the encrypted text")
+	}
+
+	msg, err := app.DecryptMessage(pk, enc)
+	if err != nil {
+		t.Fatalf("Should be able to decrypt the message: %s", err)
+	}
+
+	if msg != "hello bob" {
+		t.Logf("got: %s", msg)
+		t.Logf("exp: %s", "hello bob")
+		t.Fatalf("Should get back the message.")
+	}
+}
+
+func Test_EncryptLong(t *testing.T) {
+	pk, pubKeyPEM := newKey(t)
+
+	// RSA-OAEP with a 2048 bit key and SHA-256 fits 190 bytes in one block.
+	long := strings.Repeat("a long message ", 1000)
+
+	enc, err := app.EncryptMessage(pubKeyPEM, long)
+	if err != nil {
+		t.Fatalf("Should be able to encrypt the message: %s", err)
+	}
+
+	msg, err := app.DecryptMessage(pk, enc)
+	if err != nil {
+		t.Fatalf("Should be able to decrypt the message: %s", err)
+	}
+
+	if msg != long {
+		t.Fatalf("Should get back the message, got %d bytes", len(msg))
+	}
+}
+
+func Test_DecryptTampered(t *testing.T) {
+	pk, pubKeyPEM := newKey(t)
+
+	enc, err := app.EncryptMessage(pubKeyPEM, "hello bob")
+	if err != nil {
+		t.Fatalf("Should be able to encrypt the message: %s", err)
+	}
+
+	var em struct {
+		Key   []byte `json:"key"`
+		Nonce []byte `json:"nonce"`
+		Data  []byte `json:"data"`
+	}
+
+	if err := json.Unmarshal([]byte(enc), &em); err != nil {
+		t.Fatalf("Should be able to unmarshal the encrypted message: %s", err)
+	}
+
+	em.Data[0] ^= 0xff
+
+	tampered, err := json.Marshal(em)
+	if err != nil {
+		t.Fatalf("Should be able to marshal the encrypted message: %s", err)
+	}
+
+	if _, err := app.DecryptMessage(pk, string(tampered)); err == nil {
+		t.Fatalf("Should not be able to decrypt a tampered message")
+	}
+}
+
+func Test_DecryptWrongKey(t *testing.T) {
+	_, pubKeyPEM := newKey(t)
+	otherPK, _ := newKey(t)
+
+	enc, err := app.EncryptMessage(pubKeyPEM, "hello bob")
+	if err != nil {
+		t.Fatalf("Should be able to encrypt the message: %s", err)
+	}
+
+	if _, err := app.DecryptMessage(otherPK, enc); err == nil {
+		t.Fatalf("Should not be able to decrypt with the wrong key")
+	}
+}
+
+// =============================================================================
+
+func newKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Should be able to generate a private key: %s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&pk.PublicKey)
+	if err != nil {
+		t.Fatalf("Should be able to marshal the public key: %s", err)
+	}
+
+	pubKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	return pk, string(pubKeyPEM)
+}
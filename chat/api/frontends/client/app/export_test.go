@@ -0,0 +1,30 @@
+package app
+
+import (
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+)
+
+// Set of unexported functions made available to the tests.
+var (
+	EncryptMessage = encryptMessage
+	DecryptMessage = decryptMessage
+	Reconnectable  = reconnectable
+	CloseNote      = closeNote
+)
+
+// SetTransferTimeout changes how long a transfer waits for the next chunk.
+func SetTransferTimeout(d time.Duration) {
+	transferTimeout = d
+}
+
+// ReceiveFile handles a file frame as if it was read from the cap.
+func (app *App) ReceiveFile(env protocol.Envelope) error {
+	return app.receiveFile(env)
+}
+
+// ReceiveReceipt handles a receipt frame as if it was read from the cap.
+func (app *App) ReceiveReceipt(env protocol.Envelope) error {
+	return app.receiveReceipt(env)
+}
@@ -0,0 +1,373 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/signature"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// filesDir is the directory under the config dir received files are saved in.
+const filesDir = "files"
+
+// transferTimeout is how long a transfer waits for the next chunk before the
+// partial file is removed.
+var transferTimeout = time.Minute
+
+// transfer tracks a file being received from a contact.
+type transfer struct {
+	name    string
+	size    int64
+	total   int
+	next    int
+	written int64
+	file    *os.File
+	hash    hash.Hash
+	updated time.Time
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// sendFile streams the file to the contact in signed chunks. Every chunk
+// uses its own nonce so the cap rejects replayed chunks like any other
+// message. Files are not encrypted. The transfer continues in the background
+// so the UI stays responsive, problems are reported in the system view.
+//
+//	/send <path>
+func (app *App) sendFile(to common.Address, msg string) error {
+	path := strings.TrimSpace(strings.TrimPrefix(msg, "/send"))
+	if path == "" {
+		return fmt.Errorf("missing file path")
+	}
+
+	usr, err := app.db.QueryContactByID(to)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	if usr.IsGroup {
+		return fmt.Errorf("files can't be sent to a group")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	if fi.IsDir() {
+		f.Close()
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	go func() {
+		defer f.Close()
+
+		if err := app.streamFile(to, f, fi.Name(), fi.Size()); err != nil {
+			app.ui.WriteText("system", fmt.Sprintf("send file %s: %s", fi.Name(), err))
+		}
+	}()
+
+	return nil
+}
+
+func (app *App) streamFile(to common.Address, f *os.File, name string, size int64) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hash: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("generating transfer id: %w", err)
+	}
+
+	total := int((size + protocol.MaxChunkSize - 1) / protocol.MaxChunkSize)
+	if total == 0 {
+		total = 1
+	}
+
+	// -------------------------------------------------------------------------
+
+	label := fmt.Sprintf("sending %s", name)
+	buf := make([]byte, protocol.MaxChunkSize)
+
+	var sent int64
+
+	for i := range total {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read: %w", err)
+		}
+
+		fc := protocol.FileChunk{
+			ID:    hex.EncodeToString(id),
+			Name:  name,
+			Size:  size,
+			Hash:  hex.EncodeToString(h.Sum(nil)),
+			Index: i,
+			Total: total,
+			Data:  buf[:n],
+		}
+
+		if err := app.sendChunk(to, fc); err != nil {
+			return err
+		}
+
+		sent += int64(n)
+		app.ui.Progress(to.Hex(), label, sent, size)
+	}
+
+	return nil
+}
+
+// sendChunk signs and sends one chunk of a file. The last chunk is recorded
+// in the contact's history so its delivery can be tracked like a message.
+func (app *App) sendChunk(to common.Address, fc protocol.FileChunk) error {
+	app.muSend.Lock()
+	defer app.muSend.Unlock()
+
+	usr, err := app.db.QueryContactByID(to)
+	if err != nil {
+		return fmt.Errorf("query contact: %w", err)
+	}
+
+	nonce := usr.AppLastNonce + 1
+
+	req := protocol.FileRequest{
+		ToID:      to,
+		Chunk:     fc,
+		FromNonce: nonce,
+	}
+
+	v, r, s, err := signature.Sign(req.SignedData(), app.id.PrivKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	if err := app.writeSigned(protocol.TypeFile, to, nonce, req); err != nil {
+		return err
+	}
+
+	if !fc.Last() {
+		if err := app.db.UpdateAppNonce(to, nonce); err != nil {
+			return fmt.Errorf("update app nonce: %w", err)
+		}
+		return nil
+	}
+
+	note := fmt.Sprintf("** sent file %s (%d bytes) **", fc.Name, fc.Size)
+
+	return app.recordSent(usr, nonce, formatMessage("You", note, false))
+}
+
+// =============================================================================
+
+// receiveFile writes a chunk of a file sent by a contact. Chunks must arrive
+// in order. Once the last chunk is written the file's hash is checked and the
+// file is moved into the files directory.
+func (app *App) receiveFile(env protocol.Envelope) error {
+	var fm protocol.FileMessage
+	if err := env.Unmarshal(&fm); err != nil {
+		return err
+	}
+
+	user, err := app.acceptNonce(fm.From)
+	if err != nil {
+		return err
+	}
+
+	fc := fm.Chunk
+	key := fm.From.ID.Hex() + "/" + fc.ID
+
+	app.muTransfers.Lock()
+	defer app.muTransfers.Unlock()
+
+	t, exists := app.transfers[key]
+
+	switch {
+	case fc.Index == 0 && !exists:
+		t, err = app.newTransfer(key, fc)
+		if err != nil {
+			return err
+		}
+		app.transfers[key] = t
+
+	case !exists:
+		return fmt.Errorf("file %s: chunk %d for an unknown transfer", fc.Name, fc.Index)
+	}
+
+	if err := t.write(fc); err != nil {
+		app.abortTransfer(key)
+		return fmt.Errorf("file %s: %w", t.name, err)
+	}
+
+	t.updated = time.Now()
+	t.timer.Reset(t.timeout)
+
+	app.ui.Progress(user.ID.Hex(), fmt.Sprintf("receiving %s", t.name), t.written, t.size)
+
+	if !fc.Last() {
+		return nil
+	}
+
+	// -------------------------------------------------------------------------
+
+	path, err := t.finish(fc.Hash, filepath.Join(app.filePath, filesDir))
+	if err != nil {
+		app.abortTransfer(key)
+		return fmt.Errorf("file %s: %w", t.name, err)
+	}
+
+	t.timer.Stop()
+	delete(app.transfers, key)
+
+	note := fmt.Sprintf("** received file %s (%d bytes) from %s, saved to %s **", t.name, t.size, user.Name, path)
+
+	return app.recordReceived(user, fm.From, formatMessage(user.Name, note, false))
+}
+
+// newTransfer creates the partial file a transfer is written to. The partial
+// file is removed when no chunk arrives within the transfer timeout.
+func (app *App) newTransfer(key string, fc protocol.FileChunk) (*transfer, error) {
+	// The name comes from the contact, never let it pick the directory.
+	name := filepath.Base(fc.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, fmt.Errorf("invalid file name %q", fc.Name)
+	}
+
+	dir := filepath.Join(app.filePath, filesDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("files dir: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, name+".*.part")
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	t := transfer{
+		name:    name,
+		size:    fc.Size,
+		total:   fc.Total,
+		file:    f,
+		hash:    sha256.New(),
+		updated: time.Now(),
+		timeout: transferTimeout,
+	}
+
+	t.timer = time.AfterFunc(t.timeout, func() {
+		app.expireTransfer(key, &t)
+	})
+
+	return &t, nil
+}
+
+// expireTransfer removes a transfer that stopped receiving chunks, the sender
+// went away before the file was complete.
+func (app *App) expireTransfer(key string, t *transfer) {
+	app.muTransfers.Lock()
+	defer app.muTransfers.Unlock()
+
+	// A chunk may have arrived while the timer fired, the timer was then
+	// started again.
+	if app.transfers[key] != t || time.Since(t.updated) < t.timeout {
+		return
+	}
+
+	app.abortTransfer(key)
+
+	app.ui.WriteText("system", fmt.Sprintf("file %s: no chunk received for %s, transfer dropped", t.name, t.timeout))
+}
+
+// abortTransfer removes the transfer and its partial file. The caller must
+// hold muTransfers.
+func (app *App) abortTransfer(key string) {
+	t, exists := app.transfers[key]
+	if !exists {
+		return
+	}
+
+	t.timer.Stop()
+	t.file.Close()
+	os.Remove(t.file.Name())
+
+	delete(app.transfers, key)
+}
+
+// =============================================================================
+
+func (t *transfer) write(fc protocol.FileChunk) error {
+	if fc.Index != t.next || fc.Total != t.total {
+		return fmt.Errorf("got chunk %d of %d, expected chunk %d of %d", fc.Index, fc.Total, t.next, t.total)
+	}
+
+	if t.written+int64(len(fc.Data)) > t.size {
+		return fmt.Errorf("more data than the %d bytes announced", t.size)
+	}
+
+	if _, err := t.file.Write(fc.Data); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	t.hash.Write(fc.Data)
+	t.written += int64(len(fc.Data))
+	t.next++
+
+	return nil
+}
+
+// finish checks the file is complete and moves it to the directory without
+// replacing an existing file. It returns the path of the file.
+func (t *transfer) finish(expHash string, dir string) (string, error) {
+	if err := t.file.Close(); err != nil {
+		return "", fmt.Errorf("close: %w", err)
+	}
+
+	if t.written != t.size {
+		return "", fmt.Errorf("got %d bytes, expected %d", t.written, t.size)
+	}
+
+	if got := hex.EncodeToString(t.hash.Sum(nil)); got != expHash {
+		return "", fmt.Errorf("hash mismatch: got %s, expected %s", got, expHash)
+	}
+
+	ext := filepath.Ext(t.name)
+	base := strings.TrimSuffix(t.name, ext)
+
+	path := filepath.Join(dir, t.name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+
+	if err := os.Rename(t.file.Name(), path); err != nil {
+		return "", fmt.Errorf("rename: %w", err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,215 @@
+package app_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/storage/dbfile"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var bob = common.HexToAddress("0x1")
+
+func Test_ReceiveFile(t *testing.T) {
+	a, _, dir := newApp(t)
+
+	data := []byte("hello bob")
+
+	fc := protocol.FileChunk{
+		ID:    "1",
+		Name:  "hello.txt",
+		Size:  int64(len(data)),
+		Hash:  hashOf(data),
+		Total: 1,
+		Data:  data,
+	}
+
+	if err := a.ReceiveFile(fileEnv(t, 1, fc)); err != nil {
+		t.Fatalf("Should be able to receive the file: %s", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "files", "hello.txt"))
+	if err != nil {
+		t.Fatalf("Should be able to read the received file: %s", err)
+	}
+
+	if string(got) != string(data) {
+		t.Logf("got: %s", got)
+		t.Logf("exp: %s", data)
+		t.Fatalf("Should receive the file's content.")
+	}
+
+	checkNoParts(t, dir)
+}
+
+func Test_ReceiveFileBadHash(t *testing.T) {
+	a, _, dir := newApp(t)
+
+	fc := protocol.FileChunk{
+		ID:    "1",
+		Name:  "hello.txt",
+		Size:  9,
+		Hash:  hashOf([]byte("something else")),
+		Total: 1,
+		Data:  []byte("hello bob"),
+	}
+
+	if err := a.ReceiveFile(fileEnv(t, 1, fc)); err == nil {
+		t.Fatal("Should refuse a file with the wrong hash")
+	}
+
+	checkNoParts(t, dir)
+}
+
+func Test_ReceiveFileOutOfOrder(t *testing.T) {
+	a, _, dir := newApp(t)
+
+	fc := protocol.FileChunk{
+		ID:    "1",
+		Name:  "hello.txt",
+		Size:  9,
+		Hash:  hashOf([]byte("hello bob")),
+		Total: 3,
+		Data:  []byte("hel"),
+	}
+
+	if err := a.ReceiveFile(fileEnv(t, 1, fc)); err != nil {
+		t.Fatalf("Should be able to receive the first chunk: %s", err)
+	}
+
+	fc.Index = 2
+	fc.Data = []byte("bob")
+
+	if err := a.ReceiveFile(fileEnv(t, 2, fc)); err == nil {
+		t.Fatal("Should refuse a chunk out of order")
+	}
+
+	checkNoParts(t, dir)
+}
+
+func Test_ReceiveFileTimeout(t *testing.T) {
+	app.SetTransferTimeout(100 * time.Millisecond)
+	t.Cleanup(func() {
+		app.SetTransferTimeout(time.Minute)
+	})
+
+	a, _, dir := newApp(t)
+
+	fc := protocol.FileChunk{
+		ID:    "1",
+		Name:  "hello.txt",
+		Size:  9,
+		Hash:  hashOf([]byte("hello bob")),
+		Total: 3,
+		Data:  []byte("hel"),
+	}
+
+	if err := a.ReceiveFile(fileEnv(t, 1, fc)); err != nil {
+		t.Fatalf("Should be able to receive the first chunk: %s", err)
+	}
+
+	if len(parts(t, dir)) != 1 {
+		t.Fatal("Should write the chunk to a partial file")
+	}
+
+	for range 50 {
+		if len(parts(t, dir)) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatal("Should remove the partial file once no chunk arrives")
+}
+
+// =============================================================================
+
+// newApp returns an app that knows bob, its storage and the directory its
+// files are saved in.
+func newApp(t *testing.T) (*app.App, *dbfile.DB, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	db, err := dbfile.NewDB(dir, common.HexToAddress("0xF"))
+	if err != nil {
+		t.Fatalf("Should be able to create the db: %s", err)
+	}
+
+	if _, err := db.InsertContact(bob, "Bob"); err != nil {
+		t.Fatalf("Should be able to insert the contact: %s", err)
+	}
+
+	id, err := app.NewID(dir)
+	if err != nil {
+		t.Fatalf("Should be able to create the id: %s", err)
+	}
+
+	return app.NewApp(db, ui{}, id, "", dir), db, dir
+}
+
+// fileEnv returns the frame the cap sends for a chunk bob sent.
+func fileEnv(t *testing.T, nonce uint64, fc protocol.FileChunk) protocol.Envelope {
+	t.Helper()
+
+	fm := protocol.FileMessage{
+		From:  protocol.From{ID: bob, Name: "Bob", Nonce: nonce},
+		Chunk: fc,
+	}
+
+	data, err := protocol.Encode(protocol.TypeFile, fm)
+	if err != nil {
+		t.Fatalf("Should be able to encode the frame: %s", err)
+	}
+
+	env, err := protocol.Decode(data)
+	if err != nil {
+		t.Fatalf("Should be able to decode the frame: %s", err)
+	}
+
+	return env
+}
+
+func hashOf(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// parts returns the partial files in the files directory.
+func parts(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "files", "*.part"))
+	if err != nil {
+		t.Fatalf("Should be able to list the partial files: %s", err)
+	}
+
+	return matches
+}
+
+func checkNoParts(t *testing.T, dir string) {
+	t.Helper()
+
+	if got := parts(t, dir); len(got) != 0 {
+		t.Fatalf("Should remove the partial files, got %v", got)
+	}
+}
+
+// =============================================================================
+
+// ui discards everything the app displays.
+type ui struct{}
+
+func (ui) Run() error                                                { return nil }
+func (ui) WriteText(id string, msg string)                           {}
+func (ui) UpdateContact(id string, name string)                      {}
+func (ui) Refresh(id string)                                         {}
+func (ui) UpdateStatus(id string, status string, lastSeen time.Time) {}
+func (ui) UpdateConnection(state app.ConnState)                      {}
+func (ui) Progress(id string, label string, done int64, total int64) {}
@@ -2,6 +2,13 @@ package app
 
 import "fmt"
 
-func formatMessage(name string, msg string) string {
+// lockIndicator is displayed next to messages that were end-to-end encrypted.
+const lockIndicator = "🔒"
+
+func formatMessage(name string, msg string, encrypted bool) string {
+	if encrypted {
+		return fmt.Sprintf("%s %s: %s", lockIndicator, name, msg)
+	}
+
 	return fmt.Sprintf("%s: %s", name, msg)
 }
@@ -6,12 +6,14 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -19,12 +21,17 @@ import (
 
 const idFileName = "key.ecdsa"
 const encFileName = "key.rsa"
+const deviceFileName = "device"
 
+// ID represents the account and the device the client runs on. The keys can
+// be copied to another device to use the account from both, the device file
+// must not be copied so each device keeps its own id.
 type ID struct {
 	MyAccountID  common.Address
 	PrivKeyECDSA *ecdsa.PrivateKey
 	PrivKeyRSA   *rsa.PrivateKey
 	PubKeyRSA    string
+	Device       string
 }
 
 func NewID(filePath string) (ID, error) {
@@ -84,11 +91,33 @@ func NewID(filePath string) (ID, error) {
 		return ID{}, fmt.Errorf("encoding to public PEM: %w", err)
 	}
 
+	// -------------------------------------------------------------------------
+
+	fileName = filepath.Join(filePath, "id", deviceFileName)
+
+	var device string
+
+	_, err = os.Stat(fileName)
+	switch {
+	case err != nil:
+		device, err = createDevice(fileName)
+
+	default:
+		device, err = readDevice(fileName)
+	}
+
+	if err != nil {
+		return ID{}, fmt.Errorf("id: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+
 	id := ID{
 		MyAccountID:  addr,
 		PrivKeyECDSA: pkECDSA,
 		PrivKeyRSA:   pkRSA,
 		PubKeyRSA:    buf.String(),
+		Device:       device,
 	}
 
 	return id, nil
@@ -177,3 +206,27 @@ func readKeyEnc(fileName string) (*rsa.PrivateKey, error) {
 
 	return pk, nil
 }
+
+func createDevice(fileName string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating device: %w", err)
+	}
+
+	device := hex.EncodeToString(b)
+
+	if err := os.WriteFile(fileName, []byte(device), 0600); err != nil {
+		return "", fmt.Errorf("writing device file: %w", err)
+	}
+
+	return device, nil
+}
+
+func readDevice(fileName string) (string, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", fmt.Errorf("reading device file: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
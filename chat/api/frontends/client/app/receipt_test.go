@@ -0,0 +1,69 @@
+package app_test
+
+import (
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+)
+
+func Test_ReceiveReceipt(t *testing.T) {
+	a, db, dir := newApp(t)
+
+	// The id is read back from the files the app was created with.
+	id, err := app.NewID(dir)
+	if err != nil {
+		t.Fatalf("Should be able to read the id: %s", err)
+	}
+
+	if err := db.InsertSentMessage(bob, 1, "hello bob"); err != nil {
+		t.Fatalf("Should be able to insert a sent message: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		state  string
+		exp    string
+	}{
+		{"other device", "other", protocol.ReceiptDelivered, "hello bob (sent)"},
+		{"this device", id.Device, protocol.ReceiptDelivered, "hello bob (delivered)"},
+		{"no device", "", protocol.ReceiptRead, "hello bob (read)"},
+	}
+
+	for _, tt := range tests {
+		rct := protocol.ReceiptMessage{
+			From: protocol.From{ID: bob, Name: "Bob"},
+			Receipt: protocol.Receipt{
+				Nonce:  1,
+				State:  tt.state,
+				Device: tt.device,
+			},
+		}
+
+		data, err := protocol.Encode(protocol.TypeReceipt, rct)
+		if err != nil {
+			t.Fatalf("Should be able to encode the frame: %s", err)
+		}
+
+		env, err := protocol.Decode(data)
+		if err != nil {
+			t.Fatalf("Should be able to decode the frame: %s", err)
+		}
+
+		if err := a.ReceiveReceipt(env); err != nil {
+			t.Fatalf("Should be able to receive the receipt from %s: %s", tt.name, err)
+		}
+
+		usr, err := db.QueryContactByID(bob)
+		if err != nil {
+			t.Fatalf("Should be able to query bob: %s", err)
+		}
+
+		if len(usr.Messages) != 1 || usr.Messages[0] != tt.exp {
+			t.Logf("got: %v", usr.Messages)
+			t.Logf("exp: %v", tt.exp)
+			t.Fatalf("Should apply the receipt sent for %s only when it's about this device's messages.", tt.name)
+		}
+	}
+}
@@ -39,7 +39,7 @@ func run() error {
 
 	// -------------------------------------------------------------------------
 
-	app := app.NewApp(db, ui, id, url)
+	app := app.NewApp(db, ui, id, url, configFilePath)
 	defer app.Close()
 
 	ui.SetApp(app)
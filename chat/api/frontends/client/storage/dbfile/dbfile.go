@@ -2,6 +2,7 @@ package dbfile
 
 import (
 	"fmt"
+	"maps"
 	"sync"
 
 	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
@@ -25,8 +26,10 @@ func NewDB(filePath string, myAccountID common.Address) (*DB, error) {
 		contacts[usr.ID] = app.User{
 			ID:           usr.ID,
 			Name:         usr.Name,
+			IsGroup:      usr.IsGroup,
 			AppLastNonce: usr.AppLastNonce,
 			LastNonce:    usr.LastNonce,
+			DeviceNonces: usr.DeviceNonces,
 			Key:          usr.Key,
 		}
 	}
@@ -71,7 +74,7 @@ func (db *DB) QueryContactByID(id common.Address) (app.User, error) {
 	}
 
 	if len(u.Messages) == 0 {
-		msgs, err := readMsgsFromDisk(id)
+		msgs, err := readMessages(id)
 		if err != nil {
 			return app.User{}, fmt.Errorf("read messages: %w", err)
 		}
@@ -84,6 +87,14 @@ func (db *DB) QueryContactByID(id common.Address) (app.User, error) {
 }
 
 func (db *DB) InsertContact(id common.Address, name string) (app.User, error) {
+	return db.insert(id, name, false)
+}
+
+func (db *DB) InsertGroup(id common.Address, name string) (app.User, error) {
+	return db.insert(id, name, true)
+}
+
+func (db *DB) insert(id common.Address, name string, isGroup bool) (app.User, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -91,8 +102,9 @@ func (db *DB) InsertContact(id common.Address, name string) (app.User, error) {
 	// Update in the in-memory cache of contacts.
 
 	db.contacts[id] = app.User{
-		ID:   id,
-		Name: name,
+		ID:      id,
+		Name:    name,
+		IsGroup: isGroup,
 	}
 
 	// -------------------------------------------------------------------------
@@ -104,8 +116,9 @@ func (db *DB) InsertContact(id common.Address, name string) (app.User, error) {
 	}
 
 	dfu := dataFileUser{
-		ID:   id,
-		Name: name,
+		ID:      id,
+		Name:    name,
+		IsGroup: isGroup,
 	}
 
 	df.Contacts = append(df.Contacts, dfu)
@@ -116,8 +129,9 @@ func (db *DB) InsertContact(id common.Address, name string) (app.User, error) {
 	// Return the new contact.
 
 	u := app.User{
-		ID:   id,
-		Name: name,
+		ID:      id,
+		Name:    name,
+		IsGroup: isGroup,
 	}
 
 	return u, nil
@@ -142,6 +156,86 @@ func (db *DB) InsertMessage(id common.Address, msg string) error {
 	return nil
 }
 
+// InsertSentMessage stores a message we sent to the contact. The state of
+// the message is kept next to the message file.
+func (db *DB) InsertSentMessage(id common.Address, nonce uint64, msg string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	msgs, err := readMsgsFromDisk(id)
+	if err != nil {
+		return fmt.Errorf("read messages: %w", err)
+	}
+
+	sent, err := readSentFromDisk(id)
+	if err != nil {
+		return fmt.Errorf("read sent: %w", err)
+	}
+
+	if err := flushMsgToDisk(id, msg); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+
+	sent = append(sent, sentMessage{Line: len(msgs), Nonce: nonce, State: int(app.StateSent)})
+
+	if err := flushSentToDisk(id, sent); err != nil {
+		return fmt.Errorf("write sent: %w", err)
+	}
+
+	u.Messages = withMarkers(append(msgs, msg), sent)
+	db.contacts[id] = u
+
+	return nil
+}
+
+// UpdateMessageState moves every message sent to the contact up to and
+// including the nonce forward to the specified state.
+func (db *DB) UpdateMessageState(id common.Address, nonce uint64, state app.MessageState) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	sent, err := readSentFromDisk(id)
+	if err != nil {
+		return fmt.Errorf("read sent: %w", err)
+	}
+
+	var changed bool
+	for i, sm := range sent {
+		if sm.Nonce > 0 && sm.Nonce <= nonce && sm.State < int(state) {
+			sent[i].State = int(state)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := flushSentToDisk(id, sent); err != nil {
+		return fmt.Errorf("write sent: %w", err)
+	}
+
+	msgs, err := readMsgsFromDisk(id)
+	if err != nil {
+		return fmt.Errorf("read messages: %w", err)
+	}
+
+	u.Messages = withMarkers(msgs, sent)
+	db.contacts[id] = u
+
+	return nil
+}
+
 func (db *DB) UpdateAppNonce(id common.Address, nonce uint64) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -214,6 +308,52 @@ func (db *DB) UpdateContactNonce(id common.Address, nonce uint64) error {
 	return nil
 }
 
+// UpdateDeviceNonce records the last nonce received from the contact's
+// device.
+func (db *DB) UpdateDeviceNonce(id common.Address, device string, nonce uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// -------------------------------------------------------------------------
+	// Update in the in-memory cache of contacts.
+
+	u, exists := db.contacts[id]
+	if !exists {
+		return fmt.Errorf("contact not found")
+	}
+
+	u.DeviceNonces = maps.Clone(u.DeviceNonces)
+	if u.DeviceNonces == nil {
+		u.DeviceNonces = make(map[string]uint64)
+	}
+
+	u.DeviceNonces[device] = nonce
+
+	db.contacts[id] = u
+
+	// -------------------------------------------------------------------------
+	// Update the local file.
+
+	df, err := readDBFromDisk()
+	if err != nil {
+		return fmt.Errorf("config read: %w", err)
+	}
+
+	for i, contact := range df.Contacts {
+		if contact.ID == id {
+			if df.Contacts[i].DeviceNonces == nil {
+				df.Contacts[i].DeviceNonces = make(map[string]uint64)
+			}
+			df.Contacts[i].DeviceNonces[device] = nonce
+			break
+		}
+	}
+
+	flushDBToDisk(df)
+
+	return nil
+}
+
 func (db *DB) UpdateContactKey(id common.Address, key string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -249,3 +389,29 @@ func (db *DB) UpdateContactKey(id common.Address, key string) error {
 
 	return nil
 }
+
+// readMessages reads the messages of the contact with the state of the ones
+// we sent.
+func readMessages(id common.Address) ([]string, error) {
+	msgs, err := readMsgsFromDisk(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sent, err := readSentFromDisk(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return withMarkers(msgs, sent), nil
+}
+
+func withMarkers(msgs []string, sent []sentMessage) []string {
+	for _, sm := range sent {
+		if sm.Line < len(msgs) {
+			msgs[sm.Line] += app.MessageState(sm.State).Marker()
+		}
+	}
+
+	return msgs
+}
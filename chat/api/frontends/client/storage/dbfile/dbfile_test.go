@@ -0,0 +1,83 @@
+package dbfile_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/storage/dbfile"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func Test_MessageState(t *testing.T) {
+	dir := t.TempDir()
+
+	me := common.HexToAddress("0xF")
+	bob := common.HexToAddress("0x1")
+
+	db, err := dbfile.NewDB(dir, me)
+	if err != nil {
+		t.Fatalf("Should be able to create the db: %s", err)
+	}
+
+	if _, err := db.InsertContact(bob, "Bob"); err != nil {
+		t.Fatalf("Should be able to insert the contact: %s", err)
+	}
+
+	if err := db.InsertSentMessage(bob, 1, "hello bob"); err != nil {
+		t.Fatalf("Should be able to insert a sent message: %s", err)
+	}
+
+	if err := db.InsertMessage(bob, "hello you"); err != nil {
+		t.Fatalf("Should be able to insert a message: %s", err)
+	}
+
+	if err := db.InsertSentMessage(bob, 2, "how are you"); err != nil {
+		t.Fatalf("Should be able to insert a sent message: %s", err)
+	}
+
+	check(t, db, bob, []string{"hello bob (sent)", "hello you", "how are you (sent)"})
+
+	if err := db.UpdateMessageState(bob, 2, app.StateDelivered); err != nil {
+		t.Fatalf("Should be able to update the message state: %s", err)
+	}
+
+	if err := db.UpdateMessageState(bob, 1, app.StateRead); err != nil {
+		t.Fatalf("Should be able to update the message state: %s", err)
+	}
+
+	// A late delivered receipt doesn't move a read message back.
+
+	if err := db.UpdateMessageState(bob, 1, app.StateDelivered); err != nil {
+		t.Fatalf("Should be able to update the message state: %s", err)
+	}
+
+	exp := []string{"hello bob (read)", "hello you", "how are you (delivered)"}
+
+	check(t, db, bob, exp)
+
+	// -------------------------------------------------------------------------
+	// The states are read back from the files.
+
+	db, err = dbfile.NewDB(dir, me)
+	if err != nil {
+		t.Fatalf("Should be able to open the db again: %s", err)
+	}
+
+	check(t, db, bob, exp)
+}
+
+func check(t *testing.T, db *dbfile.DB, id common.Address, exp []string) {
+	t.Helper()
+
+	usr, err := db.QueryContactByID(id)
+	if err != nil {
+		t.Fatalf("Should be able to query the contact: %s", err)
+	}
+
+	if !slices.Equal(usr.Messages, exp) {
+		t.Logf("got: %q", usr.Messages)
+		t.Logf("exp: %q", exp)
+		t.Fatalf("Should get the messages with their state.")
+	}
+}
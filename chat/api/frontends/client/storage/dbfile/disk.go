@@ -28,11 +28,21 @@ type myAccount struct {
 }
 
 type dataFileUser struct {
-	ID           common.Address `json:"id"`
-	Name         string         `json:"name"`
-	AppLastNonce uint64         `json:"app_last_nonce"`
-	LastNonce    uint64         `json:"last_nonce"`
-	Key          string         `json:"key,omitempty"`
+	ID           common.Address    `json:"id"`
+	Name         string            `json:"name"`
+	IsGroup      bool              `json:"is_group,omitempty"`
+	AppLastNonce uint64            `json:"app_last_nonce"`
+	LastNonce    uint64            `json:"last_nonce"`
+	DeviceNonces map[string]uint64 `json:"device_nonces,omitempty"`
+	Key          string            `json:"key,omitempty"`
+}
+
+// sentMessage represents the state of a message we sent, the message being
+// the line of the contact's message file.
+type sentMessage struct {
+	Line  int    `json:"line"`
+	Nonce uint64 `json:"nonce"`
+	State int    `json:"state"`
 }
 
 type dataFile struct {
@@ -184,3 +194,41 @@ func flushMsgToDisk(id common.Address, msg string) error {
 
 	return nil
 }
+
+func readSentFromDisk(id common.Address) ([]sentMessage, error) {
+	fileName := filepath.Join(dbMsgsDir, id.Hex()+".sent")
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	var sent []sentMessage
+	if err := json.NewDecoder(f).Decode(&sent); err != nil {
+		return nil, fmt.Errorf("sent file decode: %w", err)
+	}
+
+	return sent, nil
+}
+
+func flushSentToDisk(id common.Address, sent []sentMessage) error {
+	fileName := filepath.Join(dbMsgsDir, id.Hex()+".sent")
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("sent file create: %w", err)
+	}
+	defer f.Close()
+
+	jsonSent, err := json.Marshal(sent)
+	if err != nil {
+		return fmt.Errorf("sent file marshal: %w", err)
+	}
+
+	if _, err := f.Write(jsonSent); err != nil {
+		return fmt.Errorf("sent file write: %w", err)
+	}
+
+	return nil
+}
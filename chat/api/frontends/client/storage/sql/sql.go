@@ -28,18 +28,28 @@ type myAccount struct {
 }
 
 type user struct {
-	ID           string    `gorm:"primaryKey;column:id"`
-	Name         string    `gorm:"column:name"`
-	AppLastNonce uint64    `gorm:"column:app_last_nonce"`
-	LastNonce    uint64    `gorm:"column:last_nonce"`
-	Key          string    `gorm:"column:key"`
-	Messages     []message `gorm:"foreignKey:UserID;column:messages"`
+	ID           string        `gorm:"primaryKey;column:id"`
+	Name         string        `gorm:"column:name"`
+	IsGroup      bool          `gorm:"column:is_group"`
+	AppLastNonce uint64        `gorm:"column:app_last_nonce"`
+	LastNonce    uint64        `gorm:"column:last_nonce"`
+	Key          string        `gorm:"column:key"`
+	Messages     []message     `gorm:"foreignKey:UserID;column:messages"`
+	DeviceNonces []deviceNonce `gorm:"foreignKey:UserID"`
 }
 
 type message struct {
 	ID     uint64 `gorm:"primaryKey;column:id"`
 	Msg    string `gorm:"column:msg"`
 	UserID string `gorm:"column:user_id"`
+	Nonce  uint64 `gorm:"column:nonce"`
+	State  int    `gorm:"column:state"`
+}
+
+type deviceNonce struct {
+	UserID string `gorm:"primaryKey;column:user_id"`
+	Device string `gorm:"primaryKey;column:device"`
+	Nonce  uint64 `gorm:"column:nonce"`
 }
 
 func NewDB(filePath string, myAccountID common.Address) (*DB, error) {
@@ -54,7 +64,7 @@ func NewDB(filePath string, myAccountID common.Address) (*DB, error) {
 		return nil, fmt.Errorf("gorm open: %w", err)
 	}
 
-	if err := db.AutoMigrate(&user{}, &message{}, myAccount{}); err != nil {
+	if err := db.AutoMigrate(&user{}, &message{}, &deviceNonce{}, myAccount{}); err != nil {
 		return nil, fmt.Errorf("auto migrate: %w", err)
 	}
 
@@ -108,44 +118,57 @@ func (db *DB) InsertContact(id common.Address, name string) (app.User, error) {
 	}, nil
 }
 
+func (db *DB) InsertGroup(id common.Address, name string) (app.User, error) {
+	res := db.db.Create(&user{
+		ID:      id.Hex(),
+		Name:    name,
+		IsGroup: true,
+	})
+
+	if res.Error != nil {
+		return app.User{}, fmt.Errorf("insert group: %w", res.Error)
+	}
+
+	return app.User{
+		ID:      id,
+		Name:    name,
+		IsGroup: true,
+	}, nil
+}
+
 func (db *DB) QueryContactByID(id common.Address) (app.User, error) {
 	var user user
-	if err := db.db.Preload("Messages").Where("LOWER(id) = LOWER(?)", id.Hex()).First(&user).Error; err != nil {
+	if err := db.db.Preload("Messages").Preload("DeviceNonces").Where("LOWER(id) = LOWER(?)", id.Hex()).First(&user).Error; err != nil {
 		return app.User{}, fmt.Errorf("query contact: %s %w", id.Hex(), err)
 	}
 
-	msgs := make([]string, len(user.Messages))
-	for i, msg := range user.Messages {
-		msgs[i] = msg.Msg
-	}
-
 	return app.User{
 		ID:           common.HexToAddress(user.ID),
 		Name:         user.Name,
+		IsGroup:      user.IsGroup,
 		AppLastNonce: user.AppLastNonce,
 		LastNonce:    user.LastNonce,
+		DeviceNonces: toAppDeviceNonces(user.DeviceNonces),
 		Key:          user.Key,
-		Messages:     msgs,
+		Messages:     toAppMessages(user.Messages),
 	}, nil
 }
 
 func (db *DB) Contacts() []app.User {
 	var users []user
-	db.db.Preload("Messages").Find(&users)
+	db.db.Preload("Messages").Preload("DeviceNonces").Find(&users)
 
 	contacts := make([]app.User, len(users))
 	for i, user := range users {
-		msgs := make([]string, len(user.Messages))
-		for j, msg := range user.Messages {
-			msgs[j] = msg.Msg
-		}
 		contacts[i] = app.User{
 			ID:           common.HexToAddress(user.ID),
 			Name:         user.Name,
+			IsGroup:      user.IsGroup,
 			AppLastNonce: user.AppLastNonce,
 			LastNonce:    user.LastNonce,
+			DeviceNonces: toAppDeviceNonces(user.DeviceNonces),
 			Key:          user.Key,
-			Messages:     msgs,
+			Messages:     toAppMessages(user.Messages),
 		}
 	}
 	return contacts
@@ -164,6 +187,33 @@ func (db *DB) InsertMessage(id common.Address, msg string) error {
 	return nil
 }
 
+func (db *DB) InsertSentMessage(id common.Address, nonce uint64, msg string) error {
+	res := db.db.Create(&message{
+		Msg:    msg,
+		UserID: id.Hex(),
+		Nonce:  nonce,
+		State:  int(app.StateSent),
+	})
+
+	if res.Error != nil {
+		return fmt.Errorf("insert sent message: %w", res.Error)
+	}
+
+	return nil
+}
+
+// UpdateMessageState moves every message sent to the contact up to and
+// including the nonce forward to the specified state.
+func (db *DB) UpdateMessageState(id common.Address, nonce uint64, state app.MessageState) error {
+	res := db.db.Model(&message{}).
+		Where("LOWER(user_id) = LOWER(?) AND nonce > 0 AND nonce <= ? AND state < ?", id.Hex(), nonce, int(state)).
+		Update("state", int(state))
+	if res.Error != nil {
+		return fmt.Errorf("update message state: %w", res.Error)
+	}
+	return nil
+}
+
 func (db *DB) UpdateAppNonce(id common.Address, nonce uint64) error {
 	res := db.db.Model(&user{}).Where("LOWER(id) = LOWER(?)", id.Hex()).Update("app_last_nonce", nonce)
 	if res.Error != nil {
@@ -180,6 +230,20 @@ func (db *DB) UpdateContactNonce(id common.Address, nonce uint64) error {
 	return nil
 }
 
+// UpdateDeviceNonce records the last nonce received from the contact's
+// device.
+func (db *DB) UpdateDeviceNonce(id common.Address, device string, nonce uint64) error {
+	res := db.db.Save(&deviceNonce{
+		UserID: id.Hex(),
+		Device: device,
+		Nonce:  nonce,
+	})
+	if res.Error != nil {
+		return fmt.Errorf("update device nonce: %w", res.Error)
+	}
+	return nil
+}
+
 func (db *DB) UpdateContactKey(id common.Address, key string) error {
 	res := db.db.Model(&user{}).Where("LOWER(id) = LOWER(?)", id.Hex()).Update("key", key)
 	if res.Error != nil {
@@ -189,13 +253,29 @@ func (db *DB) UpdateContactKey(id common.Address, key string) error {
 }
 
 func (db *DB) CleanTables() error {
-	if err := db.db.Migrator().DropTable(&user{}, &message{}); err != nil {
+	if err := db.db.Migrator().DropTable(&user{}, &message{}, &deviceNonce{}); err != nil {
 		return fmt.Errorf("drop table: %w", err)
 	}
 
-	if err := db.db.AutoMigrate(&user{}, &message{}); err != nil {
+	if err := db.db.AutoMigrate(&user{}, &message{}, &deviceNonce{}); err != nil {
 		return fmt.Errorf("auto migrate: %w", err)
 	}
 
 	return nil
 }
+
+func toAppMessages(messages []message) []string {
+	msgs := make([]string, len(messages))
+	for i, msg := range messages {
+		msgs[i] = msg.Msg + app.MessageState(msg.State).Marker()
+	}
+	return msgs
+}
+
+func toAppDeviceNonces(nonces []deviceNonce) map[string]uint64 {
+	m := make(map[string]uint64, len(nonces))
+	for _, dn := range nonces {
+		m[dn.Device] = dn.Nonce
+	}
+	return m
+}
@@ -3,6 +3,7 @@ package sql_test
 import (
 	"testing"
 
+	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
 	"github.com/ardanlabs/usdl/chat/api/frontends/client/storage/sql"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/stretchr/testify/assert"
@@ -36,6 +37,36 @@ func TestInsertContact(t *testing.T) {
 	assert.Equal(t, "test_user_name", user.Name)
 }
 
+func TestInsertGroup(t *testing.T) {
+	db, err := sql.NewDB(".", common.HexToAddress("0xF"))
+	assert.NoError(t, err)
+
+	err = db.CleanTables()
+	assert.NoError(t, err)
+
+	_, err = db.InsertContact(common.HexToAddress("0x1"), "test_user_name")
+	assert.NoError(t, err)
+
+	group, err := db.InsertGroup(common.HexToAddress("0x2"), "test_group_name")
+	assert.NoError(t, err)
+	assert.Equal(t, common.HexToAddress("0x2"), group.ID)
+	assert.Equal(t, "test_group_name", group.Name)
+	assert.True(t, group.IsGroup)
+
+	group, err = db.QueryContactByID(group.ID)
+	assert.NoError(t, err)
+	assert.True(t, group.IsGroup)
+
+	err = db.InsertMessage(group.ID, "test_group_message")
+	assert.NoError(t, err)
+
+	contacts := db.Contacts()
+	assert.Len(t, contacts, 2)
+	assert.False(t, contacts[0].IsGroup)
+	assert.True(t, contacts[1].IsGroup)
+	assert.Len(t, contacts[1].Messages, 1)
+}
+
 func TestQueryContactByID(t *testing.T) {
 	db, err := sql.NewDB(".", common.HexToAddress("0xF"))
 	assert.NoError(t, err)
@@ -125,6 +156,49 @@ func TestInsertMessage(t *testing.T) {
 	assert.Len(t, user.Messages, 2)
 }
 
+func TestUpdateMessageState(t *testing.T) {
+	db, err := sql.NewDB(".", common.HexToAddress("0xF"))
+	assert.NoError(t, err)
+
+	err = db.CleanTables()
+	assert.NoError(t, err)
+
+	user, err := db.InsertContact(common.HexToAddress("0x1"), "test_user_name")
+	assert.NoError(t, err)
+
+	err = db.InsertSentMessage(user.ID, 1, "test_message")
+	assert.NoError(t, err)
+
+	err = db.InsertMessage(user.ID, "test_reply")
+	assert.NoError(t, err)
+
+	err = db.InsertSentMessage(user.ID, 2, "test_message_2")
+	assert.NoError(t, err)
+
+	user, err = db.QueryContactByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test_message (sent)", "test_reply", "test_message_2 (sent)"}, user.Messages)
+
+	err = db.UpdateMessageState(user.ID, 2, app.StateDelivered)
+	assert.NoError(t, err)
+
+	err = db.UpdateMessageState(user.ID, 1, app.StateRead)
+	assert.NoError(t, err)
+
+	user, err = db.QueryContactByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test_message (read)", "test_reply", "test_message_2 (delivered)"}, user.Messages)
+
+	// A late delivered receipt doesn't move a read message back.
+
+	err = db.UpdateMessageState(user.ID, 1, app.StateDelivered)
+	assert.NoError(t, err)
+
+	user, err = db.QueryContactByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_message (read)", user.Messages[0])
+}
+
 func TestUpdateAppNonce(t *testing.T) {
 	db, err := sql.NewDB(".", common.HexToAddress("0xF"))
 	assert.NoError(t, err)
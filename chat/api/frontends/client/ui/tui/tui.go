@@ -2,8 +2,12 @@ package tui
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ardanlabs/usdl/chat/api/frontends/client/app"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -11,6 +15,7 @@ import (
 
 type App interface {
 	SendMessageHandler(to common.Address, msg string) error
+	MarkRead(id common.Address) error
 }
 
 type Storage interface {
@@ -21,18 +26,31 @@ type Storage interface {
 // =============================================================================
 
 type TUI struct {
+	myID     common.Address
 	tviewApp *tview.Application
 	flex     *tview.Flex
 	list     *tview.List
 	textView *tview.TextView
+	progress *tview.TextView
 	textArea *tview.TextArea
 	button   *tview.Button
 	app      App
 	db       Storage
+	presence map[string]status
+	muPres   sync.RWMutex
+}
+
+// status represents what the cap last told us about a contact's presence.
+type status struct {
+	status   string
+	lastSeen time.Time
 }
 
 func New(myAccountID common.Address, db Storage) *TUI {
-	var ui TUI
+	ui := TUI{
+		myID:     myAccountID,
+		presence: make(map[string]status),
+	}
 
 	app := tview.NewApplication()
 
@@ -50,39 +68,24 @@ func New(myAccountID common.Address, db Storage) *TUI {
 
 	// -------------------------------------------------------------------------
 
+	progress := tview.NewTextView().
+		SetTextAlign(tview.AlignLeft).
+		SetChangedFunc(func() {
+			app.Draw()
+		})
+
+	// -------------------------------------------------------------------------
+
 	list := tview.NewList()
 	list.SetBorder(true)
 	list.SetTitle("Users")
 	list.SetChangedFunc(func(idx int, name string, id string, shortcut rune) {
-		textView.Clear()
-
-		if ui.app == nil {
-			return
-		}
-
-		addrID := common.HexToAddress(id)
-
-		user, err := ui.db.QueryContactByID(addrID)
-		if err != nil {
-			textView.ScrollToEnd()
-			fmt.Fprintln(textView, "-----")
-			fmt.Fprintln(textView, err.Error())
-			return
-		}
-
-		for i, msg := range user.Messages {
-			fmt.Fprintln(textView, msg)
-			if i < len(user.Messages)-1 {
-				fmt.Fprintln(textView, "-----")
-			}
-		}
-
-		list.SetItemText(idx, user.Name, user.ID.Hex())
+		ui.showContact(idx, id)
 	})
 
 	for i, user := range db.Contacts() {
 		shortcut := rune(i + 49)
-		list.AddItem(user.Name, user.ID.Hex(), shortcut, nil)
+		list.AddItem(ui.displayName(user), user.ID.Hex(), shortcut, nil)
 	}
 
 	// -------------------------------------------------------------------------
@@ -108,6 +111,7 @@ func New(myAccountID common.Address, db Storage) *TUI {
 		AddItem(tview.NewFlex().
 			SetDirection(tview.FlexRow).
 			AddItem(textView, 0, 5, false).
+			AddItem(progress, 1, 0, false).
 			AddItem(tview.NewFlex().
 				SetDirection(tview.FlexColumn).
 				AddItem(textArea, 0, 90, false).
@@ -129,6 +133,7 @@ func New(myAccountID common.Address, db Storage) *TUI {
 	ui.flex = flex
 	ui.list = list
 	ui.textView = textView
+	ui.progress = progress
 	ui.textArea = textArea
 	ui.button = button
 	ui.db = db
@@ -191,6 +196,7 @@ func (ui *TUI) WriteText(id string, msg string) {
 		if id == currentID {
 			fmt.Fprintln(ui.textView, "-----")
 			fmt.Fprintln(ui.textView, msg)
+			ui.markRead(id)
 			return
 		}
 
@@ -206,12 +212,130 @@ func (ui *TUI) WriteText(id string, msg string) {
 }
 
 func (ui *TUI) UpdateContact(id string, name string) {
+	if user, err := ui.db.QueryContactByID(common.HexToAddress(id)); err == nil {
+		name = ui.displayName(user)
+	}
+
 	shortcut := rune(ui.list.GetItemCount() + 49)
 	ui.list.AddItem(name, id, shortcut, nil)
 }
 
+// Refresh redraws the conversation if the contact is currently selected.
+func (ui *TUI) Refresh(id string) {
+	idx := ui.list.GetCurrentItem()
+
+	_, currentID := ui.list.GetItemText(idx)
+	if id != currentID {
+		return
+	}
+
+	ui.showContact(idx, id)
+	ui.tviewApp.Draw()
+}
+
+// UpdateStatus shows whether the contact is connected next to its name.
+func (ui *TUI) UpdateStatus(id string, st string, lastSeen time.Time) {
+	ui.muPres.Lock()
+	ui.presence[id] = status{status: st, lastSeen: lastSeen}
+	ui.muPres.Unlock()
+
+	user, err := ui.db.QueryContactByID(common.HexToAddress(id))
+	if err != nil {
+		return
+	}
+
+	for i := range ui.list.GetItemCount() {
+		name, idStr := ui.list.GetItemText(i)
+		if id != idStr {
+			continue
+		}
+
+		// Keep the unread marker, only the status changed.
+		var unread string
+		if strings.HasPrefix(name, "* ") {
+			unread = "* "
+		}
+
+		ui.list.SetItemText(i, unread+ui.displayName(user), idStr)
+		ui.tviewApp.Draw()
+		return
+	}
+}
+
+// UpdateConnection shows the state of the connection to the cap in the title
+// of the conversation.
+func (ui *TUI) UpdateConnection(state app.ConnState) {
+	color := "green"
+	if state != app.ConnConnected {
+		color = "red"
+	}
+
+	ui.textView.SetTitle(fmt.Sprintf("*** %s *** [%s]%s[-]", ui.myID, color, state))
+	ui.tviewApp.Draw()
+}
+
+// Progress shows how far a file transfer with the contact has progressed.
+func (ui *TUI) Progress(id string, label string, done int64, total int64) {
+	name := id
+	if user, err := ui.db.QueryContactByID(common.HexToAddress(id)); err == nil {
+		name = user.Name
+	}
+
+	pct := int64(100)
+	if total > 0 {
+		pct = done * 100 / total
+	}
+
+	ui.progress.SetText(fmt.Sprintf(" %s: %s %d%% (%d of %d bytes)", name, label, pct, done, total))
+}
+
 // =============================================================================
 
+func (ui *TUI) showContact(idx int, id string) {
+	if ui.app == nil {
+		return
+	}
+
+	ui.textView.Clear()
+
+	addrID := common.HexToAddress(id)
+
+	user, err := ui.db.QueryContactByID(addrID)
+	if err != nil {
+		ui.textView.ScrollToEnd()
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintln(ui.textView, err.Error())
+		return
+	}
+
+	for i, msg := range user.Messages {
+		fmt.Fprintln(ui.textView, msg)
+		if i < len(user.Messages)-1 {
+			fmt.Fprintln(ui.textView, "-----")
+		}
+	}
+
+	ui.muPres.RLock()
+	st := ui.presence[id]
+	ui.muPres.RUnlock()
+
+	if st.status == protocol.PresenceOffline && !st.lastSeen.IsZero() {
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintf(ui.textView, "** last seen %s **\n", st.lastSeen.Local().Format(time.DateTime))
+	}
+
+	ui.list.SetItemText(idx, ui.displayName(user), user.ID.Hex())
+
+	ui.markRead(id)
+}
+
+func (ui *TUI) markRead(id string) {
+	if err := ui.app.MarkRead(common.HexToAddress(id)); err != nil {
+		fmt.Fprintln(ui.textView, "-----")
+		fmt.Fprintf(ui.textView, "read receipt: %s\n", err)
+	}
+}
+
 func (ui *TUI) buttonHandler() {
 	_, to := ui.list.GetItemText(ui.list.GetCurrentItem())
 
@@ -229,3 +353,27 @@ func (ui *TUI) buttonHandler() {
 
 	ui.textArea.SetText("", false)
 }
+
+// displayName returns the name shown in the contact list. Groups are marked
+// so they can be told apart from contacts, contacts are marked with their
+// status once the cap reported it.
+func (ui *TUI) displayName(user app.User) string {
+	if user.IsGroup {
+		return "# " + user.Name
+	}
+
+	ui.muPres.RLock()
+	st := ui.presence[user.ID.Hex()]
+	ui.muPres.RUnlock()
+
+	switch st.status {
+	case protocol.PresenceOnline:
+		return "● " + user.Name
+	case protocol.PresenceAway:
+		return "◐ " + user.Name
+	case protocol.PresenceOffline:
+		return "○ " + user.Name
+	}
+
+	return user.Name
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/ardanlabs/conf/v3"
+	"github.com/ardanlabs/usdl/chat/app/sdk/agent"
+	"github.com/ardanlabs/usdl/chat/foundation/llm"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/time/rate"
+)
+
+var build = "develop"
+
+func main() {
+	log := logger.New(os.Stdout, logger.LevelInfo, "AGENT", func(context.Context) string { return "" })
+
+	// -------------------------------------------------------------------------
+
+	ctx := context.Background()
+
+	if err := run(ctx, log); err != nil {
+		log.Error(ctx, "startup", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, log *logger.Logger) error {
+
+	// -------------------------------------------------------------------------
+	// GOMAXPROCS
+
+	log.Info(ctx, "startup", "GOMAXPROCS", runtime.GOMAXPROCS(0))
+
+	// -------------------------------------------------------------------------
+	// Configuration
+
+	cfg := struct {
+		conf.Version
+		Cap struct {
+			URL            string        `conf:"default:ws://localhost:3000/connect"`
+			ReconnectDelay time.Duration `conf:"default:5s"`
+		}
+		Agent struct {
+			Name         string        `conf:"default:Agent"`
+			IDFilePath   string        `conf:"default:chat/zarf/agent"`
+			SystemPrompt string        `conf:"default:You are a helpful assistant in a chat application. Keep your answers short."`
+			History      int           `conf:"default:20"`
+			RatePerMin   float64       `conf:"default:10"`
+			Burst        int           `conf:"default:3"`
+			Queue        int           `conf:"default:10"`
+			IdleTimeout  time.Duration `conf:"default:30m"`
+		}
+		LLM struct {
+			URL     string        `conf:"default:http://localhost:11434"`
+			Model   string        `conf:"default:llama3.2"`
+			APIKey  string        `conf:"mask"`
+			Timeout time.Duration `conf:"default:60s"`
+		}
+	}{
+		Version: conf.Version{
+			Build: build,
+			Desc:  "AGENT",
+		},
+	}
+
+	const prefix = "AGENT"
+	help, err := conf.Parse(prefix, &cfg)
+	if err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			fmt.Println(help)
+			return nil
+		}
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// App Starting
+
+	log.Info(ctx, "starting service", "version", cfg.Build)
+	defer log.Info(ctx, "shutdown complete")
+
+	out, err := conf.String(&cfg)
+	if err != nil {
+		return fmt.Errorf("generating config for output: %w", err)
+	}
+	log.Info(ctx, "startup", "config", out)
+
+	// -------------------------------------------------------------------------
+	// Agent ID
+
+	key, err := loadKey(filepath.Join(cfg.Agent.IDFilePath, "key.ecdsa"))
+	if err != nil {
+		return fmt.Errorf("key: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+	// Agent
+
+	cln, err := llm.New(llm.Config{
+		URL:     cfg.LLM.URL,
+		Model:   cfg.LLM.Model,
+		APIKey:  cfg.LLM.APIKey,
+		Timeout: cfg.LLM.Timeout,
+	})
+	if err != nil {
+		return fmt.Errorf("llm: %w", err)
+	}
+
+	cfgAgent := agent.Config{
+		Log:          log,
+		CapURL:       cfg.Cap.URL,
+		Name:         cfg.Agent.Name,
+		Key:          key,
+		LLM:          cln,
+		SystemPrompt: cfg.Agent.SystemPrompt,
+		History:      cfg.Agent.History,
+		Rate:         rate.Limit(cfg.Agent.RatePerMin / 60),
+		Burst:        cfg.Agent.Burst,
+		Queue:        cfg.Agent.Queue,
+		IdleTimeout:  cfg.Agent.IdleTimeout,
+		NoncesFile:   filepath.Join(cfg.Agent.IDFilePath, "nonces.json"),
+	}
+
+	agt, err := agent.New(cfgAgent)
+	if err != nil {
+		return fmt.Errorf("agent: %w", err)
+	}
+
+	log.Info(ctx, "startup", "status", "agent ready", "id", agt.ID())
+
+	// -------------------------------------------------------------------------
+	// Run until shutdown, reconnecting when the cap goes away.
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	for {
+		if err := agt.Run(ctx); err != nil {
+			log.Info(ctx, "agent", "status", "disconnected", "ERROR", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info(ctx, "shutdown", "status", "shutdown started")
+			return nil
+
+		case <-time.After(cfg.Cap.ReconnectDelay):
+		}
+	}
+}
+
+// loadKey reads the agent's private key, creating one the first time.
+func loadKey(fileName string) (*ecdsa.PrivateKey, error) {
+	if _, err := os.Stat(fileName); err == nil {
+		return crypto.LoadECDSA(fileName)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("generate: %w", err)
+	}
+
+	if err := crypto.SaveECDSA(fileName, key); err != nil {
+		return nil, fmt.Errorf("save: %w", err)
+	}
+
+	return key, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"embed"
 	"errors"
 	"fmt"
 	"io"
@@ -15,12 +16,22 @@ import (
 
 	"github.com/ardanlabs/conf/v3"
 	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/groups"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/jsbus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/jsusers"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/limiter"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/nonces"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/offline"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/presence"
 	"github.com/ardanlabs/usdl/chat/app/sdk/chat/users"
+	"github.com/ardanlabs/usdl/chat/app/sdk/metrics"
 	"github.com/ardanlabs/usdl/chat/app/sdk/mux"
 	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/natsserver"
 	"github.com/ardanlabs/usdl/chat/foundation/web"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 /*
@@ -40,6 +51,11 @@ import (
 		- Clear history button
 */
 
+// static holds the browser client served at the root of the cap.
+//
+//go:embed static
+var static embed.FS
+
 var build = "develop"
 
 func main() {
@@ -78,12 +94,58 @@ func run(ctx context.Context, log *logger.Logger) error {
 			WriteTimeout    time.Duration `conf:"default:10s"`
 			IdleTimeout     time.Duration `conf:"default:120s"`
 			ShutdownTimeout time.Duration `conf:"default:20s"`
+			ShutdownDelay   time.Duration `conf:"default:5s"`
 			APIHost         string        `conf:"default:0.0.0.0:3000"`
 		}
+		CORS struct {
+			AllowedOrigins []string
+		}
+		Websocket struct {
+			MaxMessageSize  int64 `conf:"default:262144"`
+			Compression     bool  `conf:"default:false"`
+			ReadBufferSize  int   `conf:"default:4096"`
+			WriteBufferSize int   `conf:"default:4096"`
+			Subprotocol     string
+		}
 		NATS struct {
 			Host       string `conf:"default:demo.nats.io"`
 			Subject    string `conf:"default:ardanlabs-cap"`
 			IDFilePath string `conf:"default:chat/zarf/cap"`
+			Embedded   bool   `conf:"default:false"`
+			Port       int    `conf:"default:4222"`
+			StoreDir   string `conf:"default:chat/zarf/nats"`
+		}
+		Presence struct {
+			TTL time.Duration `conf:"default:30s"`
+		}
+		Users struct {
+			TTL   time.Duration `conf:"default:30s"`
+			Local bool          `conf:"default:false"`
+		}
+		Offline struct {
+			MaxAge  time.Duration `conf:"default:168h"`
+			MaxMsgs int64         `conf:"default:1000"`
+		}
+		Files struct {
+			MaxSize int64 `conf:"default:10485760"`
+		}
+		Admin struct {
+			Token string `conf:"mask"`
+		}
+		Outbound struct {
+			QueueSize    int           `conf:"default:256"`
+			WriteTimeout time.Duration `conf:"default:10s"`
+			PingInterval time.Duration `conf:"default:10s"`
+		}
+		RateLimit struct {
+			MessageRate    float64       `conf:"default:20"`
+			MessageBurst   int           `conf:"default:50"`
+			ByteRate       float64       `conf:"default:1048576"`
+			ByteBurst      int           `conf:"default:4194304"`
+			HandshakeRate  float64       `conf:"default:1"`
+			HandshakeBurst int           `conf:"default:10"`
+			MaxViolations  int           `conf:"default:10"`
+			TTL            time.Duration `conf:"default:10m"`
 		}
 	}{
 		Version: conf.Version{
@@ -157,13 +219,120 @@ func run(ctx context.Context, log *logger.Logger) error {
 	// -------------------------------------------------------------------------
 	// Chat and NATS
 
-	nc, err := nats.Connect(cfg.NATS.Host)
+	natsURL := cfg.NATS.Host
+
+	if cfg.NATS.Embedded {
+		log.Info(ctx, "startup", "status", "starting embedded nats", "port", cfg.NATS.Port, "storeDir", cfg.NATS.StoreDir)
+
+		cfgNATS := natsserver.Config{
+			Port:     cfg.NATS.Port,
+			StoreDir: cfg.NATS.StoreDir,
+		}
+
+		ns, err := natsserver.Start(cfgNATS)
+		if err != nil {
+			return fmt.Errorf("nats embedded: %w", err)
+		}
+		defer ns.Shutdown()
+
+		natsURL = ns.ClientURL()
+	}
+
+	nc, err := nats.Connect(natsURL)
 	if err != nil {
 		return fmt.Errorf("nats connect: %w", err)
 	}
 	defer nc.Close()
 
-	chat, err := chat.New(log, nc, cfg.NATS.Subject, users.New(log), capID)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return fmt.Errorf("nats new js: %w", err)
+	}
+
+	bus, err := jsbus.New(ctx, log, js, cfg.NATS.Subject)
+	if err != nil {
+		return fmt.Errorf("bus: %w", err)
+	}
+
+	grps, err := groups.New(ctx, log, js, cfg.NATS.Subject+"-groups")
+	if err != nil {
+		return fmt.Errorf("groups: %w", err)
+	}
+
+	prs, err := presence.New(ctx, log, js, cfg.NATS.Subject+"-presence", cfg.Presence.TTL)
+	if err != nil {
+		return fmt.Errorf("presence: %w", err)
+	}
+
+	off, err := offline.New(ctx, log, js, cfg.NATS.Subject+"-offline", cfg.Offline.MaxAge, cfg.Offline.MaxMsgs)
+	if err != nil {
+		return fmt.Errorf("offline: %w", err)
+	}
+
+	nnc, err := nonces.New(ctx, log, js, cfg.NATS.Subject+"-nonces")
+	if err != nil {
+		return fmt.Errorf("nonces: %w", err)
+	}
+
+	lmt, err := limiter.New(ctx, log, js, cfg.NATS.Subject+"-limits", cfg.RateLimit.TTL)
+	if err != nil {
+		return fmt.Errorf("limiter: %w", err)
+	}
+
+	// Users are shared by every cap unless the cap runs on its own.
+
+	var usrs chat.Users = users.New(log)
+
+	if !cfg.Users.Local {
+		usrs, err = jsusers.New(ctx, log, js, cfg.NATS.Subject+"-users", capID, cfg.Users.TTL)
+		if err != nil {
+			return fmt.Errorf("users: %w", err)
+		}
+	}
+
+	mtrcs := metrics.New()
+
+	limits := chat.Limits{
+		Messages:      chat.Limit{Rate: cfg.RateLimit.MessageRate, Burst: cfg.RateLimit.MessageBurst},
+		Bytes:         chat.Limit{Rate: cfg.RateLimit.ByteRate, Burst: cfg.RateLimit.ByteBurst},
+		Handshakes:    chat.Limit{Rate: cfg.RateLimit.HandshakeRate, Burst: cfg.RateLimit.HandshakeBurst},
+		MaxViolations: cfg.RateLimit.MaxViolations,
+	}
+
+	outbound := chat.Outbound{
+		QueueSize:    cfg.Outbound.QueueSize,
+		WriteTimeout: cfg.Outbound.WriteTimeout,
+		PingInterval: cfg.Outbound.PingInterval,
+	}
+
+	upgrader := chat.Upgrader{
+		AllowedOrigins:  cfg.CORS.AllowedOrigins,
+		MaxMessageSize:  cfg.Websocket.MaxMessageSize,
+		Compression:     cfg.Websocket.Compression,
+		ReadBufferSize:  cfg.Websocket.ReadBufferSize,
+		WriteBufferSize: cfg.Websocket.WriteBufferSize,
+		Subprotocol:     cfg.Websocket.Subprotocol,
+	}
+
+	cfgChat := chat.Config{
+		Log:         log,
+		Bus:         bus,
+		Subject:     cfg.NATS.Subject,
+		CapID:       capID,
+		Users:       usrs,
+		Groups:      grps,
+		Presence:    prs,
+		Offline:     off,
+		Nonces:      nnc,
+		Metrics:     mtrcs,
+		Limiter:     lmt,
+		Limits:      limits,
+		Outbound:    outbound,
+		Upgrader:    upgrader,
+		MaxFileSize: cfg.Files.MaxSize,
+	}
+
+	chat, err := chat.New(cfgChat)
 	if err != nil {
 		return fmt.Errorf("chat: %w", err)
 	}
@@ -177,11 +346,16 @@ func run(ctx context.Context, log *logger.Logger) error {
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
 	cfgMux := mux.Config{
-		Log:  log,
-		Chat: chat,
+		Build:       build,
+		Log:         log,
+		NATS:        nc,
+		Chat:        chat,
+		Metrics:     mtrcs,
+		AdminToken:  cfg.Admin.Token,
+		CORSOrigins: cfg.CORS.AllowedOrigins,
 	}
 
-	webAPI := mux.WebAPI(cfgMux)
+	webAPI := mux.WebAPI(cfgMux, mux.WithFileServer(static, "static", "/"))
 
 	api := http.Server{
 		Addr:         cfg.Web.APIHost,
@@ -211,9 +385,23 @@ func run(ctx context.Context, log *logger.Logger) error {
 		log.Info(ctx, "shutdown", "status", "shutdown started", "signal", sig)
 		defer log.Info(ctx, "shutdown", "status", "shutdown complete", "signal", sig)
 
+		// Report not ready and give the load balancer time to notice before
+		// the listener is closed.
+
+		chat.Shutdown()
+		time.Sleep(cfg.Web.ShutdownDelay)
+
 		ctx, cancel := context.WithTimeout(ctx, cfg.Web.ShutdownTimeout)
 		defer cancel()
 
+		// The websocket connections are hijacked, the server doesn't know
+		// about them. The users are moved to other caps before the server
+		// is stopped.
+
+		if err := chat.Drain(ctx); err != nil {
+			log.Info(ctx, "shutdown", "status", "drain", "ERROR", err)
+		}
+
 		if err := api.Shutdown(ctx); err != nil {
 			api.Close()
 			return fmt.Errorf("could not stop server gracefully: %w", err)
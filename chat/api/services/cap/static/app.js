@@ -0,0 +1,629 @@
+// Browser client for the cap. It speaks the same protocol as the terminal
+// client: every frame is wrapped in a versioned envelope and every request is
+// signed with the account's key. The key, contacts and history are kept in
+// the browser's local storage.
+
+"use strict";
+
+const PROTOCOL_VERSION = 1;
+const STORE_KEY = "usdl.state";
+const ZERO_ADDRESS = "0x0000000000000000000000000000000000000000";
+
+const MARKERS = { sent: " (sent)", delivered: " (delivered)", read: " (read)" };
+const STATE_RANK = { sent: 1, delivered: 2, read: 3 };
+const PRESENCE_DOTS = { online: "●", away: "◐", offline: "○" };
+
+const protocolTypes = {
+  challenge: "challenge",
+  hello: "hello",
+  welcome: "welcome",
+  chat: "chat",
+  command: "command",
+  receipt: "receipt",
+  file: "file",
+  status: "status",
+  presence: "presence",
+  error: "error",
+};
+
+// Close codes the cap uses when it closes the connection for good. The
+// connection is made again after any other close.
+const closeCodes = {
+  unsupportedVersion: 4000,
+  unauthenticated: 4001,
+  kicked: 4003,
+  revoked: 4006,
+};
+
+const closeNotes = {
+  [closeCodes.unsupportedVersion]: "the cap does not support the page's protocol version",
+  [closeCodes.unauthenticated]: "the cap could not authenticate this browser",
+  [closeCodes.kicked]: "disconnected by the cap's admin",
+  [closeCodes.revoked]: "this device was revoked by another device",
+};
+
+let state = loadState();
+let conn = null;
+let ready = false;
+let selected = null;
+let retryDelay = 1000;
+let stopped = null;
+
+const presence = {};
+const unread = new Set();
+
+const $ = (id) => document.getElementById(id);
+
+// =============================================================================
+// Storage
+
+function loadState() {
+  try {
+    return JSON.parse(localStorage.getItem(STORE_KEY));
+  } catch {
+    return null;
+  }
+}
+
+function saveState() {
+  localStorage.setItem(STORE_KEY, JSON.stringify(state));
+}
+
+function myID() {
+  return addressOf(state.key);
+}
+
+function ensureContact(id, name, isGroup) {
+  id = id.toLowerCase();
+
+  let contact = state.contacts[id];
+  if (contact) {
+    return contact;
+  }
+
+  contact = {
+    id: id,
+    name: name,
+    isGroup: !!isGroup,
+    appNonce: 0,
+    lastNonce: 0,
+    lastRead: 0,
+    messages: [],
+  };
+
+  state.contacts[id] = contact;
+  saveState();
+
+  if (!contact.isGroup) {
+    subscribePresence([id]);
+  }
+
+  renderContacts();
+
+  return contact;
+}
+
+function addMessage(id, msg) {
+  const contact = state.contacts[id];
+  contact.messages.push(msg);
+  saveState();
+
+  if (id === selected && document.visibilityState === "visible") {
+    renderHistory();
+    markRead(id);
+    return;
+  }
+
+  unread.add(id);
+  renderContacts();
+}
+
+// =============================================================================
+// Connection
+
+function connect() {
+  const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+
+  conn = new WebSocket(`${scheme}//${location.host}/connect`);
+  ready = false;
+
+  let phase = protocolTypes.challenge;
+
+  conn.onopen = () => setConnStatus("handshaking...");
+
+  conn.onmessage = (event) => {
+    let env;
+    try {
+      env = JSON.parse(event.data);
+    } catch (err) {
+      notice(`decode: ${err}`);
+      return;
+    }
+
+    if (env.type === protocolTypes.error) {
+      receiveError(env.payload);
+      return;
+    }
+
+    switch (phase) {
+      case protocolTypes.challenge:
+        if (env.type !== phase || !env.payload.versions.includes(PROTOCOL_VERSION)) {
+          stopped = closeNotes[closeCodes.unsupportedVersion];
+          conn.close();
+          return;
+        }
+        sendHello(env.payload.challenge);
+        phase = protocolTypes.welcome;
+        return;
+
+      case protocolTypes.welcome:
+        if (env.type !== phase) {
+          stopped = `unexpected ${env.type} frame: expected ${phase}`;
+          conn.close();
+          return;
+        }
+        phase = null;
+        ready = true;
+        retryDelay = 1000;
+        setConnStatus("");
+        subscribePresence(Object.values(state.contacts).filter((c) => !c.isGroup).map((c) => c.id));
+        return;
+    }
+
+    receive(env);
+  };
+
+  conn.onclose = (event) => {
+    ready = false;
+
+    if (stopped === null && event.code in closeNotes) {
+      stopped = closeNotes[event.code];
+    }
+
+    if (stopped !== null) {
+      setConnStatus(`${stopped}: reload the page to connect again`);
+      return;
+    }
+
+    setConnStatus(`disconnected, reconnecting in ${retryDelay / 1000}s`);
+    setTimeout(connect, retryDelay);
+    retryDelay = Math.min(retryDelay * 2, 30000);
+  };
+}
+
+function writeFrame(type, payload) {
+  conn.send(goJSON({ type: type, version: PROTOCOL_VERSION, payload: payload }));
+}
+
+// signed returns the request with the signature of the signed data added.
+function signed(req, signedData) {
+  const sig = sign(signedData, state.key);
+  return Object.assign(req, { v: sig.v, r: sig.r, s: sig.s });
+}
+
+function sendHello(challenge) {
+  const id = myID();
+
+  const hello = signed({ id: id, name: state.name }, { ID: id, Challenge: challenge });
+
+  writeFrame(protocolTypes.hello, hello);
+}
+
+// =============================================================================
+// Receiving
+
+function receive(env) {
+  try {
+    switch (env.type) {
+      case protocolTypes.chat:
+        receiveChat(env.payload);
+        break;
+      case protocolTypes.command:
+        receiveCommand(env.payload);
+        break;
+      case protocolTypes.file:
+        receiveFile(env.payload);
+        break;
+      case protocolTypes.receipt:
+        receiveReceipt(env.payload);
+        break;
+      case protocolTypes.status:
+        receiveStatus(env.payload);
+        break;
+      case protocolTypes.presence:
+        receivePresence(env.payload);
+        break;
+      default:
+        notice(`unexpected ${env.type} frame`);
+    }
+  } catch (err) {
+    notice(err.message);
+  }
+}
+
+function receiveChat(msg) {
+  if (msg.group) {
+    const group = ensureContact(msg.group.id, msg.group.name, true);
+
+    let name = msg.from.name;
+    if (msg.from.id === myID()) {
+      name = "You";
+    } else if (state.contacts[msg.from.id]) {
+      name = state.contacts[msg.from.id].name;
+    }
+
+    addMessage(group.id, { text: `${name}: ${msg.msg}` });
+    return;
+  }
+
+  const contact = acceptNonce(msg.from);
+
+  let text = `${contact.name}: ${msg.msg}`;
+  if (msg.encrypted) {
+    text = `🔒 ${contact.name}: ** encrypted message, the browser can't display encrypted messages **`;
+  }
+
+  recordReceived(contact, msg.from.nonce, text);
+}
+
+function receiveCommand(msg) {
+  const contact = acceptNonce(msg.from);
+
+  switch (msg.command.action) {
+    case "share-key":
+      contact.key = msg.command.key;
+      recordReceived(contact, msg.from.nonce, `${contact.name}: ** updated contact's key **`);
+      return;
+  }
+
+  throw new Error(`unknown command "${msg.command.action}"`);
+}
+
+function receiveFile(msg) {
+  const contact = acceptNonce(msg.from);
+
+  if (msg.chunk.index === msg.chunk.total - 1) {
+    recordReceived(contact, msg.from.nonce, `${contact.name}: ** sent file ${msg.chunk.name}, the browser can't display files **`);
+  }
+}
+
+// acceptNonce makes sure the message is the next one we expect from the
+// contact, adding the contact if this is the first message.
+function acceptNonce(from) {
+  const contact = ensureContact(from.id, from.name, false);
+
+  const expNonce = contact.lastNonce + 1;
+
+  if (from.nonce < expNonce) {
+    throw new Error(`invalid nonce: possible security issue with contact: got: ${from.nonce}, exp: ${expNonce}`);
+  }
+
+  if (from.nonce > expNonce) {
+    addMessage(contact.id, { text: `** ${from.nonce - expNonce} message(s) from contact missing **`, note: true });
+  }
+
+  contact.lastNonce = from.nonce;
+  saveState();
+
+  return contact;
+}
+
+function recordReceived(contact, nonce, text) {
+  addMessage(contact.id, { text: text });
+  sendReceipt(contact.id, nonce, "delivered");
+}
+
+function receiveReceipt(msg) {
+  const contact = state.contacts[msg.from.id];
+  if (!contact) {
+    return;
+  }
+
+  const st = msg.receipt.state;
+
+  for (const m of contact.messages) {
+    if (m.nonce && m.nonce <= msg.receipt.nonce && STATE_RANK[m.state] < STATE_RANK[st]) {
+      m.state = st;
+    }
+  }
+
+  saveState();
+
+  if (contact.id === selected) {
+    renderHistory();
+  }
+}
+
+function receiveStatus(st) {
+  const id = st.toID.toLowerCase();
+  if (!state.contacts[id]) {
+    return;
+  }
+
+  switch (st.status) {
+    case "queued":
+      addMessage(id, { text: `** message ${st.nonce} queued: contact is offline **`, note: true });
+      break;
+    case "failed":
+      addMessage(id, { text: `** message ${st.nonce} could not be delivered **`, note: true });
+      break;
+  }
+}
+
+function receivePresence(pm) {
+  presence[pm.id.toLowerCase()] = pm;
+  renderContacts();
+
+  if (pm.id.toLowerCase() === selected) {
+    renderHeader();
+  }
+}
+
+function receiveError(em) {
+  const id = (em.toID || ZERO_ADDRESS).toLowerCase();
+
+  if (id === ZERO_ADDRESS || !state.contacts[id]) {
+    notice(`cap: ${em.code}: ${em.message}`);
+    return;
+  }
+
+  addMessage(id, { text: `** message ${em.nonce} rejected: ${em.message} **`, note: true });
+}
+
+// =============================================================================
+// Sending
+
+function sendMessage(text) {
+  if (!ready) {
+    throw new Error("no connection");
+  }
+
+  if (text.startsWith("/status ")) {
+    sendStatus(text);
+    return;
+  }
+
+  if (text.startsWith("/")) {
+    throw new Error("commands are only supported in the terminal client");
+  }
+
+  const contact = state.contacts[selected];
+  if (!contact) {
+    throw new Error("select a contact first");
+  }
+
+  const nonce = contact.appNonce + 1;
+
+  const signedData = { ToID: contact.id, Msg: text, Encrypted: false, FromNonce: nonce };
+  const req = signed({ toID: contact.id, msg: text, encrypted: false, fromNonce: nonce }, signedData);
+
+  writeFrame(protocolTypes.chat, req);
+
+  contact.appNonce = nonce;
+
+  if (contact.isGroup) {
+    addMessage(contact.id, { text: `You: ${text}` });
+    return;
+  }
+
+  addMessage(contact.id, { text: `You: ${text}`, nonce: nonce, state: "sent" });
+}
+
+function sendReceipt(to, nonce, st) {
+  if (!ready) {
+    return;
+  }
+
+  const receipt = { nonce: nonce, state: st };
+
+  const req = signed(
+    { toID: to, receipt: receipt, fromNonce: 0 },
+    { ToID: to, Receipt: receipt, FromNonce: 0 },
+  );
+
+  writeFrame(protocolTypes.receipt, req);
+}
+
+// sendStatus tells our contacts whether we are available.
+//
+//	/status online
+//	/status away
+function sendStatus(text) {
+  const st = text.split(/\s+/)[1].toLowerCase();
+  if (st !== "online" && st !== "away") {
+    throw new Error(`unknown status "${st}"`);
+  }
+
+  writeFrame(protocolTypes.presence, signed({ status: st }, { Status: st, Subscribe: null }));
+  notice(`** status set to ${st} **`);
+}
+
+function subscribePresence(ids) {
+  if (!ready || ids.length === 0) {
+    return;
+  }
+
+  writeFrame(protocolTypes.presence, signed({ subscribe: ids }, { Status: "", Subscribe: ids }));
+}
+
+// markRead tells the contact their messages up to the last one received
+// have been shown.
+function markRead(id) {
+  const contact = state.contacts[id];
+  if (!contact || contact.isGroup || contact.lastNonce <= contact.lastRead || !ready) {
+    return;
+  }
+
+  sendReceipt(id, contact.lastNonce, "read");
+
+  contact.lastRead = contact.lastNonce;
+  saveState();
+}
+
+// =============================================================================
+// Rendering
+
+function setConnStatus(text) {
+  $("conn-status").textContent = text;
+}
+
+// notice shows a message that is not part of any conversation.
+function notice(text) {
+  const li = document.createElement("li");
+  li.className = "note";
+  li.textContent = text;
+  $("history").appendChild(li);
+  li.scrollIntoView();
+}
+
+function displayName(contact) {
+  if (contact.isGroup) {
+    return `# ${contact.name}`;
+  }
+
+  const pm = presence[contact.id];
+  const dot = pm ? PRESENCE_DOTS[pm.status] || "" : "";
+
+  return `${dot} ${contact.name}`.trim();
+}
+
+function renderContacts() {
+  const ul = $("contacts");
+  ul.replaceChildren();
+
+  for (const contact of Object.values(state.contacts)) {
+    const li = document.createElement("li");
+    li.textContent = displayName(contact);
+    li.title = contact.id;
+    li.classList.toggle("selected", contact.id === selected);
+    li.classList.toggle("unread", unread.has(contact.id));
+    li.onclick = () => selectContact(contact.id);
+    ul.appendChild(li);
+  }
+}
+
+function renderHeader() {
+  const contact = state.contacts[selected];
+  if (!contact) {
+    $("contact-header").textContent = "";
+    return;
+  }
+
+  let text = `${displayName(contact)}  ${contact.id}`;
+
+  const pm = presence[contact.id];
+  if (pm && pm.status === "offline" && !pm.lastSeen.startsWith("0001-")) {
+    text += `  (last seen ${new Date(pm.lastSeen).toLocaleString()})`;
+  }
+
+  $("contact-header").textContent = text;
+}
+
+function renderHistory() {
+  const ol = $("history");
+  ol.replaceChildren();
+
+  const contact = state.contacts[selected];
+  if (!contact) {
+    return;
+  }
+
+  for (const m of contact.messages) {
+    const li = document.createElement("li");
+    li.textContent = m.text + (m.state ? MARKERS[m.state] : "");
+    if (m.note) {
+      li.className = "note";
+    }
+    ol.appendChild(li);
+  }
+
+  if (ol.lastChild) {
+    ol.lastChild.scrollIntoView();
+  }
+}
+
+function selectContact(id) {
+  selected = id;
+  unread.delete(id);
+
+  renderContacts();
+  renderHeader();
+  renderHistory();
+  markRead(id);
+}
+
+// =============================================================================
+// Startup
+
+function start() {
+  $("login").classList.add("hidden");
+  $("main").classList.remove("hidden");
+
+  $("me-name").textContent = state.name;
+  $("me-id").textContent = myID();
+  $("me-id").onclick = () => navigator.clipboard.writeText(myID());
+
+  $("send-form").onsubmit = (event) => {
+    event.preventDefault();
+
+    const text = $("send-msg").value;
+    if (text === "") {
+      return;
+    }
+
+    try {
+      sendMessage(text);
+      $("send-msg").value = "";
+    } catch (err) {
+      notice(`Error sending message: ${err.message}`);
+    }
+  };
+
+  $("add-form").onsubmit = (event) => {
+    event.preventDefault();
+
+    const id = $("add-id").value.trim().toLowerCase();
+    if (!/^0x[0-9a-f]{40}$/.test(id)) {
+      notice("invalid address");
+      return;
+    }
+
+    ensureContact(id, $("add-name").value.trim(), false);
+    $("add-form").reset();
+    selectContact(id);
+  };
+
+  document.addEventListener("visibilitychange", () => {
+    if (document.visibilityState === "visible" && selected) {
+      markRead(selected);
+    }
+  });
+
+  renderContacts();
+
+  const first = Object.keys(state.contacts)[0];
+  if (first) {
+    selectContact(first);
+  }
+
+  connect();
+}
+
+if (state) {
+  start();
+} else {
+  $("login").classList.remove("hidden");
+
+  $("login-form").onsubmit = (event) => {
+    event.preventDefault();
+
+    state = {
+      key: generateKey(),
+      name: $("login-name").value.trim(),
+      contacts: {},
+    };
+
+    saveState();
+    start();
+  };
+}
@@ -0,0 +1,347 @@
+// Support for the signatures the cap expects. Messages are signed the same
+// way the Go signature package does it: the Go JSON encoding of the value
+// is stamped, hashed with keccak256 and signed with secp256k1.
+
+"use strict";
+
+// =============================================================================
+// Keccak256
+
+const MASK64 = (1n << 64n) - 1n;
+
+const KECCAK_RC = [
+  0x0000000000000001n, 0x0000000000008082n, 0x800000000000808an, 0x8000000080008000n,
+  0x000000000000808bn, 0x0000000080000001n, 0x8000000080008081n, 0x8000000000008009n,
+  0x000000000000008an, 0x0000000000000088n, 0x0000000080008009n, 0x000000008000000an,
+  0x000000008000808bn, 0x800000000000008bn, 0x8000000000008089n, 0x8000000000008003n,
+  0x8000000000008002n, 0x8000000000000080n, 0x000000000000800an, 0x800000008000000an,
+  0x8000000080008081n, 0x8000000000008080n, 0x0000000080000001n, 0x8000000080008008n,
+];
+
+// KECCAK_ROT[x][y] is the rotation applied to the lane at x, y.
+const KECCAK_ROT = [
+  [0, 36, 3, 41, 18],
+  [1, 44, 10, 45, 2],
+  [62, 6, 43, 15, 61],
+  [28, 55, 25, 21, 56],
+  [27, 20, 39, 8, 14],
+];
+
+function rotl64(v, n) {
+  if (n === 0) {
+    return v;
+  }
+  const b = BigInt(n);
+  return ((v << b) | (v >> (64n - b))) & MASK64;
+}
+
+function keccakF(a) {
+  const c = new Array(5);
+  const b = new Array(25);
+
+  for (let round = 0; round < 24; round++) {
+    for (let x = 0; x < 5; x++) {
+      c[x] = a[x] ^ a[x + 5] ^ a[x + 10] ^ a[x + 15] ^ a[x + 20];
+    }
+
+    for (let x = 0; x < 5; x++) {
+      const d = c[(x + 4) % 5] ^ rotl64(c[(x + 1) % 5], 1);
+      for (let y = 0; y < 5; y++) {
+        a[x + 5 * y] ^= d;
+      }
+    }
+
+    for (let x = 0; x < 5; x++) {
+      for (let y = 0; y < 5; y++) {
+        b[y + 5 * ((2 * x + 3 * y) % 5)] = rotl64(a[x + 5 * y], KECCAK_ROT[x][y]);
+      }
+    }
+
+    for (let x = 0; x < 5; x++) {
+      for (let y = 0; y < 5; y++) {
+        a[x + 5 * y] = b[x + 5 * y] ^ (~b[(x + 1) % 5 + 5 * y] & MASK64 & b[(x + 2) % 5 + 5 * y]);
+      }
+    }
+
+    a[0] ^= KECCAK_RC[round];
+  }
+}
+
+// keccak256 returns the legacy keccak256 hash used by Ethereum.
+function keccak256(bytes) {
+  const rate = 136;
+
+  const padded = new Uint8Array(Math.ceil((bytes.length + 1) / rate) * rate);
+  padded.set(bytes);
+  padded[bytes.length] = 0x01;
+  padded[padded.length - 1] |= 0x80;
+
+  const a = new Array(25).fill(0n);
+
+  for (let off = 0; off < padded.length; off += rate) {
+    for (let i = 0; i < rate / 8; i++) {
+      let lane = 0n;
+      for (let j = 7; j >= 0; j--) {
+        lane = (lane << 8n) | BigInt(padded[off + i * 8 + j]);
+      }
+      a[i] ^= lane;
+    }
+    keccakF(a);
+  }
+
+  const out = new Uint8Array(32);
+  for (let i = 0; i < 4; i++) {
+    let lane = a[i];
+    for (let j = 0; j < 8; j++) {
+      out[i * 8 + j] = Number(lane & 0xffn);
+      lane >>= 8n;
+    }
+  }
+
+  return out;
+}
+
+// =============================================================================
+// secp256k1
+
+const CURVE_P = 0xfffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2fn;
+const CURVE_N = 0xfffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141n;
+const CURVE_G = {
+  x: 0x79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798n,
+  y: 0x483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8n,
+};
+
+function mod(a, m) {
+  const r = a % m;
+  return r >= 0n ? r : r + m;
+}
+
+function invert(a, m) {
+  let [oldR, r] = [mod(a, m), m];
+  let [oldS, s] = [1n, 0n];
+
+  while (r !== 0n) {
+    const q = oldR / r;
+    [oldR, r] = [r, oldR - q * r];
+    [oldS, s] = [s, oldS - q * s];
+  }
+
+  return mod(oldS, m);
+}
+
+// pointAdd adds two affine points, null is the point at infinity.
+function pointAdd(p1, p2) {
+  if (p1 === null) {
+    return p2;
+  }
+  if (p2 === null) {
+    return p1;
+  }
+
+  let l;
+  if (p1.x === p2.x) {
+    if (mod(p1.y + p2.y, CURVE_P) === 0n) {
+      return null;
+    }
+    l = mod(3n * p1.x * p1.x * invert(2n * p1.y, CURVE_P), CURVE_P);
+  } else {
+    l = mod((p2.y - p1.y) * invert(p2.x - p1.x, CURVE_P), CURVE_P);
+  }
+
+  const x = mod(l * l - p1.x - p2.x, CURVE_P);
+  const y = mod(l * (p1.x - x) - p1.y, CURVE_P);
+
+  return { x, y };
+}
+
+function pointMul(k, p) {
+  let result = null;
+  let addend = p;
+
+  while (k > 0n) {
+    if (k & 1n) {
+      result = pointAdd(result, addend);
+    }
+    addend = pointAdd(addend, addend);
+    k >>= 1n;
+  }
+
+  return result;
+}
+
+function bytesToBigInt(bytes) {
+  let v = 0n;
+  for (const b of bytes) {
+    v = (v << 8n) | BigInt(b);
+  }
+  return v;
+}
+
+function bigIntToBytes(v, length) {
+  const out = new Uint8Array(length);
+  for (let i = length - 1; i >= 0; i--) {
+    out[i] = Number(v & 0xffn);
+    v >>= 8n;
+  }
+  return out;
+}
+
+function bytesToHex(bytes) {
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+function hexToBytes(hex) {
+  hex = hex.replace(/^0x/, "");
+  const out = new Uint8Array(hex.length / 2);
+  for (let i = 0; i < out.length; i++) {
+    out[i] = parseInt(hex.substr(i * 2, 2), 16);
+  }
+  return out;
+}
+
+function randomScalar() {
+  for (;;) {
+    const k = bytesToBigInt(crypto.getRandomValues(new Uint8Array(32)));
+    if (k > 0n && k < CURVE_N) {
+      return k;
+    }
+  }
+}
+
+// generateKey returns a new private key as a hex string.
+function generateKey() {
+  return bytesToHex(bigIntToBytes(randomScalar(), 32));
+}
+
+// addressOf returns the lower case hex address of the private key, the same
+// value the cap uses for the account.
+function addressOf(privHex) {
+  const pub = pointMul(bytesToBigInt(hexToBytes(privHex)), CURVE_G);
+
+  const data = new Uint8Array(64);
+  data.set(bigIntToBytes(pub.x, 32));
+  data.set(bigIntToBytes(pub.y, 32), 32);
+
+  return "0x" + bytesToHex(keccak256(data).slice(12));
+}
+
+// =============================================================================
+// Go compatible JSON
+
+// goJSON encodes the value the way Go's encoding/json does, so the bytes we
+// sign are the bytes the cap verifies. BigInt values are written as numbers.
+function goJSON(value) {
+  if (value === null || value === undefined) {
+    return "null";
+  }
+
+  switch (typeof value) {
+    case "bigint":
+      return value.toString();
+    case "number":
+      return String(value);
+    case "boolean":
+      return value ? "true" : "false";
+    case "string":
+      return goString(value);
+  }
+
+  if (Array.isArray(value)) {
+    return "[" + value.map(goJSON).join(",") + "]";
+  }
+
+  const fields = Object.keys(value).map((k) => goString(k) + ":" + goJSON(value[k]));
+  return "{" + fields.join(",") + "}";
+}
+
+function goString(s) {
+  let out = '"';
+
+  for (const ch of s) {
+    const c = ch.codePointAt(0);
+
+    switch (ch) {
+      case '"':
+        out += '\\"';
+        continue;
+      case "\\":
+        out += "\\\\";
+        continue;
+      case "\b":
+        out += "\\b";
+        continue;
+      case "\f":
+        out += "\\f";
+        continue;
+      case "\n":
+        out += "\\n";
+        continue;
+      case "\r":
+        out += "\\r";
+        continue;
+      case "\t":
+        out += "\\t";
+        continue;
+    }
+
+    if (c < 0x20 || ch === "<" || ch === ">" || ch === "&") {
+      out += "\\u00" + c.toString(16).padStart(2, "0");
+      continue;
+    }
+
+    if (c === 0x2028 || c === 0x2029) {
+      out += "\\u" + c.toString(16);
+      continue;
+    }
+
+    out += ch;
+  }
+
+  return out + '"';
+}
+
+// =============================================================================
+// Signing
+
+// sign returns the v, r and s values for the value, using the same stamp as
+// the Go signature package.
+function sign(value, privHex) {
+  const data = new TextEncoder().encode(goJSON(value));
+  const prefix = new TextEncoder().encode("\x19Ethereum Signed Message:\n" + data.length);
+
+  const msg = new Uint8Array(prefix.length + data.length);
+  msg.set(prefix);
+  msg.set(data, prefix.length);
+
+  const z = bytesToBigInt(keccak256(msg));
+  const d = bytesToBigInt(hexToBytes(privHex));
+
+  for (;;) {
+    const k = randomScalar();
+    const p = pointMul(k, CURVE_G);
+
+    const r = mod(p.x, CURVE_N);
+    if (r === 0n) {
+      continue;
+    }
+
+    let s = mod(invert(k, CURVE_N) * (z + r * d), CURVE_N);
+    if (s === 0n) {
+      continue;
+    }
+
+    let recID = Number(p.y & 1n) | (p.x >= CURVE_N ? 2 : 0);
+
+    // Keep s in the lower half like go-ethereum does.
+    if (s > CURVE_N / 2n) {
+      s = CURVE_N - s;
+      recID ^= 1;
+    }
+
+    return { v: BigInt(recID + 27), r, s };
+  }
+}
+
+if (typeof module !== "undefined") {
+  module.exports = { keccak256, generateKey, addressOf, goJSON, sign, bytesToHex };
+}
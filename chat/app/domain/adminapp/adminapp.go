@@ -0,0 +1,122 @@
+// Package adminapp provides the application layer for operating a cap.
+package adminapp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type app struct {
+	log   *logger.Logger
+	chat  *chat.Chat
+	build string
+}
+
+func newApp(log *logger.Logger, chat *chat.Chat, build string) *app {
+	return &app{
+		log:   log,
+		chat:  chat,
+		build: build,
+	}
+}
+
+func (a *app) cap(ctx context.Context, r *http.Request) web.Encoder {
+	ci := CapInfo{
+		CapID:    a.chat.CapID(),
+		Build:    a.build,
+		Settings: make(map[string]string),
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		ci.GoVersion = info.GoVersion
+		ci.ModVersion = info.Main.Version
+
+		for _, s := range info.Settings {
+			ci.Settings[s.Key] = s.Value
+		}
+	}
+
+	return ci
+}
+
+func (a *app) connections(ctx context.Context, r *http.Request) web.Encoder {
+	conns := toConnections(a.chat.Connections())
+
+	slices.SortFunc(conns, func(a, b Connection) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Device, b.Device)
+	})
+
+	return conns
+}
+
+func (a *app) disconnect(ctx context.Context, r *http.Request) web.Encoder {
+	id := web.Param(r, "id")
+	if !common.IsHexAddress(id) {
+		return errs.Newf(errs.InvalidArgument, "invalid user id %q", id)
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "disconnected by an operator"
+	}
+
+	// Every device of the user connected to this cap is disconnected unless
+	// a device is specified.
+	device := r.URL.Query().Get("device")
+
+	if err := a.chat.Disconnect(ctx, common.HexToAddress(id), device, reason); err != nil {
+		if errors.Is(err, chat.ErrNotExists) {
+			return errs.Newf(errs.NotFound, "user %s is not connected to this cap", id)
+		}
+		return errs.Newf(errs.Internal, "disconnect: %s", err)
+	}
+
+	a.log.Info(ctx, "admin-disconnect", "id", id, "device", device, "reason", reason)
+
+	return nil
+}
+
+func (a *app) devices(ctx context.Context, r *http.Request) web.Encoder {
+	id := web.Param(r, "id")
+	if !common.IsHexAddress(id) {
+		return errs.Newf(errs.InvalidArgument, "invalid user id %q", id)
+	}
+
+	devices, err := a.chat.Devices(ctx, common.HexToAddress(id))
+	if err != nil {
+		if errors.Is(err, chat.ErrNotExists) {
+			return errs.Newf(errs.NotFound, "user %s is not connected", id)
+		}
+		return errs.Newf(errs.Internal, "devices: %s", err)
+	}
+
+	list := toDevices(devices)
+
+	slices.SortFunc(list, func(a, b Device) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return list
+}
+
+func (a *app) bus(ctx context.Context, r *http.Request) web.Encoder {
+	info, err := a.chat.BusInfo(ctx)
+	if err != nil {
+		return errs.Newf(errs.Internal, "%s", err)
+	}
+
+	return BusInfo(info)
+}
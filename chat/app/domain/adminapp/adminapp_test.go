@@ -0,0 +1,336 @@
+package adminapp_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/domain/adminapp"
+	"github.com/ardanlabs/usdl/chat/app/domain/chatapp"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/groups"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/membus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/nonces"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/offline"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/presence"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/users"
+	"github.com/ardanlabs/usdl/chat/app/sdk/mid"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/natsserver"
+	"github.com/ardanlabs/usdl/chat/foundation/signature"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	subject = "test-admin"
+	token   = "secret"
+)
+
+func Test_Token(t *testing.T) {
+	url, _ := startCap(t)
+
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/admin/cap"},
+		{http.MethodGet, "/admin/connections"},
+		{http.MethodDelete, "/admin/connections/" + common.HexToAddress("0x1").Hex()},
+		{http.MethodGet, "/admin/devices/" + common.HexToAddress("0x1").Hex()},
+		{http.MethodGet, "/admin/bus"},
+	}
+
+	for _, rt := range routes {
+		for _, auth := range []string{"", "Bearer guess"} {
+			resp := request(t, rt.method, url+rt.path, auth)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Should refuse %s %s with %q, got status %d", rt.method, rt.path, auth, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func Test_Routes(t *testing.T) {
+	url, c := startCap(t)
+
+	// -------------------------------------------------------------------------
+
+	var ci adminapp.CapInfo
+	get(t, url+"/admin/cap", http.StatusOK, &ci)
+
+	if ci.CapID != c.CapID() || ci.Build != "test" {
+		t.Fatalf("Should get the cap's id and build, got %+v", ci)
+	}
+
+	var bi adminapp.BusInfo
+	get(t, url+"/admin/bus", http.StatusOK, &bi)
+
+	if bi.Stream != "memory" || bi.Consumer != c.CapID().String() {
+		t.Fatalf("Should get the cap's subscription, got %+v", bi)
+	}
+
+	// -------------------------------------------------------------------------
+	// A connected user is listed with the caps of its devices.
+
+	conn, id := connect(t, url)
+
+	var conns adminapp.Connections
+	get(t, url+"/admin/connections", http.StatusOK, &conns)
+
+	if len(conns) != 1 || conns[0].ID != id || conns[0].Name != "Alice" {
+		t.Fatalf("Should list alice's connection, got %+v", conns)
+	}
+
+	var devices adminapp.Devices
+	for range 50 {
+		get(t, url+"/admin/devices/"+id.Hex(), 0, &devices)
+		if len(devices) == 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if len(devices) != 1 || devices[0].CapID != c.CapID() {
+		t.Fatalf("Should list alice's device on the cap, got %+v", devices)
+	}
+
+	unknown := common.HexToAddress("0x1").Hex()
+
+	get(t, url+"/admin/devices/"+unknown, http.StatusNotFound, nil)
+	get(t, url+"/admin/devices/bad", http.StatusBadRequest, nil)
+
+	// -------------------------------------------------------------------------
+	// Disconnecting a user closes the connection with the reason.
+
+	resp := request(t, http.MethodDelete, url+"/admin/connections/"+unknown, "Bearer "+token)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Should not find a user that isn't connected, got status %d", resp.StatusCode)
+	}
+
+	resp = request(t, http.MethodDelete, url+"/admin/connections/"+id.Hex()+"?reason=bye", "Bearer "+token)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Should disconnect alice, got status %d", resp.StatusCode)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err := conn.ReadMessage()
+
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != protocol.CloseKicked || ce.Text != "bye" {
+		t.Fatalf("Should be closed with code %d and the reason, got %v", protocol.CloseKicked, err)
+	}
+}
+
+// =============================================================================
+
+// startCap serves the connect and admin routes of a cap and returns its url.
+func startCap(t *testing.T) (string, *chat.Chat) {
+	t.Helper()
+
+	ctx := context.Background()
+	log := logger.New(io.Discard, logger.LevelInfo, "TEST", func(context.Context) string { return "" })
+
+	ns, err := natsserver.Start(natsserver.Config{Port: -1, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Should be able to start nats: %s", err)
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Should be able to connect to nats: %s", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Should be able to create jetstream: %s", err)
+	}
+
+	grps, err := groups.New(ctx, log, js, subject+"-groups")
+	if err != nil {
+		t.Fatalf("Should be able to create groups: %s", err)
+	}
+
+	prs, err := presence.New(ctx, log, js, subject+"-presence", 30*time.Second)
+	if err != nil {
+		t.Fatalf("Should be able to create presence: %s", err)
+	}
+
+	off, err := offline.New(ctx, log, js, subject+"-offline", time.Hour, 100)
+	if err != nil {
+		t.Fatalf("Should be able to create offline: %s", err)
+	}
+
+	nnc, err := nonces.New(ctx, log, js, subject+"-nonces")
+	if err != nil {
+		t.Fatalf("Should be able to create nonces: %s", err)
+	}
+
+	c, err := chat.New(chat.Config{
+		Log:         log,
+		Bus:         membus.New(),
+		Subject:     subject,
+		CapID:       uuid.New(),
+		Users:       users.New(log),
+		Groups:      grps,
+		Presence:    prs,
+		Offline:     off,
+		Nonces:      nnc,
+		MaxFileSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("Should be able to create chat: %s", err)
+	}
+
+	app := web.NewApp(func(context.Context, string, ...any) {}, mid.Errors(log))
+
+	chatapp.Routes(app, log, c)
+	adminapp.Routes(app, adminapp.Config{
+		Log:   log,
+		Chat:  c,
+		Build: "test",
+		Token: token,
+	})
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	return srv.URL, c
+}
+
+func request(t *testing.T, method string, url string, auth string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("Should be able to create the request: %s", err)
+	}
+
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Should be able to send the request: %s", err)
+	}
+
+	return resp
+}
+
+// get sends an authorized request and decodes the response into v when it's
+// provided. The status is only checked when it's provided.
+func get(t *testing.T, url string, status int, v any) {
+	t.Helper()
+
+	resp := request(t, http.MethodGet, url, "Bearer "+token)
+	defer resp.Body.Close()
+
+	if status != 0 && resp.StatusCode != status {
+		t.Fatalf("Should get status %d for %s, got %d", status, url, resp.StatusCode)
+	}
+
+	if v == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Should be able to decode the response: %s", err)
+	}
+}
+
+// connect performs the handshake for alice and returns the connection.
+func connect(t *testing.T, url string) (*websocket.Conn, common.Address) {
+	t.Helper()
+
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Should be able to generate a key: %s", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/connect", nil)
+	if err != nil {
+		t.Fatalf("Should be able to dial the cap: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	hello := protocol.Hello{
+		ID:   crypto.PubkeyToAddress(pk.PublicKey),
+		Name: "Alice",
+	}
+	hello.Signature = sign(t, pk, hello.SignedData(chlg.Challenge))
+
+	data, err := protocol.Encode(protocol.TypeHello, hello)
+	if err != nil {
+		t.Fatalf("Should be able to encode the hello: %s", err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("Should be able to write the hello: %s", err)
+	}
+
+	var welcome protocol.Welcome
+	readFrame(t, conn, protocol.TypeWelcome, &welcome)
+
+	return conn, hello.ID
+}
+
+func sign(t *testing.T, pk *ecdsa.PrivateKey, data any) protocol.Signature {
+	t.Helper()
+
+	v, r, s, err := signature.Sign(data, pk)
+	if err != nil {
+		t.Fatalf("Should be able to sign: %s", err)
+	}
+
+	return protocol.Signature{V: v, R: r, S: s}
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn, typ protocol.Type, v any) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Should be able to read a %s frame: %s", typ, err)
+	}
+
+	env, err := protocol.Decode(msg)
+	if err != nil {
+		t.Fatalf("Should be able to decode the frame: %s", err)
+	}
+
+	if env.Type != typ {
+		t.Fatalf("Should receive a %s frame, got %s", typ, env.Type)
+	}
+
+	if err := env.Unmarshal(v); err != nil {
+		t.Fatalf("Should be able to unmarshal the %s frame: %s", typ, err)
+	}
+}
@@ -0,0 +1,110 @@
+package adminapp
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// CapInfo represents the identity of the cap and how it was built.
+type CapInfo struct {
+	CapID      uuid.UUID         `json:"capID"`
+	Build      string            `json:"build"`
+	GoVersion  string            `json:"goVersion"`
+	ModVersion string            `json:"modVersion"`
+	Settings   map[string]string `json:"settings"`
+}
+
+// Encode implements the encoder interface.
+func (ci CapInfo) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(ci)
+	return data, "application/json", err
+}
+
+// =============================================================================
+
+// Connection represents a user's device connected to the cap.
+type Connection struct {
+	ID         common.Address `json:"id"`
+	Name       string         `json:"name"`
+	Device     string         `json:"device"`
+	RemoteAddr string         `json:"remoteAddr"`
+	LastPing   time.Time      `json:"lastPing"`
+	LastPong   time.Time      `json:"lastPong"`
+}
+
+// Connections represents the set of devices connected to the cap.
+type Connections []Connection
+
+// Encode implements the encoder interface.
+func (c Connections) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(c)
+	return data, "application/json", err
+}
+
+func toConnections(conns map[chat.Session]chat.Connection) Connections {
+	list := make(Connections, 0, len(conns))
+	for s, conn := range conns {
+		c := Connection{
+			ID:       s.ID,
+			Name:     conn.Name,
+			Device:   s.Device,
+			LastPing: conn.LastPing,
+			LastPong: conn.LastPong,
+		}
+
+		if conn.Conn != nil {
+			c.RemoteAddr = conn.Conn.RemoteAddr().String()
+		}
+
+		list = append(list, c)
+	}
+
+	return list
+}
+
+// =============================================================================
+
+// Device represents a connected device of a user and the cap it is connected
+// to.
+type Device struct {
+	ID    string    `json:"id"`
+	CapID uuid.UUID `json:"capID"`
+}
+
+// Devices represents the set of connected devices of a user.
+type Devices []Device
+
+// Encode implements the encoder interface.
+func (d Devices) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(d)
+	return data, "application/json", err
+}
+
+func toDevices(devices map[string]uuid.UUID) Devices {
+	list := make(Devices, 0, len(devices))
+	for id, capID := range devices {
+		d := Device{
+			ID:    id,
+			CapID: capID,
+		}
+
+		list = append(list, d)
+	}
+
+	return list
+}
+
+// =============================================================================
+
+// BusInfo represents the state of the bus and of the cap's subscription.
+type BusInfo chat.BusInfo
+
+// Encode implements the encoder interface.
+func (bi BusInfo) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(bi)
+	return data, "application/json", err
+}
@@ -0,0 +1,33 @@
+package adminapp
+
+import (
+	"net/http"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/mid"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+)
+
+// Config contains all the mandatory systems required by handlers.
+type Config struct {
+	Log   *logger.Logger
+	Chat  *chat.Chat
+	Build string
+	Token string
+}
+
+// Routes adds specific routes for this group.
+func Routes(app *web.App, cfg Config) {
+	const version = "admin"
+
+	token := mid.Token(cfg.Token)
+
+	api := newApp(cfg.Log, cfg.Chat, cfg.Build)
+
+	app.HandlerFunc(http.MethodGet, version, "/cap", api.cap, token)
+	app.HandlerFunc(http.MethodGet, version, "/connections", api.connections, token)
+	app.HandlerFunc(http.MethodDelete, version, "/connections/{id}", api.disconnect, token)
+	app.HandlerFunc(http.MethodGet, version, "/devices/{id}", api.devices, token)
+	app.HandlerFunc(http.MethodGet, version, "/bus", api.bus, token)
+}
@@ -3,6 +3,7 @@ package chatapp
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
@@ -26,6 +27,18 @@ func newApp(log *logger.Logger, chat *chat.Chat) *app {
 func (a *app) connect(ctx context.Context, r *http.Request) web.Encoder {
 	usr, err := a.chat.Handshake(ctx, web.GetWriter(ctx), r)
 	if err != nil {
+		if errors.Is(err, chat.ErrShuttingDown) {
+			return errs.New(errs.Unavailable, err)
+		}
+		if errors.Is(err, chat.ErrRateLimited) {
+			return errs.New(errs.TooManyRequests, err)
+		}
+
+		// Requests refused before the upgrade carry the reason.
+		var appErr *errs.Error
+		if errors.As(err, &appErr) {
+			return appErr
+		}
 		return errs.Newf(errs.FailedPrecondition, "handshake failed: %s", err)
 	}
 	defer usr.Conn.Close()
@@ -0,0 +1,103 @@
+// Package checkapp maintains the app layer api for the check domain.
+package checkapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/metrics"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/nats-io/nats.go"
+)
+
+type app struct {
+	build string
+	log   *logger.Logger
+	nc    *nats.Conn
+	chat  *chat.Chat
+	mtrcs *metrics.Metrics
+}
+
+func newApp(build string, log *logger.Logger, nc *nats.Conn, chat *chat.Chat, mtrcs *metrics.Metrics) *app {
+	return &app{
+		build: build,
+		log:   log,
+		nc:    nc,
+		chat:  chat,
+		mtrcs: mtrcs,
+	}
+}
+
+// readiness checks if the cap can take new users. It reports not ready while
+// the cap is shutting down so the load balancer stops sending it users.
+func (a *app) readiness(ctx context.Context, r *http.Request) web.Encoder {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	rd := Readiness{
+		Status: statusReady,
+		Checks: make(map[string]string),
+	}
+
+	check := func(name string, err error) {
+		if err != nil {
+			rd.Status = statusNotReady
+			rd.Checks[name] = err.Error()
+			return
+		}
+		rd.Checks[name] = statusOK
+	}
+
+	var shutdown error
+	if a.chat.ShuttingDown() {
+		shutdown = errors.New("shutting down")
+	}
+	check("shutdown", shutdown)
+
+	var conn error
+	if status := a.nc.Status(); status != nats.CONNECTED {
+		conn = fmt.Errorf("connection %s", status)
+	}
+	check("nats", conn)
+
+	_, err := a.chat.BusInfo(ctx)
+	check("bus", err)
+
+	check("ping", a.chat.CheckPing())
+
+	if rd.Status != statusReady {
+		a.log.Info(ctx, "readiness failure", "checks", rd.Checks)
+	}
+
+	return rd
+}
+
+// liveness returns simple status info if the service is alive.
+func (a *app) liveness(ctx context.Context, r *http.Request) web.Encoder {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unavailable"
+	}
+
+	info := Info{
+		Status:     "up",
+		Build:      a.build,
+		Host:       host,
+		CapID:      a.chat.CapID().String(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+
+	return info
+}
+
+// metrics returns the metrics in the Prometheus text format.
+func (a *app) metrics(ctx context.Context, r *http.Request) web.Encoder {
+	return a.mtrcs
+}
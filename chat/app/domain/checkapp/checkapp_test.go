@@ -0,0 +1,135 @@
+package checkapp_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/domain/checkapp"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/membus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/users"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/natsserver"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+func Test_Readiness(t *testing.T) {
+	ns, err := natsserver.Start(natsserver.Config{Port: -1, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Should be able to start nats: %s", err)
+	}
+	t.Cleanup(ns.Shutdown)
+
+	// -------------------------------------------------------------------------
+
+	t.Run("ready", func(t *testing.T) {
+		app, _, _ := newApp(t, ns)
+
+		rd := readiness(t, app, http.StatusOK)
+
+		if rd.Status != "ready" {
+			t.Fatalf("Should be ready, got %+v", rd)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		app, c, _ := newApp(t, ns)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := c.Drain(ctx); err != nil {
+			t.Fatalf("Should be able to drain the cap: %s", err)
+		}
+
+		if !c.ShuttingDown() {
+			t.Fatal("Should report the cap is shutting down")
+		}
+
+		rd := readiness(t, app, http.StatusServiceUnavailable)
+
+		if rd.Status != "not ready" || rd.Checks["shutdown"] != "shutting down" {
+			t.Fatalf("Should not be ready while shutting down, got %+v", rd)
+		}
+	})
+
+	t.Run("nats", func(t *testing.T) {
+		app, _, nc := newApp(t, ns)
+
+		nc.Close()
+
+		rd := readiness(t, app, http.StatusServiceUnavailable)
+
+		if rd.Status != "not ready" || rd.Checks["nats"] == "ok" {
+			t.Fatalf("Should not be ready without nats, got %+v", rd)
+		}
+
+		if rd.Checks["shutdown"] != "ok" {
+			t.Fatalf("Should only fail the nats check, got %+v", rd)
+		}
+	})
+}
+
+// =============================================================================
+
+// newApp returns the check routes of a cap connected to the nats server.
+func newApp(t *testing.T, ns *natsserver.Server) (*web.App, *chat.Chat, *nats.Conn) {
+	t.Helper()
+
+	log := logger.New(io.Discard, logger.LevelInfo, "TEST", func(context.Context) string { return "" })
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Should be able to connect to nats: %s", err)
+	}
+	t.Cleanup(nc.Close)
+
+	c, err := chat.New(chat.Config{
+		Log:         log,
+		Bus:         membus.New(),
+		Subject:     "test-check",
+		CapID:       uuid.New(),
+		Users:       users.New(log),
+		MaxFileSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("Should be able to create chat: %s", err)
+	}
+
+	app := web.NewApp(func(context.Context, string, ...any) {})
+
+	checkapp.Routes(app, checkapp.Config{
+		Build: "test",
+		Log:   log,
+		NATS:  nc,
+		Chat:  c,
+	})
+
+	return app, c, nc
+}
+
+// readiness calls the readiness probe and checks the status of the response.
+func readiness(t *testing.T, app *web.App, status int) checkapp.Readiness {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+
+	if w.Code != status {
+		t.Fatalf("Should get status %d, got %d: %s", status, w.Code, w.Body)
+	}
+
+	var rd checkapp.Readiness
+	if err := json.NewDecoder(w.Body).Decode(&rd); err != nil {
+		t.Fatalf("Should be able to decode the response: %s", err)
+	}
+
+	return rd
+}
@@ -0,0 +1,53 @@
+package checkapp
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Info represents information about the service.
+type Info struct {
+	Status     string `json:"status,omitempty"`
+	Build      string `json:"build,omitempty"`
+	Host       string `json:"host,omitempty"`
+	CapID      string `json:"capID,omitempty"`
+	GOMAXPROCS int    `json:"GOMAXPROCS,omitempty"`
+}
+
+// Encode implements the encoder interface.
+func (i Info) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(i)
+	return data, "application/json", err
+}
+
+// =============================================================================
+
+// Set of readiness states.
+const (
+	statusOK       = "ok"
+	statusReady    = "ready"
+	statusNotReady = "not ready"
+)
+
+// Readiness represents whether the cap can take new users and the result of
+// every check that was run.
+type Readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Encode implements the encoder interface.
+func (r Readiness) Encode() ([]byte, string, error) {
+	data, err := json.Marshal(r)
+	return data, "application/json", err
+}
+
+// HTTPStatus implements the web package httpStatus interface so the
+// probe fails when the cap is not ready.
+func (r Readiness) HTTPStatus() int {
+	if r.Status != statusReady {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusOK
+}
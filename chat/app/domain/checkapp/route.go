@@ -0,0 +1,30 @@
+package checkapp
+
+import (
+	"net/http"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/metrics"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/nats-io/nats.go"
+)
+
+// Config contains all the mandatory systems required by handlers.
+type Config struct {
+	Build   string
+	Log     *logger.Logger
+	NATS    *nats.Conn
+	Chat    *chat.Chat
+	Metrics *metrics.Metrics
+}
+
+// Routes adds specific routes for this group. The probes and the metrics
+// skip the middleware so they don't flood the logs.
+func Routes(app *web.App, cfg Config) {
+	api := newApp(cfg.Build, cfg.Log, cfg.NATS, cfg.Chat, cfg.Metrics)
+
+	app.HandlerFuncNoMid(http.MethodGet, "", "/readiness", api.readiness)
+	app.HandlerFuncNoMid(http.MethodGet, "", "/liveness", api.liveness)
+	app.HandlerFuncNoMid(http.MethodGet, "", "/metrics", api.metrics)
+}
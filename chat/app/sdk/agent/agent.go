@@ -0,0 +1,504 @@
+// Package agent provides support for a bot user that answers the messages it
+// receives using a language model. The agent connects to a cap like any other
+// client, with its own identity, so users message it like any contact.
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/llm"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/signature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// Set of replies the agent sends when it can't ask the model.
+const (
+	replyEncrypted   = "I can't read encrypted messages, please send me messages in the clear."
+	replyRateLimited = "You're sending messages faster than I can answer, please try again in a moment."
+	replyUnavailable = "Sorry, I can't answer right now, please try again later."
+)
+
+// Set of defaults used when the queue settings are not provided.
+const (
+	defaultQueue       = 10
+	defaultIdleTimeout = 30 * time.Minute
+)
+
+// LLM defines the behavior required to get a reply from a language model.
+type LLM interface {
+	Chat(ctx context.Context, msgs []llm.Message) (string, error)
+}
+
+// Config represents the settings for the agent. History is the number of
+// messages of a conversation sent to the model. Rate and Burst limit how
+// many messages of a single user are sent to the model. Queue is the number
+// of messages of a single user waiting to be answered, the messages past it
+// are refused. A conversation nobody used for the IdleTimeout is forgotten.
+type Config struct {
+	Log          *logger.Logger
+	CapURL       string
+	Name         string
+	Key          *ecdsa.PrivateKey
+	LLM          LLM
+	SystemPrompt string
+	History      int
+	Rate         rate.Limit
+	Burst        int
+	Queue        int
+	IdleTimeout  time.Duration
+	NoncesFile   string
+}
+
+// Agent represents a bot user connected to a cap.
+type Agent struct {
+	log          *logger.Logger
+	capURL       string
+	name         string
+	id           common.Address
+	key          *ecdsa.PrivateKey
+	llm          LLM
+	systemPrompt string
+	history      int
+	rate         rate.Limit
+	burst        int
+	queue        int
+	idleTimeout  time.Duration
+	nonces       *nonces
+
+	conn    *websocket.Conn
+	muWrite sync.Mutex
+
+	convs   map[common.Address]*conversation
+	muConvs sync.Mutex
+}
+
+// New constructs an agent. The nonces the agent used are kept in the nonces
+// file since the caps reject a nonce that was already used, even after the
+// agent restarts.
+func New(cfg Config) (*Agent, error) {
+	if cfg.Key == nil {
+		return nil, errors.New("key is required")
+	}
+
+	if cfg.LLM == nil {
+		return nil, errors.New("llm is required")
+	}
+
+	if cfg.History <= 0 {
+		return nil, errors.New("history must be greater than zero")
+	}
+
+	if cfg.Queue <= 0 {
+		cfg.Queue = defaultQueue
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+
+	nnc, err := loadNonces(cfg.NoncesFile)
+	if err != nil {
+		return nil, fmt.Errorf("nonces: %w", err)
+	}
+
+	a := Agent{
+		log:          cfg.Log,
+		capURL:       cfg.CapURL,
+		name:         cfg.Name,
+		id:           crypto.PubkeyToAddress(cfg.Key.PublicKey),
+		key:          cfg.Key,
+		llm:          cfg.LLM,
+		systemPrompt: cfg.SystemPrompt,
+		history:      cfg.History,
+		rate:         cfg.Rate,
+		burst:        cfg.Burst,
+		queue:        cfg.Queue,
+		idleTimeout:  cfg.IdleTimeout,
+		nonces:       nnc,
+		convs:        make(map[common.Address]*conversation),
+	}
+
+	return &a, nil
+}
+
+// ID returns the address users send messages to.
+func (a *Agent) ID() common.Address {
+	return a.id
+}
+
+// Run connects to the cap and answers messages until the context is canceled
+// or the connection is lost.
+func (a *Agent) Run(ctx context.Context) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, a.capURL, nil)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	a.conn = conn
+
+	if err := a.handshake(); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	a.log.Info(ctx, "agent", "status", "connected", "id", a.id, "cap", a.capURL)
+
+	// Closing the connection unblocks the read below.
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// The answers in progress and the eviction stop once we return.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.evictIdle(ctx)
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read: %w", err)
+		}
+
+		env, err := protocol.Decode(data)
+		if err != nil {
+			a.log.Info(ctx, "agent", "status", "decode", "ERROR", err)
+			continue
+		}
+
+		switch env.Type {
+		case protocol.TypeChat:
+			var cm protocol.ChatMessage
+			if err := env.Unmarshal(&cm); err != nil {
+				a.log.Info(ctx, "agent", "status", "unmarshal", "ERROR", err)
+				continue
+			}
+
+			if cm.Group != nil {
+				continue
+			}
+
+			a.enqueue(ctx, &wg, cm)
+
+		case protocol.TypeError:
+			var em protocol.ErrorMessage
+			if err := env.Unmarshal(&em); err == nil {
+				a.log.Info(ctx, "agent", "status", "cap error", "code", em.Code, "message", em.Message, "toID", em.ToID, "nonce", em.Nonce)
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+func (a *Agent) handshake() error {
+	var chlg protocol.Challenge
+	if err := a.readFrame(protocol.TypeChallenge, &chlg); err != nil {
+		return err
+	}
+
+	hello := protocol.Hello{
+		ID:   a.id,
+		Name: a.name,
+	}
+
+	sig, err := a.sign(hello.SignedData(chlg.Challenge))
+	if err != nil {
+		return err
+	}
+
+	hello.Signature = sig
+
+	if err := a.writeFrame(protocol.TypeHello, hello); err != nil {
+		return err
+	}
+
+	var welcome protocol.Welcome
+	return a.readFrame(protocol.TypeWelcome, &welcome)
+}
+
+// enqueue answers the message in the background. Users are answered in
+// parallel, but the messages of a user are answered one at a time in the
+// order they arrived so the conversation stays in order. A user with a full
+// queue is told to slow down right away.
+func (a *Agent) enqueue(ctx context.Context, wg *sync.WaitGroup, cm protocol.ChatMessage) {
+	a.muConvs.Lock()
+
+	conv := a.conversation(cm.From.ID)
+
+	if len(conv.queue) >= a.queue {
+		a.muConvs.Unlock()
+
+		if err := a.sendChat(cm.From.ID, replyRateLimited); err != nil {
+			a.log.Info(ctx, "agent", "status", "send reply", "to", cm.From.ID, "ERROR", err)
+		}
+		return
+	}
+
+	conv.queue = append(conv.queue, cm)
+
+	start := !conv.busy
+	conv.busy = true
+
+	a.muConvs.Unlock()
+
+	if !start {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.work(ctx, conv)
+	}()
+}
+
+// work answers the messages queued for the conversation until there are none
+// left.
+func (a *Agent) work(ctx context.Context, conv *conversation) {
+	for {
+		a.muConvs.Lock()
+
+		if len(conv.queue) == 0 {
+			conv.busy = false
+			conv.used = time.Now()
+			a.muConvs.Unlock()
+			return
+		}
+
+		cm := conv.queue[0]
+		conv.queue = conv.queue[1:]
+
+		a.muConvs.Unlock()
+
+		a.answer(ctx, conv, cm)
+	}
+}
+
+// evictIdle forgets the conversations nobody used for the idle timeout until
+// the context is canceled.
+func (a *Agent) evictIdle(ctx context.Context) {
+	ticker := time.NewTicker(a.idleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			a.evict(time.Now().Add(-a.idleTimeout))
+		}
+	}
+}
+
+// evict forgets the conversations last used before the specified time that
+// have no message waiting to be answered.
+func (a *Agent) evict(before time.Time) {
+	a.muConvs.Lock()
+	defer a.muConvs.Unlock()
+
+	for id, conv := range a.convs {
+		if !conv.busy && conv.used.Before(before) {
+			delete(a.convs, id)
+		}
+	}
+}
+
+// answer replies to a message from a user.
+func (a *Agent) answer(ctx context.Context, conv *conversation, cm protocol.ChatMessage) {
+	from := cm.From.ID
+
+	if err := a.sendReceipt(from, cm.From.Device, cm.From.Nonce, protocol.ReceiptRead); err != nil {
+		a.log.Info(ctx, "agent", "status", "send receipt", "to", from, "ERROR", err)
+	}
+
+	reply := a.reply(ctx, conv, cm)
+
+	if err := a.sendChat(from, reply); err != nil {
+		a.log.Info(ctx, "agent", "status", "send reply", "to", from, "ERROR", err)
+	}
+}
+
+func (a *Agent) reply(ctx context.Context, conv *conversation, cm protocol.ChatMessage) string {
+	if cm.Encrypted {
+		return replyEncrypted
+	}
+
+	if !conv.limiter.Allow() {
+		return replyRateLimited
+	}
+
+	msgs := make([]llm.Message, 0, len(conv.msgs)+2)
+	if a.systemPrompt != "" {
+		msgs = append(msgs, llm.Message{Role: llm.RoleSystem, Content: a.systemPrompt})
+	}
+	msgs = append(msgs, conv.msgs...)
+	msgs = append(msgs, llm.Message{Role: llm.RoleUser, Content: cm.Msg})
+
+	reply, err := a.llm.Chat(ctx, msgs)
+	if err != nil {
+		a.log.Info(ctx, "agent", "status", "llm chat", "from", cm.From.ID, "ERROR", err)
+		return replyUnavailable
+	}
+
+	conv.add(a.history,
+		llm.Message{Role: llm.RoleUser, Content: cm.Msg},
+		llm.Message{Role: llm.RoleAssistant, Content: reply},
+	)
+
+	return reply
+}
+
+// conversation returns the conversation with the user, starting one when
+// needed. The caller must hold muConvs.
+func (a *Agent) conversation(userID common.Address) *conversation {
+	conv, exists := a.convs[userID]
+	if !exists {
+		conv = &conversation{
+			limiter: rate.NewLimiter(a.rate, a.burst),
+		}
+		a.convs[userID] = conv
+	}
+
+	conv.used = time.Now()
+
+	return conv
+}
+
+func (a *Agent) sendChat(to common.Address, msg string) error {
+	nonce, err := a.nonces.next(to)
+	if err != nil {
+		return fmt.Errorf("nonce: %w", err)
+	}
+
+	req := protocol.ChatRequest{
+		ToID:      to,
+		Msg:       msg,
+		FromNonce: nonce,
+	}
+
+	sig, err := a.sign(req.SignedData())
+	if err != nil {
+		return err
+	}
+
+	req.Signature = sig
+
+	return a.writeFrame(protocol.TypeChat, req)
+}
+
+func (a *Agent) sendReceipt(to common.Address, device string, nonce uint64, state string) error {
+	req := protocol.ReceiptRequest{
+		ToID: to,
+		Receipt: protocol.Receipt{
+			Nonce:  nonce,
+			State:  state,
+			Device: device,
+		},
+	}
+
+	sig, err := a.sign(req.SignedData())
+	if err != nil {
+		return err
+	}
+
+	req.Signature = sig
+
+	return a.writeFrame(protocol.TypeReceipt, req)
+}
+
+func (a *Agent) sign(data any) (protocol.Signature, error) {
+	v, r, s, err := signature.Sign(data, a.key)
+	if err != nil {
+		return protocol.Signature{}, fmt.Errorf("signing: %w", err)
+	}
+
+	return protocol.Signature{V: v, R: r, S: s}, nil
+}
+
+func (a *Agent) writeFrame(typ protocol.Type, payload any) error {
+	data, err := protocol.Encode(typ, payload)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", typ, err)
+	}
+
+	a.muWrite.Lock()
+	defer a.muWrite.Unlock()
+
+	if err := a.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+func (a *Agent) readFrame(typ protocol.Type, v any) error {
+	_, data, err := a.conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	env, err := protocol.Decode(data)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	switch env.Type {
+	case typ:
+		return env.Unmarshal(v)
+
+	case protocol.TypeError:
+		var em protocol.ErrorMessage
+		if err := env.Unmarshal(&em); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("cap: %s: %s", em.Code, em.Message)
+	}
+
+	return fmt.Errorf("unexpected %s frame: expected %s", env.Type, typ)
+}
+
+// =============================================================================
+
+// conversation holds the recent messages exchanged with a user. The queue,
+// busy and used fields are guarded by the agent's muConvs, busy is set while
+// a goroutine answers the queued messages.
+type conversation struct {
+	msgs    []llm.Message
+	limiter *rate.Limiter
+	queue   []protocol.ChatMessage
+	busy    bool
+	used    time.Time
+}
+
+// add appends the messages, keeping no more than limit messages.
+func (c *conversation) add(limit int, msgs ...llm.Message) {
+	c.msgs = append(c.msgs, msgs...)
+
+	if n := len(c.msgs) - limit; n > 0 {
+		c.msgs = c.msgs[n:]
+	}
+}
@@ -0,0 +1,453 @@
+package agent_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/agent"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/groups"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/membus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/nonces"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/offline"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/presence"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/users"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/llm"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/natsserver"
+	"github.com/ardanlabs/usdl/chat/foundation/signature"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"golang.org/x/time/rate"
+)
+
+const subject = "test-agent"
+
+func Test_Agent(t *testing.T) {
+	capURL, prs := startCap(t)
+
+	agt := startAgent(t, capURL, prs, startLLM(t, nil), func(cfg *agent.Config) {
+		cfg.History = 4
+		cfg.Rate = rate.Every(time.Hour)
+		cfg.Burst = 2
+	})
+
+	// -------------------------------------------------------------------------
+
+	conn, pk := connect(t, capURL)
+
+	// The fake model tells us how many messages of the conversation it got,
+	// so we know the history is sent along.
+
+	exp := []string{
+		"hello (1 messages)",
+		"again (3 messages)",
+		"You're sending messages faster than I can answer, please try again in a moment.",
+	}
+
+	for i, msg := range []string{"hello", "again", "too fast"} {
+		sendChat(t, conn, pk, agt, uint64(i+1), msg)
+
+		cm := readChat(t, conn)
+
+		if cm.From.ID != agt.ID() || cm.From.Nonce != uint64(i+1) || cm.Msg != exp[i] {
+			t.Fatalf("Should get reply %q with nonce %d, got %q with nonce %d", exp[i], i+1, cm.Msg, cm.From.Nonce)
+		}
+	}
+}
+
+func Test_AgentQueue(t *testing.T) {
+	capURL, prs := startCap(t)
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	llmURL := startLLM(t, func() {
+		started <- struct{}{}
+		<-release
+	})
+
+	agt := startAgent(t, capURL, prs, llmURL, func(cfg *agent.Config) {
+		cfg.Queue = 2
+	})
+
+	conn, pk := connect(t, capURL)
+
+	// -------------------------------------------------------------------------
+	// While the model answers the first message, two more wait in the queue
+	// and the one after them is refused right away.
+
+	sendChat(t, conn, pk, agt, 1, "first")
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should ask the model about the first message")
+	}
+
+	for i, msg := range []string{"second", "third", "fourth"} {
+		sendChat(t, conn, pk, agt, uint64(i+2), msg)
+	}
+
+	cm := readChat(t, conn)
+
+	if cm.Msg != "You're sending messages faster than I can answer, please try again in a moment." {
+		t.Fatalf("Should be told to slow down, got %q", cm.Msg)
+	}
+
+	close(release)
+
+	for _, exp := range []string{"first (1 messages)", "second (3 messages)", "third (5 messages)"} {
+		cm := readChat(t, conn)
+
+		if cm.Msg != exp {
+			t.Fatalf("Should get reply %q, got %q", exp, cm.Msg)
+		}
+	}
+}
+
+func Test_AgentIdle(t *testing.T) {
+	capURL, prs := startCap(t)
+
+	agt := startAgent(t, capURL, prs, startLLM(t, nil), func(cfg *agent.Config) {
+		cfg.IdleTimeout = 100 * time.Millisecond
+	})
+
+	conn, pk := connect(t, capURL)
+
+	// -------------------------------------------------------------------------
+	// The conversation is forgotten once it was idle for a while, so the
+	// history is no longer sent to the model.
+
+	sendChat(t, conn, pk, agt, 1, "hello")
+
+	if cm := readChat(t, conn); cm.Msg != "hello (1 messages)" {
+		t.Fatalf("Should get the reply to the first message, got %q", cm.Msg)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	sendChat(t, conn, pk, agt, 2, "again")
+
+	if cm := readChat(t, conn); cm.Msg != "again (1 messages)" {
+		t.Fatalf("Should get a reply without the history, got %q", cm.Msg)
+	}
+}
+
+// =============================================================================
+
+// startLLM starts a fake model server that echoes the last message. The
+// before function is called for every request when it's provided.
+func startLLM(t *testing.T, before func()) string {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if before != nil {
+			before()
+		}
+
+		var req struct {
+			Messages []llm.Message `json:"messages"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Messages) == 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		last := req.Messages[len(req.Messages)-1]
+		content := fmt.Sprintf("%s (%d messages)", last.Content, len(req.Messages))
+
+		resp := map[string]any{
+			"choices": []any{
+				map[string]any{"message": llm.Message{Role: llm.RoleAssistant, Content: content}},
+			},
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+// startAgent runs an agent connected to the cap until the test ends.
+func startAgent(t *testing.T, capURL string, prs *presence.Presence, llmURL string, options ...func(cfg *agent.Config)) *agent.Agent {
+	t.Helper()
+
+	cln, err := llm.New(llm.Config{URL: llmURL, Model: "fake"})
+	if err != nil {
+		t.Fatalf("Should be able to create the llm client: %s", err)
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Should be able to generate a key: %s", err)
+	}
+
+	cfg := agent.Config{
+		Log:        newLogger(),
+		CapURL:     capURL,
+		Name:       "Agent",
+		Key:        key,
+		LLM:        cln,
+		History:    10,
+		Rate:       rate.Inf,
+		NoncesFile: filepath.Join(t.TempDir(), "nonces.json"),
+	}
+
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	agt, err := agent.New(cfg)
+	if err != nil {
+		t.Fatalf("Should be able to create the agent: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- agt.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitOnline(t, prs, agt)
+
+	return agt
+}
+
+func startCap(t *testing.T) (string, *presence.Presence) {
+	t.Helper()
+
+	ctx := context.Background()
+	log := newLogger()
+
+	ns, err := natsserver.Start(natsserver.Config{Port: -1, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Should be able to start nats: %s", err)
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Should be able to connect to nats: %s", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Should be able to create jetstream: %s", err)
+	}
+
+	grps, err := groups.New(ctx, log, js, subject+"-groups")
+	if err != nil {
+		t.Fatalf("Should be able to create groups: %s", err)
+	}
+
+	prs, err := presence.New(ctx, log, js, subject+"-presence", 30*time.Second)
+	if err != nil {
+		t.Fatalf("Should be able to create presence: %s", err)
+	}
+
+	off, err := offline.New(ctx, log, js, subject+"-offline", time.Hour, 100)
+	if err != nil {
+		t.Fatalf("Should be able to create offline: %s", err)
+	}
+
+	nnc, err := nonces.New(ctx, log, js, subject+"-nonces")
+	if err != nil {
+		t.Fatalf("Should be able to create nonces: %s", err)
+	}
+
+	cfg := chat.Config{
+		Log:         log,
+		Bus:         membus.New(),
+		Subject:     subject,
+		CapID:       uuid.New(),
+		Users:       users.New(log),
+		Groups:      grps,
+		Presence:    prs,
+		Offline:     off,
+		Nonces:      nnc,
+		MaxFileSize: 1024,
+	}
+
+	c, err := chat.New(cfg)
+	if err != nil {
+		t.Fatalf("Should be able to create chat: %s", err)
+	}
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		usr, err := c.Handshake(r.Context(), w, r)
+		if err != nil {
+			return
+		}
+		defer usr.Conn.Close()
+
+		c.ListenClient(r.Context(), usr)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), prs
+}
+
+func newLogger() *logger.Logger {
+	return logger.New(io.Discard, logger.LevelInfo, "TEST", func(context.Context) string { return "" })
+}
+
+func waitOnline(t *testing.T, prs *presence.Presence, agt *agent.Agent) {
+	t.Helper()
+
+	for range 50 {
+		if _, err := prs.Retrieve(context.Background(), agt.ID()); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatal("Should see the agent online")
+}
+
+// connect performs the handshake for a new user.
+func connect(t *testing.T, url string) (*websocket.Conn, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Should be able to generate a key: %s", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Should be able to dial the cap: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	hello := protocol.Hello{
+		ID:   crypto.PubkeyToAddress(pk.PublicKey),
+		Name: "Alice",
+	}
+
+	v, r, s, err := signature.Sign(hello.SignedData(chlg.Challenge), pk)
+	if err != nil {
+		t.Fatalf("Should be able to sign: %s", err)
+	}
+	hello.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	writeFrame(t, conn, protocol.TypeHello, hello)
+
+	var welcome protocol.Welcome
+	readFrame(t, conn, protocol.TypeWelcome, &welcome)
+
+	return conn, pk
+}
+
+// sendChat signs and sends a message to the agent.
+func sendChat(t *testing.T, conn *websocket.Conn, pk *ecdsa.PrivateKey, agt *agent.Agent, nonce uint64, msg string) {
+	t.Helper()
+
+	req := protocol.ChatRequest{
+		ToID:      agt.ID(),
+		Msg:       msg,
+		FromNonce: nonce,
+	}
+
+	v, r, s, err := signature.Sign(req.SignedData(), pk)
+	if err != nil {
+		t.Fatalf("Should be able to sign: %s", err)
+	}
+	req.Signature = protocol.Signature{V: v, R: r, S: s}
+
+	writeFrame(t, conn, protocol.TypeChat, req)
+}
+
+// readChat skips the receipts and statuses until the next chat message.
+func readChat(t *testing.T, conn *websocket.Conn) protocol.ChatMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Should be able to read a frame: %s", err)
+		}
+
+		env, err := protocol.Decode(msg)
+		if err != nil {
+			t.Fatalf("Should be able to decode the frame: %s", err)
+		}
+
+		if env.Type != protocol.TypeChat {
+			continue
+		}
+
+		var cm protocol.ChatMessage
+		if err := env.Unmarshal(&cm); err != nil {
+			t.Fatalf("Should be able to unmarshal the chat frame: %s", err)
+		}
+
+		return cm
+	}
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn, typ protocol.Type, v any) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Should be able to read a %s frame: %s", typ, err)
+	}
+
+	env, err := protocol.Decode(msg)
+	if err != nil {
+		t.Fatalf("Should be able to decode the frame: %s", err)
+	}
+
+	if env.Type != typ {
+		t.Fatalf("Should receive a %s frame, got %s", typ, env.Type)
+	}
+
+	if err := env.Unmarshal(v); err != nil {
+		t.Fatalf("Should be able to unmarshal the %s frame: %s", typ, err)
+	}
+}
+
+func writeFrame(t *testing.T, conn *websocket.Conn, typ protocol.Type, payload any) {
+	t.Helper()
+
+	data, err := protocol.Encode(typ, payload)
+	if err != nil {
+		t.Fatalf("Should be able to encode a %s frame: %s", typ, err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("Should be able to write a %s frame: %s", typ, err)
+	}
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// nonces tracks the last nonce the agent used for each user. When a file is
+// specified the nonces are saved to it after every change.
+type nonces struct {
+	file string
+
+	mu   sync.Mutex
+	last map[common.Address]uint64
+}
+
+func loadNonces(file string) (*nonces, error) {
+	n := nonces{
+		file: file,
+		last: make(map[common.Address]uint64),
+	}
+
+	if file == "" {
+		return &n, nil
+	}
+
+	data, err := os.ReadFile(file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return &n, nil
+
+	case err != nil:
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &n.last); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return &n, nil
+}
+
+// next returns the nonce to use for the next message to the user.
+func (n *nonces) next(userID common.Address) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	nonce := n.last[userID] + 1
+	n.last[userID] = nonce
+
+	if n.file == "" {
+		return nonce, nil
+	}
+
+	data, err := json.Marshal(n.last)
+	if err != nil {
+		return 0, fmt.Errorf("marshal: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(n.file), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("mkdir: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial file.
+	tmp := n.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+
+	if err := os.Rename(tmp, n.file); err != nil {
+		return 0, fmt.Errorf("rename: %w", err)
+	}
+
+	return nonce, nil
+}
@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// CapID returns the identity of the cap.
+func (c *Chat) CapID() uuid.UUID {
+	return c.capID
+}
+
+// Connections returns the devices connected to this cap.
+func (c *Chat) Connections() map[Session]Connection {
+	return c.users.Connections()
+}
+
+// Disconnect closes the connection of a user's device connected to this cap.
+// Every device of the user connected to this cap is closed when no device is
+// specified. The client is told why with the close frame. A device is removed
+// once the client's read loop sees the connection closed.
+func (c *Chat) Disconnect(ctx context.Context, userID common.Address, device string, reason string) error {
+	devices, err := c.users.Retrieve(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+
+	for _, usr := range devices {
+		if device != "" && usr.Device != device {
+			continue
+		}
+
+		c.closeConn(usr.Conn, protocol.CloseKicked, reason)
+		found = true
+	}
+
+	if !found {
+		return ErrNotExists
+	}
+
+	return nil
+}
+
+// Devices returns the cap each connected device of the user is connected to.
+func (c *Chat) Devices(ctx context.Context, userID common.Address) (map[string]uuid.UUID, error) {
+	return c.presence.Retrieve(ctx, userID)
+}
+
+// BusInfo returns the state of the bus and of this cap's subscription.
+func (c *Chat) BusInfo(ctx context.Context) (BusInfo, error) {
+	info, err := c.bus.Info(ctx, c.capID.String())
+	if err != nil {
+		return BusInfo{}, fmt.Errorf("bus info: %w", err)
+	}
+
+	return info, nil
+}
@@ -3,112 +3,285 @@ package chat
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
 	"github.com/ardanlabs/usdl/chat/foundation/logger"
 	"github.com/ardanlabs/usdl/chat/foundation/signature"
 	"github.com/ardanlabs/usdl/chat/foundation/web"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/nats-io/nats.go"
-	"github.com/nats-io/nats.go/jetstream"
 )
 
 // Set of error variables.
 var (
-	ErrExists    = fmt.Errorf("user exists")
-	ErrNotExists = fmt.Errorf("user doesn't exists")
+	ErrExists         = fmt.Errorf("user exists")
+	ErrNotExists      = fmt.Errorf("user doesn't exists")
+	ErrGroupExists    = fmt.Errorf("group exists")
+	ErrGroupNotExists = fmt.Errorf("group doesn't exists")
+	ErrNotMember      = fmt.Errorf("user is not a member of the group")
+	ErrQuotaExceeded  = fmt.Errorf("offline quota exceeded")
+	ErrInvalidNonce   = fmt.Errorf("invalid nonce")
+	ErrShuttingDown   = fmt.Errorf("cap is shutting down")
+	ErrRateLimited    = fmt.Errorf("rate limit exceeded")
+	ErrSlowConsumer   = fmt.Errorf("slow consumer")
+	ErrConnClosed     = fmt.Errorf("connection closed")
+	ErrMessageTooBig  = fmt.Errorf("message too big")
 )
 
-// Users defines the set of behavior for user management.
+// handshakeTimeout is how long a client has to answer the challenge.
+const handshakeTimeout = 100 * time.Millisecond
+
+// Users defines the set of behavior for user management. A user can be
+// connected from several devices at once, each with its own connection.
+// Retrieve returns every device of the user.
 type Users interface {
 	Add(ctx context.Context, usr User) error
-	UpdateLastPing(ctx context.Context, userID common.Address) error
-	UpdateLastPong(ctx context.Context, userID common.Address) (User, error)
-	Remove(ctx context.Context, userID common.Address)
-	Connections() map[common.Address]Connection
-	Retrieve(ctx context.Context, userID common.Address) (User, error)
+	UpdateLastPing(ctx context.Context, s Session) error
+	UpdateLastPong(ctx context.Context, s Session) (User, error)
+	Remove(ctx context.Context, s Session)
+	Connections() map[Session]Connection
+	Retrieve(ctx context.Context, userID common.Address) ([]User, error)
+}
+
+// Groups defines the set of behavior for group management. The storage must
+// be shared by every cap so membership is the same no matter where a user
+// is connected.
+type Groups interface {
+	Create(ctx context.Context, grp Group) error
+	AddMember(ctx context.Context, groupID common.Address, userID common.Address) (Group, error)
+	RemoveMember(ctx context.Context, groupID common.Address, userID common.Address) (Group, error)
+	Retrieve(ctx context.Context, groupID common.Address) (Group, error)
+}
+
+// Presence defines the set of behavior for tracking which cap each device of
+// a user is connected to and the user's status. The storage must be shared by
+// every cap.
+type Presence interface {
+	Set(ctx context.Context, userID common.Address, device string, capID uuid.UUID) error
+	SetStatus(ctx context.Context, userID common.Address, status string) error
+	Delete(ctx context.Context, userID common.Address, device string, capID uuid.UUID) error
+	Retrieve(ctx context.Context, userID common.Address) (map[string]uuid.UUID, error)
+	Status(ctx context.Context, userID common.Address) (UserStatus, error)
+}
+
+// Offline defines the set of behavior for storing messages for users that
+// are not connected to any cap until they connect again.
+type Offline interface {
+	Store(ctx context.Context, userID common.Address, data []byte) error
+	Drain(ctx context.Context, userID common.Address, deliver func(data []byte) error) error
+}
+
+// Nonces defines the set of behavior for tracking the last nonce each device
+// of a user sent to each recipient. The storage must be shared by every cap
+// so a frame can't be replayed through a different cap.
+type Nonces interface {
+	Advance(ctx context.Context, from Session, toID common.Address, nonce uint64) error
+}
+
+// Limiter defines the set of behavior for rate limiting with token buckets,
+// one bucket per key. The storage must be shared by every cap so spreading
+// connections over caps doesn't raise the limits.
+type Limiter interface {
+	Take(ctx context.Context, key string, limit Limit, n int) error
+}
+
+// BusMessage represents a message received from the bus.
+type BusMessage interface {
+	Subject() string
+	Data() []byte
+	Ack() error
+}
+
+// Bus defines the set of behavior for exchanging messages between caps. A
+// message published on a subject is delivered to every subscription that
+// includes the subject. Subscriptions are durable by name, so a cap that
+// subscribes again continues where it left off. Drain stops a subscription
+// once the messages already handed to it are handled.
+type Bus interface {
+	Publish(ctx context.Context, subject string, data []byte) error
+	Subscribe(ctx context.Context, name string, subjects []string, handler func(msg BusMessage)) error
+	Info(ctx context.Context, name string) (BusInfo, error)
+	Drain(ctx context.Context, name string) error
+}
+
+// Config contains all the mandatory systems required by the chat support.
+// Metrics is optional, nothing is recorded when it's not provided. Limiter is
+// optional, nothing is rate limited when it's not provided. Outbound settings
+// that are not provided use defaults, as do upgrader settings.
+type Config struct {
+	Log         *logger.Logger
+	Bus         Bus
+	Subject     string
+	CapID       uuid.UUID
+	Users       Users
+	Groups      Groups
+	Presence    Presence
+	Offline     Offline
+	Nonces      Nonces
+	Metrics     Metrics
+	Limiter     Limiter
+	Limits      Limits
+	Outbound    Outbound
+	Upgrader    Upgrader
+	MaxFileSize int64
 }
 
 // Chat represents a chat support.
 type Chat struct {
-	log      *logger.Logger
-	js       jetstream.JetStream
-	stream   jetstream.Stream
-	consumer jetstream.Consumer
-	capID    uuid.UUID
-	subject  string
-	users    Users
+	log         *logger.Logger
+	bus         Bus
+	capID       uuid.UUID
+	subject     string
+	users       Users
+	groups      Groups
+	presence    Presence
+	offline     Offline
+	nonces      Nonces
+	metrics     Metrics
+	limiter     Limiter
+	limits      Limits
+	outbound    Outbound
+	upgrade     Upgrader
+	upgrader    websocket.Upgrader
+	watchers    *watchers
+	maxFileSize int64
+	pingEvery   time.Duration
+	readTimeout time.Duration
+	lastTick    atomic.Int64
+	shutdown    atomic.Bool
+	done        chan struct{}
+	doneOnce    sync.Once
 }
 
 // New creates a new chat support.
-func New(log *logger.Logger, conn *nats.Conn, subject string, users Users, capID uuid.UUID) (*Chat, error) {
+func New(cfg Config) (*Chat, error) {
 	ctx := context.TODO()
 
-	js, err := jetstream.New(conn)
-	if err != nil {
-		return nil, fmt.Errorf("nats new js: %w", err)
+	if cfg.MaxFileSize <= 0 {
+		return nil, errors.New("max file size must be greater than zero")
 	}
 
-	// js.DeleteStream(ctx, subject)
+	if cfg.Metrics == nil {
+		cfg.Metrics = nopMetrics{}
+	}
 
-	s1, err := js.CreateStream(ctx, jetstream.StreamConfig{
-		Name:     subject,
-		Subjects: []string{subject},
-		MaxAge:   24 * time.Hour,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("nats create js: %w", err)
+	if cfg.Limiter == nil {
+		cfg.Limiter = nopLimiter{}
 	}
 
-	c1, err := s1.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Durable:       capID.String(),
-		AckPolicy:     jetstream.AckExplicitPolicy,
-		DeliverPolicy: jetstream.DeliverNewPolicy,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("nats create consumer: %w", err)
+	if cfg.Outbound.QueueSize <= 0 {
+		cfg.Outbound.QueueSize = defaultQueueSize
+	}
+
+	if cfg.Outbound.WriteTimeout <= 0 {
+		cfg.Outbound.WriteTimeout = defaultWriteTimeout
+	}
+
+	if cfg.Outbound.PingInterval <= 0 {
+		cfg.Outbound.PingInterval = defaultPingInterval
 	}
 
 	c := Chat{
-		log:      log,
-		js:       js,
-		stream:   s1,
-		consumer: c1,
-		capID:    capID,
-		subject:  subject,
-		users:    users,
+		log:         cfg.Log,
+		bus:         cfg.Bus,
+		capID:       cfg.CapID,
+		subject:     cfg.Subject,
+		users:       cfg.Users,
+		groups:      cfg.Groups,
+		presence:    cfg.Presence,
+		offline:     cfg.Offline,
+		nonces:      cfg.Nonces,
+		metrics:     cfg.Metrics,
+		limiter:     cfg.Limiter,
+		limits:      cfg.Limits,
+		outbound:    cfg.Outbound,
+		upgrade:     cfg.Upgrader,
+		watchers:    newWatchers(),
+		maxFileSize: cfg.MaxFileSize,
+		done:        make(chan struct{}),
 	}
 
-	c1.Consume(c.listenBus(), jetstream.PullMaxMessages(1))
+	c.upgrader = c.newUpgrader()
+
+	// Messages are published on the subject of the cap the recipient is
+	// connected to. The base subject is the fallback that reaches every cap.
+	// Status changes are announced to every cap on their own subject.
 
-	const maxWait = 10 * time.Second
-	c.ping(maxWait)
+	subjects := []string{c.subject, capSubject(c.subject, c.capID), presenceSubject(c.subject)}
+
+	if err := c.bus.Subscribe(ctx, c.capID.String(), subjects, c.listenBus()); err != nil {
+		return nil, fmt.Errorf("bus subscribe: %w", err)
+	}
+
+	c.updateConnected()
+
+	c.pingEvery = cfg.Outbound.PingInterval
+	c.readTimeout = 2 * c.pingEvery
+	c.lastTick.Store(time.Now().UnixNano())
+	c.ping(c.pingEvery)
 
 	return &c, nil
 }
 
 // Handshake performs the connection handshake protocol.
 func (c *Chat) Handshake(ctx context.Context, w http.ResponseWriter, r *http.Request) (User, error) {
-	var ws websocket.Upgrader
-	conn, err := ws.Upgrade(w, r, nil)
+	result := HandshakeIO
+	defer func() {
+		c.metrics.Handshake(result)
+	}()
+
+	// The load balancer may still send users while the cap is going away,
+	// they are better served by another cap.
+	if c.ShuttingDown() {
+		result = HandshakeShuttingDown
+		return User{}, ErrShuttingDown
+	}
+
+	if err := c.allowHandshake(ctx, r); err != nil {
+		result = HandshakeRateLimited
+		return User{}, err
+	}
+
+	if res, err := c.checkUpgrade(r); err != nil {
+		result = res
+		return User{}, err
+	}
+
+	ws, err := c.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		result = HandshakeUpgrade
 		return User{}, errs.Newf(errs.FailedPrecondition, "unable to upgrade to websocket")
 	}
 
-	if err := conn.WriteMessage(websocket.TextMessage, []byte("HELLO")); err != nil {
-		return User{}, fmt.Errorf("write message: %w", err)
+	conn := newConn(ws, c.outbound, c.upgrade.MaxMessageSize)
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return User{}, fmt.Errorf("generate challenge: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
-	defer cancel()
+	chlg := protocol.Challenge{
+		Challenge: hexutil.Encode(nonce),
+		Versions:  protocol.Versions,
+	}
+
+	if err := writeFrame(conn, outgoingMessage{Type: protocol.TypeChallenge, Payload: chlg}); err != nil {
+		conn.Close()
+		return User{}, fmt.Errorf("write challenge: %w", err)
+	}
 
 	usr := User{
 		Conn:     conn,
@@ -116,111 +289,279 @@ func (c *Chat) Handshake(ctx context.Context, w http.ResponseWriter, r *http.Req
 		LastPong: time.Now(),
 	}
 
-	msg, err := c.readMessage(ctx, usr)
+	// A client that doesn't answer the challenge in time is told why before
+	// the connection is closed.
+
+	stop := conn.watch(ctx)
+	defer stop()
+
+	msg, err := conn.read(ctx, handshakeTimeout)
 	if err != nil {
+		switch {
+		case isTimeout(err):
+			result = HandshakeTimeout
+			c.closeConn(conn, protocol.CloseHandshakeTimeout, "handshake timeout")
+
+		case errors.Is(err, ErrMessageTooBig):
+			result = HandshakeBadFrame
+			c.reject(ctx, conn, websocket.CloseMessageTooBig, c.tooBig())
+		}
+
+		conn.Close()
 		return User{}, fmt.Errorf("read message: %w", err)
 	}
 
-	if err := json.Unmarshal(msg, &usr); err != nil {
-		return User{}, fmt.Errorf("unmarshal message: %w", err)
+	// Clients that predate the envelope, or speak a version we don't know,
+	// are told why before the connection is closed.
+
+	env, err := protocol.Decode(msg)
+	if err != nil {
+		result = HandshakeUnsupportedVersion
+		c.reject(ctx, conn, protocol.CloseUnsupportedVersion, errs.Newf(errs.FailedPrecondition, "%s, supported versions %v", protocol.ErrUnsupportedVersion, protocol.Versions))
+		return User{}, fmt.Errorf("decode hello: %w", err)
+	}
+
+	var hello protocol.Hello
+	if env.Type != protocol.TypeHello || env.Unmarshal(&hello) != nil {
+		e := errs.Newf(errs.InvalidArgument, "expected a %s frame", protocol.TypeHello)
+		result = HandshakeBadFrame
+		c.reject(ctx, conn, websocket.CloseProtocolError, e)
+		return User{}, e
 	}
 
 	// -------------------------------------------------------------------------
+	// The client proves it owns the address by signing the challenge.
+
+	if err := verifyChallenge(chlg, hello); err != nil {
+		result = HandshakeUnauthenticated
+		c.reject(ctx, conn, protocol.CloseUnauthenticated, errs.Newf(errs.Unauthenticated, "invalid challenge signature"))
+		return User{}, errs.Newf(errs.Unauthenticated, "verify challenge: %s", err)
+	}
+
+	if !validDevice(hello.Device) {
+		e := errs.Newf(errs.InvalidArgument, "invalid device %q", hello.Device)
+		result = HandshakeBadFrame
+		c.reject(ctx, conn, websocket.CloseProtocolError, e)
+		return User{}, e
+	}
+
+	usr.ID = hello.ID
+	usr.Name = hello.Name
+	usr.Device = hello.Device
+
+	// -------------------------------------------------------------------------
+	// Once the user is added, messages can be sent to it. They are held until
+	// the welcome and the messages stored while the user was offline are
+	// written, so they arrive in the order they were sent.
+
+	conn.hold()
 
 	if err := c.users.Add(ctx, usr); err != nil {
-		defer conn.Close()
-		if err := conn.WriteMessage(websocket.TextMessage, []byte("Already Connected")); err != nil {
-			return User{}, fmt.Errorf("write message: %w", err)
-		}
+		conn.release()
+
+		result = HandshakeAlreadyConnected
+		c.reject(ctx, conn, protocol.CloseAlreadyConnected, errs.Newf(errs.AlreadyExists, "device already connected"))
 		return User{}, fmt.Errorf("add user: %w", err)
 	}
 
-	usr.Conn.SetPongHandler(c.pong(usr.ID))
+	usr.Conn.ws.SetPongHandler(c.pong(usr))
+
+	c.updateConnected()
 
 	// -------------------------------------------------------------------------
 
-	v := fmt.Sprintf("WELCOME %s", usr.Name)
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
-		return User{}, fmt.Errorf("write message: %w", err)
+	welcome := outgoingMessage{
+		Type: protocol.TypeWelcome,
+		Payload: protocol.Welcome{
+			Name:   usr.Name,
+			Limits: c.frameLimits(),
+		},
+	}
+
+	if err := c.writeFirst(ctx, usr, welcome); err != nil {
+		c.removeUser(ctx, usr.Session())
+		conn.Close()
+		return User{}, fmt.Errorf("write welcome: %w", err)
+	}
+
+	// -------------------------------------------------------------------------
+
+	if err := c.presence.Set(ctx, usr.ID, usr.Device, c.capID); err != nil {
+		c.log.Info(ctx, "chat-handshake", "status", "presence set", "ERROR", err)
+	}
+
+	c.announce(ctx, usr.ID)
+
+	if err := c.offline.Drain(ctx, usr.ID, c.deliverOffline(ctx, usr)); err != nil {
+		c.log.Info(ctx, "chat-handshake", "status", "offline drain", "ERROR", err)
+	}
+
+	if err := conn.release(); err != nil {
+		c.removeUser(ctx, usr.Session())
+		conn.Close()
+		return User{}, fmt.Errorf("release held messages: %w", err)
 	}
 
 	c.log.Info(ctx, "chat-handshake", "status", "complete", "usr", usr)
 
+	result = HandshakeOK
+
 	return usr, nil
 }
 
-// ListenClient waits for messages from users.
+// ListenClient waits for messages from users. It is the only reader of the
+// user's connection and returns once the connection can't be read anymore, the
+// user is then removed. A client must send a frame or answer a ping within the
+// read timeout.
 func (c *Chat) ListenClient(ctx context.Context, from User) {
+	strikes := c.newStrikes()
+
+	stop := from.Conn.watch(ctx)
+	defer stop()
+
 	for {
-		msg, err := c.readMessage(ctx, from)
+		msg, err := from.Conn.read(ctx, c.readTimeout)
 		if err != nil {
-			if c.isCriticalError(ctx, err) {
-				return
+			if errors.Is(err, ErrMessageTooBig) {
+				c.reject(ctx, from.Conn, websocket.CloseMessageTooBig, c.tooBig())
 			}
-			continue
+
+			c.logReadError(ctx, from, err)
+			c.removeUser(ctx, from.Session())
+			from.Conn.Close()
+			return
 		}
 
-		var inMsg incomingMessage
-		if err := json.Unmarshal(msg, &inMsg); err != nil {
-			c.log.Info(ctx, "loc-unmarshal", "ERROR", err)
+		if err := c.allowFrame(ctx, from, len(msg)); err != nil {
+			c.log.Info(ctx, "loc-ratelimit", "id", from.ID, "ERROR", err)
+			c.sendError(ctx, from, errs.New(errs.TooManyRequests, err))
+
+			if !strikes.Allow() {
+				c.closeConn(from.Conn, protocol.CloseRateLimited, "too many requests")
+			}
 			continue
 		}
 
-		c.log.Info(ctx, "CLIENT: msg recv", "fromNonce", inMsg.FromNonce, "from", from.ID, "to", inMsg.ToID, "message", inMsg.Msg)
-
-		dataThatWasSign := struct {
-			ToID      common.Address
-			Msg       string
-			FromNonce uint64
-		}{
-			ToID:      inMsg.ToID,
-			Msg:       inMsg.Msg,
-			FromNonce: inMsg.FromNonce,
+		inMsg, err := decodeIncoming(msg)
+		if err != nil {
+			c.log.Info(ctx, "loc-decode", "ERROR", err)
+			c.sendError(ctx, from, errs.New(errs.InvalidArgument, err))
+			continue
 		}
 
-		id, err := signature.FromAddress(dataThatWasSign, inMsg.V, inMsg.R, inMsg.S)
+		c.log.Info(ctx, "CLIENT: msg recv", "type", inMsg.Type, "fromNonce", inMsg.FromNonce, "from", from.ID, "to", inMsg.ToID, "encrypted", inMsg.Encrypted, "message", inMsg.Msg)
+
+		id, err := signature.FromAddress(signedData(inMsg), inMsg.V, inMsg.R, inMsg.S)
 		if err != nil {
 			c.log.Info(ctx, "loc-fromAddress", "ERROR", err)
+			c.metrics.SignatureFailure(SourceClient)
+			c.sendError(ctx, from, errs.Newf(errs.Unauthenticated, "invalid signature"))
 			continue
 		}
 
 		if id != from.ID.Hex() {
 			c.log.Info(ctx, "loc-signature check", "status", "signature does not match")
+			c.metrics.SignatureFailure(SourceClient)
+			c.sendError(ctx, from, errs.Newf(errs.Unauthenticated, "signature does not match"))
 			continue
 		}
 
-		to, err := c.users.Retrieve(ctx, inMsg.ToID)
-		if err != nil {
-			switch {
-			case errors.Is(err, ErrNotExists):
-				c.log.Info(ctx, "loc-retrieve", "status", "user not found, sending over bus")
-				if err := c.sendMessageBus(ctx, from, inMsg); err != nil {
-					c.log.Info(ctx, "loc-bussend", "ERROR", err)
+		if err := c.checkFile(inMsg); err != nil {
+			c.log.Info(ctx, "loc-file", "ERROR", err)
+			c.sendFrameError(ctx, from, inMsg, errs.New(errs.FailedPrecondition, err))
+			continue
+		}
+
+		if err := c.checkNonce(ctx, from, inMsg); err != nil {
+			c.log.Info(ctx, "loc-nonce", "ERROR", err)
+
+			code := errs.Unavailable
+			if errors.Is(err, ErrInvalidNonce) {
+				code = errs.Aborted
+			}
+
+			c.sendFrameError(ctx, from, inMsg, errs.New(code, err))
+			continue
+		}
+
+		if inMsg.Type == protocol.TypePresence {
+			if err := c.presenceRequest(ctx, from, *inMsg.Presence); err != nil {
+				c.log.Info(ctx, "loc-presence", "ERROR", err)
+				c.sendError(ctx, from, errs.Newf(errs.InvalidArgument, "presence: %s", err))
+			}
+			continue
+		}
+
+		if inMsg.Type == protocol.TypeDevice {
+			if err := c.deviceRequest(ctx, from, inMsg); err != nil {
+				c.log.Info(ctx, "loc-device", "ERROR", err)
+
+				code := errs.InvalidArgument
+				if errors.Is(err, ErrNotExists) {
+					code = errs.NotFound
 				}
 
-			default:
-				c.log.Info(ctx, "loc-retrieve", "ERROR", err)
+				c.sendError(ctx, from, errs.Newf(code, "device: %s", err))
+			}
+			continue
+		}
+
+		if inMsg.isGroupCommand() {
+			if err := c.groupCommand(ctx, from, inMsg); err != nil {
+				c.log.Info(ctx, "loc-group", "ERROR", err)
+				c.sendError(ctx, from, errs.Newf(errs.FailedPrecondition, "%s: %s", inMsg.Command.Action, err))
+			}
+			continue
+		}
+
+		grp, err := c.groups.Retrieve(ctx, inMsg.ToID)
+		switch {
+		case err == nil:
+			if err := c.sendGroupMessage(ctx, from, grp, inMsg); err != nil {
+				c.log.Info(ctx, "loc-groupsend", "ERROR", err)
+				c.sendError(ctx, from, errs.Newf(errs.FailedPrecondition, "group %s: %s", grp.Name, err))
 			}
+			continue
 
+		case !errors.Is(err, ErrGroupNotExists):
+			c.log.Info(ctx, "loc-groupretrieve", "ERROR", err)
 			continue
 		}
 
-		if err := c.sendMessage(from, to, inMsg.FromNonce, inMsg.Msg); err != nil {
-			c.log.Info(ctx, "loc-send", "ERROR", err)
+		// The recipient's devices connected to this cap are written to
+		// first, the devices connected to other caps are handled by
+		// sendRemote.
+
+		recipients := []common.Address{inMsg.ToID}
+
+		local := c.sendLocal(ctx, common.Address{}, recipients, newOutgoingMessage(from, inMsg, nil))
+		if len(local) > 0 {
+			c.metrics.Routed(RouteLocal)
+			c.log.Info(ctx, "LOC: msg sent over web socket", "from", from.ID, "to", inMsg.ToID)
+		}
+
+		status := c.sendRemote(ctx, from, inMsg, recipients, local)
+		if inMsg.needsStatus() {
+			c.sendStatus(ctx, from, inMsg, status)
 		}
 
-		c.log.Info(ctx, "LOC: msg sent over web socket", "from", from.ID, "to", inMsg.ToID)
+		c.mirror(ctx, from, inMsg, nil)
 	}
 }
 
 // =============================================================================
 
-func (c *Chat) listenBus() func(msg jetstream.Msg) {
+func (c *Chat) listenBus() func(msg BusMessage) {
 	ctx := web.SetTraceID(context.Background(), uuid.New())
 
-	f := func(msg jetstream.Msg) {
+	f := func(msg BusMessage) {
 		defer msg.Ack()
 
+		if msg.Subject() == presenceSubject(c.subject) {
+			c.presenceNotifyBus(ctx, msg.Data())
+			return
+		}
+
 		var busMsg busMessage
 		if err := json.Unmarshal(msg.Data(), &busMsg); err != nil {
 			c.log.Info(ctx, "bus-unmarshal", "ERROR", err)
@@ -231,33 +572,82 @@ func (c *Chat) listenBus() func(msg jetstream.Msg) {
 			return
 		}
 
-		c.log.Info(ctx, "BUS: msg recv", "fromNonce", busMsg.FromNonce, "from", busMsg.FromID, "to", busMsg.ToID, "message", busMsg.Msg, "fromName", busMsg.FromName)
-
-		dataThatWasSign := struct {
-			ToID      common.Address
-			Msg       string
-			FromNonce uint64
-		}{
-			ToID:      busMsg.ToID,
-			Msg:       busMsg.Msg,
-			FromNonce: busMsg.FromNonce,
-		}
+		c.log.Info(ctx, "BUS: msg recv", "type", busMsg.Type, "fromNonce", busMsg.FromNonce, "from", busMsg.FromID, "to", busMsg.ToID, "encrypted", busMsg.Encrypted, "message", busMsg.Msg, "fromName", busMsg.FromName)
 
-		id, err := signature.FromAddress(dataThatWasSign, busMsg.V, busMsg.R, busMsg.S)
+		id, err := signature.FromAddress(signedData(busMsg.incomingMessage), busMsg.V, busMsg.R, busMsg.S)
 		if err != nil {
 			c.log.Info(ctx, "bus-fromAddress", "ERROR", err)
+			c.metrics.SignatureFailure(SourceBus)
 			return
 		}
 
 		if id != busMsg.FromID.Hex() {
 			c.log.Info(ctx, "bus-signature check", "status", "signature does not match")
+			c.metrics.SignatureFailure(SourceBus)
 			return
 		}
 
-		to, err := c.users.Retrieve(ctx, busMsg.ToID)
+		from := User{
+			ID:     busMsg.FromID,
+			Name:   busMsg.FromName,
+			Device: busMsg.FromDevice,
+		}
+
+		if busMsg.Mirror {
+			var grp *protocol.Group
+			if g, err := c.groups.Retrieve(ctx, busMsg.ToID); err == nil {
+				grp = newOutgoingGroup(g)
+			}
+
+			c.mirrorLocal(ctx, from, busMsg.incomingMessage, grp)
+			return
+		}
+
+		if busMsg.Type == protocol.TypeDevice {
+			if err := c.revokeLocal(ctx, Session{ID: from.ID, Device: busMsg.Device.Device}); err != nil {
+				c.log.Info(ctx, "bus-revoke", "ERROR", err)
+			}
+			return
+		}
+
+		if busMsg.isGroupCommand() {
+			c.groupNotifyBus(ctx, from, *busMsg.Command)
+			return
+		}
+
+		grp, err := c.groups.Retrieve(ctx, busMsg.ToID)
+		switch {
+		case err == nil:
+			if !grp.IsMember(from.ID) {
+				c.log.Info(ctx, "bus-groupsend", "ERROR", ErrNotMember)
+				return
+			}
+
+			m := newOutgoingMessage(from, busMsg.incomingMessage, newOutgoingGroup(grp))
+
+			c.sendLocal(ctx, from.ID, grp.Members, m)
+
+			c.log.Info(ctx, "BUS: group msg sent over web socket", "from", busMsg.FromID, "group", busMsg.ToID)
+			return
+
+		case !errors.Is(err, ErrGroupNotExists):
+			c.log.Info(ctx, "bus-groupretrieve", "ERROR", err)
+			return
+		}
+
+		devices, err := c.users.Retrieve(ctx, busMsg.ToID)
 		if err != nil {
 			switch {
 			case errors.Is(err, ErrNotExists):
+				// A message routed to this cap was meant for a user that just
+				// disconnected, keep it until the user connects again.
+				if msg.Subject() != c.subject {
+					if err := c.storeOffline(ctx, from, busMsg.ToID, busMsg.incomingMessage); err != nil {
+						c.log.Info(ctx, "bus-offlinestore", "ERROR", err)
+					}
+					return
+				}
+
 				c.log.Info(ctx, "bus-retrieve", "status", "user not found")
 
 			default:
@@ -267,14 +657,7 @@ func (c *Chat) listenBus() func(msg jetstream.Msg) {
 			return
 		}
 
-		from := User{
-			ID:   busMsg.FromID,
-			Name: busMsg.FromName,
-		}
-
-		if err := c.sendMessage(from, to, busMsg.incomingMessage.FromNonce, busMsg.Msg); err != nil {
-			c.log.Info(ctx, "bus-send", "ERROR", err)
-		}
+		c.writeDevices(ctx, devices, newOutgoingMessage(from, busMsg.incomingMessage, nil))
 
 		c.log.Info(ctx, "BUS: msg sent over web socket", "from", busMsg.FromID, "to", busMsg.ToID)
 	}
@@ -282,123 +665,504 @@ func (c *Chat) listenBus() func(msg jetstream.Msg) {
 	return f
 }
 
-func (c *Chat) isCriticalError(ctx context.Context, err error) bool {
-	switch e := err.(type) {
-	case *websocket.CloseError:
-		c.log.Info(ctx, "chat-isCriticalError", "status", "client disconnected")
-		return true
+// reject tells the client why the connection is refused using an error frame
+// and then closes the connection with the specified code.
+func (c *Chat) reject(ctx context.Context, conn *Conn, code int, e *errs.Error) {
+	if err := writeFrame(conn, newErrorMessage(e)); err != nil {
+		c.log.Info(ctx, "chat-reject", "ERROR", err)
+	}
 
-	case *net.OpError:
-		if !e.Temporary() {
-			c.log.Info(ctx, "chat-isCriticalError", "status", "client disconnected")
-			return true
-		}
-		return false
+	c.closeConn(conn, code, e.Message)
+}
 
-	default:
-		if errors.Is(err, context.Canceled) {
-			c.log.Info(ctx, "chat-isCriticalError", "status", "client canceled")
-			return true
-		}
+// closeConn sends a close frame with the specified code and reason before
+// closing the connection. Frames already queued for the client are written
+// first.
+func (c *Chat) closeConn(conn *Conn, code int, reason string) {
+	// The reason must fit in a control frame.
+	const maxReason = 123
+	if len(reason) > maxReason {
+		reason = reason[:maxReason]
+	}
 
-		if errors.Is(err, nats.ErrConnectionClosed) {
-			c.log.Info(ctx, "chat-isCriticalError", "status", "nats connection closed")
-			return true
-		}
+	conn.closeWith(code, reason)
+}
+
+// tooBig returns the error sent to a client that sent a frame larger than
+// the maximum message size.
+func (c *Chat) tooBig() *errs.Error {
+	return errs.Newf(errs.InvalidArgument, "frame larger than %d bytes", c.upgrade.MaxMessageSize)
+}
+
+// logReadError logs why the user's connection can't be read anymore. Once a
+// read failed every later read returns the same error. The pongs push the
+// read deadline back, so a read timeout is a client that stopped answering
+// pings.
+func (c *Chat) logReadError(ctx context.Context, from User, err error) {
+	var ce *websocket.CloseError
+
+	switch {
+	case errors.As(err, &ce):
+		c.log.Info(ctx, "chat-read", "id", from.ID, "device", from.Device, "status", "client disconnected", "code", ce.Code)
+
+	case errors.Is(err, context.Canceled):
+		c.log.Info(ctx, "chat-read", "id", from.ID, "device", from.Device, "status", "client canceled")
+
+	case isTimeout(err):
+		c.log.Info(ctx, "chat-read", "id", from.ID, "device", from.Device, "status", "read timeout")
+		c.metrics.PingTimeout()
+
+	case errors.Is(err, ErrMessageTooBig):
+		c.log.Info(ctx, "chat-read", "id", from.ID, "device", from.Device, "status", "message too big")
 
-		c.log.Info(ctx, "chat-isCriticalError", "ERROR", err, "TYPE", fmt.Sprintf("%T", err))
-		return false
+	case errors.Is(err, net.ErrClosed):
+		c.log.Info(ctx, "chat-read", "id", from.ID, "device", from.Device, "status", "connection closed")
+
+	default:
+		c.log.Info(ctx, "chat-read", "id", from.ID, "device", from.Device, "ERROR", err, "TYPE", fmt.Sprintf("%T", err))
 	}
 }
 
-func (c *Chat) readMessage(ctx context.Context, usr User) ([]byte, error) {
-	type response struct {
-		msg []byte
-		err error
+// writeMessage queues the message for the client. A client that is too slow
+// reading its messages is disconnected.
+func (c *Chat) writeMessage(ctx context.Context, to User, m outgoingMessage) error {
+	return c.checkSlow(ctx, to, writeFrame(to.Conn, m))
+}
+
+// writeFirst writes the message ahead of the messages held while the user's
+// handshake completes.
+func (c *Chat) writeFirst(ctx context.Context, to User, m outgoingMessage) error {
+	data, err := protocol.Encode(m.Type, m.Payload)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", m.Type, err)
 	}
 
-	ch := make(chan response, 1)
+	if err := to.Conn.sendFirst(data); err != nil {
+		return c.checkSlow(ctx, to, fmt.Errorf("write message: %w", err))
+	}
 
-	go func() {
-		_, msg, err := usr.Conn.ReadMessage()
-		if err != nil {
-			ch <- response{nil, err}
-		}
-		ch <- response{msg, nil}
-	}()
+	return nil
+}
 
-	var resp response
+// checkSlow counts the clients disconnected for not reading their messages
+// fast enough and returns the write error.
+func (c *Chat) checkSlow(ctx context.Context, to User, err error) error {
+	if errors.Is(err, ErrSlowConsumer) {
+		c.log.Info(ctx, "chat-slowconsumer", "id", to.ID, "device", to.Device)
+		c.metrics.SlowConsumer()
+	}
+
+	return err
+}
 
-	select {
-	case <-ctx.Done():
-		c.users.Remove(ctx, usr.ID)
-		usr.Conn.Close()
-		return nil, ctx.Err()
+// writeDevices writes the message to each of the devices and returns how
+// many of them it was written to.
+func (c *Chat) writeDevices(ctx context.Context, devices []User, m outgoingMessage) int {
+	var n int
 
-	case resp = <-ch:
-		if resp.err != nil {
-			c.users.Remove(ctx, usr.ID)
-			usr.Conn.Close()
-			return nil, resp.err
+	for _, to := range devices {
+		if err := c.writeMessage(ctx, to, m); err != nil {
+			c.log.Info(ctx, "chat-writedevices", "id", to.ID, "device", to.Device, "ERROR", err)
+			continue
 		}
+		n++
 	}
 
-	return resp.msg, nil
+	return n
+}
+
+// sendError tells the client a frame it sent could not be processed.
+func (c *Chat) sendError(ctx context.Context, to User, e *errs.Error) {
+	if err := c.writeMessage(ctx, to, newErrorMessage(e)); err != nil {
+		c.log.Info(ctx, "chat-senderror", "id", to.ID, "ERROR", err)
+	}
 }
 
-func (c *Chat) sendMessage(from User, to User, fromNonce uint64, msg string) error {
+// sendFrameError tells the client the specified frame was rejected, so the
+// client knows which of its messages failed.
+func (c *Chat) sendFrameError(ctx context.Context, to User, inMsg incomingMessage, e *errs.Error) {
 	m := outgoingMessage{
-		From: outgoingUser{
-			ID:    from.ID,
-			Name:  from.Name,
-			Nonce: fromNonce,
+		Type: protocol.TypeError,
+		Payload: protocol.ErrorMessage{
+			Code:    e.Code,
+			Message: e.Message,
+			ToID:    inMsg.ToID,
+			Nonce:   inMsg.FromNonce,
 		},
-		Msg: msg,
 	}
 
-	if err := to.Conn.WriteJSON(m); err != nil {
-		return fmt.Errorf("write message: %w", err)
+	if err := c.writeMessage(ctx, to, m); err != nil {
+		c.log.Info(ctx, "chat-senderror", "id", to.ID, "ERROR", err)
+	}
+}
+
+// checkNonce makes sure a frame meant for other users is not a replay of a
+// frame the cap already accepted. Receipts, presence and device requests and
+// group commands don't carry a nonce, applying them twice changes nothing.
+// Every device of the user has its own nonces.
+func (c *Chat) checkNonce(ctx context.Context, from User, inMsg incomingMessage) error {
+	switch {
+	case inMsg.Type == protocol.TypeReceipt, inMsg.Type == protocol.TypePresence, inMsg.Type == protocol.TypeDevice:
+		return nil
+
+	case inMsg.isGroupCommand():
+		return nil
+	}
+
+	return c.nonces.Advance(ctx, from.Session(), inMsg.ToID, inMsg.FromNonce)
+}
+
+// checkFile makes sure a file chunk is well formed and the file is not larger
+// than the cap accepts. Chunks are relayed as they arrive, the receiver
+// verifies the file once it has every chunk.
+func (c *Chat) checkFile(inMsg incomingMessage) error {
+	if inMsg.Type != protocol.TypeFile {
+		return nil
+	}
+
+	fc := inMsg.File
+
+	switch {
+	case fc.Size > c.maxFileSize:
+		return fmt.Errorf("file %s is larger than %d bytes", fc.Name, c.maxFileSize)
+
+	case len(fc.Data) > protocol.MaxChunkSize:
+		return fmt.Errorf("chunk is larger than %d bytes", protocol.MaxChunkSize)
+
+	case fc.Index < 0 || fc.Index >= fc.Total:
+		return fmt.Errorf("chunk %d of %d is out of range", fc.Index, fc.Total)
 	}
 
 	return nil
 }
 
+// sendMessageBus broadcasts the message to every cap.
 func (c *Chat) sendMessageBus(ctx context.Context, from User, inMsg incomingMessage) error {
+	return c.publish(ctx, c.subject, from, inMsg)
+}
+
+// sendMessageCap sends the message to the specified cap only.
+func (c *Chat) sendMessageCap(ctx context.Context, capID uuid.UUID, from User, inMsg incomingMessage) error {
+	return c.publish(ctx, capSubject(c.subject, capID), from, inMsg)
+}
+
+func (c *Chat) publish(ctx context.Context, subject string, from User, inMsg incomingMessage) error {
+	d, err := c.marshalBusMessage(from, inMsg)
+	if err != nil {
+		return fmt.Errorf("send marshal message: %w", err)
+	}
+
+	if err := c.busPublish(ctx, subject, d); err != nil {
+		return fmt.Errorf("send publish: %w", err)
+	}
+
+	c.metrics.Routed(RouteBus)
+
+	return nil
+}
+
+func (c *Chat) marshalBusMessage(from User, inMsg incomingMessage) ([]byte, error) {
 	busMsg := busMessage{
 		CapID:           c.capID,
 		FromID:          from.ID,
 		FromName:        from.Name,
+		FromDevice:      from.Device,
 		incomingMessage: inMsg,
 	}
 
-	d, err := json.Marshal(busMsg)
+	return json.Marshal(busMsg)
+}
+
+// removeUser removes the user's device from the local storage and the
+// presence registry shared with the other caps, and tells the user's
+// subscribers. The user's subscriptions end with the user's last device
+// connected to this cap.
+func (c *Chat) removeUser(ctx context.Context, s Session) {
+	c.users.Remove(ctx, s)
+
+	if _, err := c.users.Retrieve(ctx, s.ID); errors.Is(err, ErrNotExists) {
+		c.watchers.remove(s.ID)
+	}
+
+	c.updateConnected()
+
+	if err := c.presence.Delete(ctx, s.ID, s.Device, c.capID); err != nil {
+		c.log.Info(ctx, "chat-removeuser", "id", s.ID, "device", s.Device, "ERROR", err)
+	}
+
+	c.announce(ctx, s.ID)
+}
+
+// capSubject returns the subject a cap receives the messages routed to it on.
+func capSubject(subject string, capID uuid.UUID) string {
+	return fmt.Sprintf("%s.%s", subject, capID)
+}
+
+func newOutgoingMessage(from User, inMsg incomingMessage, grp *protocol.Group) outgoingMessage {
+	fromUsr := protocol.From{
+		ID:     from.ID,
+		Name:   from.Name,
+		Device: from.Device,
+		Nonce:  inMsg.FromNonce,
+	}
+
+	switch inMsg.Type {
+	case protocol.TypeCommand:
+		return outgoingMessage{
+			Type: protocol.TypeCommand,
+			Payload: protocol.CommandMessage{
+				From:    fromUsr,
+				Command: *inMsg.Command,
+			},
+		}
+
+	case protocol.TypeReceipt:
+		return outgoingMessage{
+			Type: protocol.TypeReceipt,
+			Payload: protocol.ReceiptMessage{
+				From:    fromUsr,
+				Receipt: *inMsg.Receipt,
+			},
+		}
+
+	case protocol.TypeFile:
+		return outgoingMessage{
+			Type: protocol.TypeFile,
+			Payload: protocol.FileMessage{
+				From:  fromUsr,
+				Chunk: *inMsg.File,
+			},
+		}
+	}
+
+	return outgoingMessage{
+		Type: protocol.TypeChat,
+		Payload: protocol.ChatMessage{
+			From:      fromUsr,
+			Msg:       inMsg.Msg,
+			Encrypted: inMsg.Encrypted,
+			Group:     grp,
+		},
+	}
+}
+
+func newErrorMessage(e *errs.Error) outgoingMessage {
+	return outgoingMessage{
+		Type: protocol.TypeError,
+		Payload: protocol.ErrorMessage{
+			Code:    e.Code,
+			Message: e.Message,
+		},
+	}
+}
+
+func writeFrame(conn *Conn, m outgoingMessage) error {
+	data, err := protocol.Encode(m.Type, m.Payload)
 	if err != nil {
-		return fmt.Errorf("send marshal message: %w", err)
+		return fmt.Errorf("encode %s: %w", m.Type, err)
 	}
 
-	_, err = c.js.Publish(ctx, c.subject, d)
+	if err := conn.send(data); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+
+	return nil
+}
+
+// decodeIncoming converts a frame sent by a client into an incoming message.
+func decodeIncoming(data []byte) (incomingMessage, error) {
+	env, err := protocol.Decode(data)
 	if err != nil {
-		return fmt.Errorf("send publish: %w", err)
+		return incomingMessage{}, err
+	}
+
+	switch env.Type {
+	case protocol.TypeChat:
+		var req protocol.ChatRequest
+		if err := env.Unmarshal(&req); err != nil {
+			return incomingMessage{}, err
+		}
+
+		inMsg := incomingMessage{
+			Type:      env.Type,
+			ToID:      req.ToID,
+			Msg:       req.Msg,
+			Encrypted: req.Encrypted,
+			FromNonce: req.FromNonce,
+			Signature: req.Signature,
+		}
+
+		return inMsg, nil
+
+	case protocol.TypeCommand:
+		var req protocol.CommandRequest
+		if err := env.Unmarshal(&req); err != nil {
+			return incomingMessage{}, err
+		}
+
+		inMsg := incomingMessage{
+			Type:      env.Type,
+			ToID:      req.ToID,
+			Command:   &req.Command,
+			FromNonce: req.FromNonce,
+			Signature: req.Signature,
+		}
+
+		return inMsg, nil
+
+	case protocol.TypeReceipt:
+		var req protocol.ReceiptRequest
+		if err := env.Unmarshal(&req); err != nil {
+			return incomingMessage{}, err
+		}
+
+		inMsg := incomingMessage{
+			Type:      env.Type,
+			ToID:      req.ToID,
+			Receipt:   &req.Receipt,
+			FromNonce: req.FromNonce,
+			Signature: req.Signature,
+		}
+
+		return inMsg, nil
+
+	case protocol.TypeFile:
+		var req protocol.FileRequest
+		if err := env.Unmarshal(&req); err != nil {
+			return incomingMessage{}, err
+		}
+
+		inMsg := incomingMessage{
+			Type:      env.Type,
+			ToID:      req.ToID,
+			File:      &req.Chunk,
+			FromNonce: req.FromNonce,
+			Signature: req.Signature,
+		}
+
+		return inMsg, nil
+
+	case protocol.TypePresence:
+		var req protocol.PresenceRequest
+		if err := env.Unmarshal(&req); err != nil {
+			return incomingMessage{}, err
+		}
+
+		inMsg := incomingMessage{
+			Type:      env.Type,
+			Presence:  &req,
+			Signature: req.Signature,
+		}
+
+		return inMsg, nil
+
+	case protocol.TypeDevice:
+		var req protocol.DeviceRequest
+		if err := env.Unmarshal(&req); err != nil {
+			return incomingMessage{}, err
+		}
+
+		inMsg := incomingMessage{
+			Type:      env.Type,
+			Device:    &req,
+			Signature: req.Signature,
+		}
+
+		return inMsg, nil
+	}
+
+	return incomingMessage{}, fmt.Errorf("unexpected %s frame", env.Type)
+}
+
+// verifyChallenge checks the challenge was signed by the address the client
+// claims to own.
+func verifyChallenge(chlg protocol.Challenge, hello protocol.Hello) error {
+	if hello.V == nil || hello.R == nil || hello.S == nil {
+		return errors.New("missing signature")
+	}
+
+	id, err := signature.FromAddress(hello.SignedData(chlg.Challenge), hello.V, hello.R, hello.S)
+	if err != nil {
+		return fmt.Errorf("from address: %w", err)
+	}
+
+	if id != hello.ID.Hex() {
+		return errors.New("signature does not match")
 	}
 
 	return nil
 }
 
-func (c *Chat) pong(id common.Address) func(appData string) error {
+// signedData returns the data the client signed for the specified message.
+func signedData(inMsg incomingMessage) any {
+	switch inMsg.Type {
+	case protocol.TypeCommand:
+		req := protocol.CommandRequest{
+			ToID:      inMsg.ToID,
+			Command:   *inMsg.Command,
+			FromNonce: inMsg.FromNonce,
+		}
+
+		return req.SignedData()
+
+	case protocol.TypeReceipt:
+		req := protocol.ReceiptRequest{
+			ToID:      inMsg.ToID,
+			Receipt:   *inMsg.Receipt,
+			FromNonce: inMsg.FromNonce,
+		}
+
+		return req.SignedData()
+
+	case protocol.TypeFile:
+		req := protocol.FileRequest{
+			ToID:      inMsg.ToID,
+			Chunk:     *inMsg.File,
+			FromNonce: inMsg.FromNonce,
+		}
+
+		return req.SignedData()
+
+	case protocol.TypePresence:
+		return inMsg.Presence.SignedData()
+
+	case protocol.TypeDevice:
+		return inMsg.Device.SignedData()
+	}
+
+	req := protocol.ChatRequest{
+		ToID:      inMsg.ToID,
+		Msg:       inMsg.Msg,
+		Encrypted: inMsg.Encrypted,
+		FromNonce: inMsg.FromNonce,
+	}
+
+	return req.SignedData()
+}
+
+// pong records the user's answer to a ping. A client that answers pings is
+// given more time to send its next frame.
+func (c *Chat) pong(usr User) func(appData string) error {
+	s := usr.Session()
+
 	f := func(appData string) error {
 		ctx := web.SetTraceID(context.Background(), uuid.New())
 
-		c.log.Debug(ctx, "*** PONG ***", "id", id, "status", "started")
-		defer c.log.Debug(ctx, "*** PONG ***", "id", id, "status", "completed")
+		if err := usr.Conn.extendRead(c.readTimeout); err != nil {
+			c.log.Info(ctx, "*** PONG ***", "id", s.ID, "device", s.Device, "ERROR", err)
+		}
+
+		c.log.Debug(ctx, "*** PONG ***", "id", s.ID, "device", s.Device, "status", "started")
+		defer c.log.Debug(ctx, "*** PONG ***", "id", s.ID, "device", s.Device, "status", "completed")
 
-		usr, err := c.users.UpdateLastPong(ctx, id)
+		usr, err := c.users.UpdateLastPong(ctx, s)
 		if err != nil {
-			c.log.Info(ctx, "*** PONG ***", "id", id, "ERROR", err)
+			c.log.Info(ctx, "*** PONG ***", "id", s.ID, "device", s.Device, "ERROR", err)
 			return nil
 		}
 
 		sub := usr.LastPong.Sub(usr.LastPing)
-		c.log.Debug(ctx, "*** PONG ***", "id", id, "status", "received", "sub", sub.String(), "ping", usr.LastPing.String(), "pong", usr.LastPong.String())
+		c.log.Debug(ctx, "*** PONG ***", "id", s.ID, "device", s.Device, "status", "received", "sub", sub.String(), "ping", usr.LastPing.String(), "pong", usr.LastPong.String())
 
 		return nil
 	}
@@ -410,32 +1174,41 @@ func (c *Chat) ping(maxWait time.Duration) {
 	ticker := time.NewTicker(maxWait)
 
 	go func() {
+		defer ticker.Stop()
+
 		ctx := web.SetTraceID(context.Background(), uuid.New())
 
 		for {
-			<-ticker.C
+			select {
+			case <-ticker.C:
+			case <-c.done:
+				c.log.Info(ctx, "*** PING ***", "status", "stopped")
+				return
+			}
 
 			c.log.Debug(ctx, "*** PING ***", "status", "started")
 
-			for id, conn := range c.users.Connections() {
-				sub := conn.LastPong.Sub(conn.LastPing)
-				if sub > maxWait {
-					c.log.Info(ctx, "*** PING ***", "ping", conn.LastPing.String(), "pong", conn.LastPong.Second(), "maxWait", maxWait, "sub", sub.String())
-					c.users.Remove(ctx, id)
-					continue
+			// A client that stopped answering is disconnected by its read
+			// deadline, the pongs push it back.
+
+			for s, conn := range c.users.Connections() {
+				if err := c.presence.Set(ctx, s.ID, s.Device, c.capID); err != nil {
+					c.log.Info(ctx, "*** PING ***", "status", "presence refresh", "id", s.ID, "device", s.Device, "ERROR", err)
 				}
 
-				c.log.Debug(ctx, "*** PING ***", "status", "sending", "id", id)
+				c.log.Debug(ctx, "*** PING ***", "status", "sending", "id", s.ID, "device", s.Device)
 
-				if err := conn.Conn.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
-					c.log.Info(ctx, "*** PING ***", "status", "failed", "id", id, "ERROR", err)
+				if err := conn.Conn.ping(); err != nil {
+					c.log.Info(ctx, "*** PING ***", "status", "failed", "id", s.ID, "device", s.Device, "ERROR", err)
 				}
 
-				if err := c.users.UpdateLastPing(ctx, id); err != nil {
-					c.log.Info(ctx, "*** PING ***", "status", "failed", "id", id, "ERROR", err)
+				if err := c.users.UpdateLastPing(ctx, s); err != nil {
+					c.log.Info(ctx, "*** PING ***", "status", "failed", "id", s.ID, "device", s.Device, "ERROR", err)
 				}
 			}
 
+			c.lastTick.Store(time.Now().UnixNano())
+
 			c.log.Debug(ctx, "*** PING ***", "status", "completed")
 		}
 	}()
@@ -0,0 +1,1816 @@
+package chat_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/groups"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/jsbus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/jsusers"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/limiter"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/localbus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/membus"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/nonces"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/offline"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/presence"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/users"
+	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ardanlabs/usdl/chat/foundation/natsserver"
+	"github.com/ardanlabs/usdl/chat/foundation/signature"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"golang.org/x/time/rate"
+)
+
+const subject = "test-cap"
+
+// =============================================================================
+
+// newBusFn returns the bus a cap uses, given the cap's jetstream connection.
+type newBusFn func(t *testing.T, js jetstream.JetStream) chat.Bus
+
+func Test_TwoCaps(t *testing.T) {
+	t.Run("jetstream", func(t *testing.T) {
+		testTwoCaps(t, func(t *testing.T, js jetstream.JetStream) chat.Bus {
+			bus, err := jsbus.New(context.Background(), newLogger(), js, subject)
+			if err != nil {
+				t.Fatalf("Should be able to create the bus: %s", err)
+			}
+			return bus
+		})
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		bus := membus.New()
+		testTwoCaps(t, func(*testing.T, jetstream.JetStream) chat.Bus {
+			return bus
+		})
+	})
+
+	t.Run("local", func(t *testing.T) {
+		bus, err := localbus.New(localbus.Config{MaxLen: 100, AckWait: time.Second})
+		if err != nil {
+			t.Fatalf("Should be able to create the bus: %s", err)
+		}
+		testTwoCaps(t, func(*testing.T, jetstream.JetStream) chat.Bus {
+			return bus
+		})
+	})
+}
+
+func testTwoCaps(t *testing.T, newBus newBusFn) {
+	ns := startNATS(t)
+
+	url1, _, _ := startCap(t, ns, newBus)
+	url2, prs, _ := startCap(t, ns, newBus)
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+	carol := newClient(t, "Carol")
+
+	alice.connect(t, url1)
+	bob.connect(t, url2)
+
+	waitOnline(t, prs, bob.id)
+
+	// -------------------------------------------------------------------------
+	// A message to a user on the other cap is routed over the bus.
+
+	alice.sendChat(t, bob.id, 1, "hello bob")
+
+	var chatMsg protocol.ChatMessage
+	bob.read(t, protocol.TypeChat, &chatMsg)
+
+	if chatMsg.From.ID != alice.id || chatMsg.From.Nonce != 1 || chatMsg.Msg != "hello bob" {
+		t.Fatalf("Should receive alice's message, got %+v", chatMsg)
+	}
+
+	var st protocol.StatusMessage
+	alice.read(t, protocol.TypeStatus, &st)
+
+	if st.Status != protocol.StatusDelivered {
+		t.Fatalf("Should get a %s status, got %s", protocol.StatusDelivered, st.Status)
+	}
+
+	// -------------------------------------------------------------------------
+	// A message to a user that is not connected is stored until they are.
+
+	alice.sendChat(t, carol.id, 2, "hello carol")
+
+	alice.read(t, protocol.TypeStatus, &st)
+
+	if st.Status != protocol.StatusQueued {
+		t.Fatalf("Should get a %s status, got %s", protocol.StatusQueued, st.Status)
+	}
+
+	carol.connect(t, url2)
+	carol.read(t, protocol.TypeChat, &chatMsg)
+
+	if chatMsg.From.ID != alice.id || chatMsg.Msg != "hello carol" {
+		t.Fatalf("Should receive alice's queued message, got %+v", chatMsg)
+	}
+}
+
+func Test_Groups(t *testing.T) {
+	ns := startNATS(t)
+
+	bus := membus.New()
+	newBus := func(*testing.T, jetstream.JetStream) chat.Bus {
+		return bus
+	}
+
+	url1, _, _ := startCap(t, ns, newBus)
+	url2, prs, _ := startCap(t, ns, newBus)
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+	carol := newClient(t, "Carol")
+	mallory := newClient(t, "Mallory")
+
+	alice.connect(t, url1)
+	carol.connect(t, url1)
+	mallory.connect(t, url1)
+	bob.connect(t, url2)
+
+	waitOnline(t, prs, bob.id)
+
+	groupID := newClient(t, "Team").id
+
+	notice := func(c *client, exp string) {
+		t.Helper()
+
+		var chatMsg protocol.ChatMessage
+		c.read(t, protocol.TypeChat, &chatMsg)
+
+		if chatMsg.Group == nil || chatMsg.Group.ID != groupID || chatMsg.Msg != exp {
+			t.Fatalf("Should get the notice %q, got %+v", exp, chatMsg)
+		}
+	}
+
+	// -------------------------------------------------------------------------
+	// Alice creates the group and invites Bob, who is on the other cap, and
+	// Carol. Every member is told.
+
+	alice.sendCommand(t, groupID, 1, protocol.Command{
+		Action:  protocol.ActionGroupCreate,
+		GroupID: groupID,
+		Name:    "Team",
+	})
+
+	notice(alice, "** Alice created the group **")
+
+	alice.sendCommand(t, groupID, 2, protocol.Command{
+		Action:   protocol.ActionGroupInvite,
+		GroupID:  groupID,
+		MemberID: bob.id,
+	})
+
+	invited := fmt.Sprintf("** Alice invited %s **", bob.id.Hex())
+	notice(alice, invited)
+	notice(bob, invited)
+
+	alice.sendCommand(t, groupID, 3, protocol.Command{
+		Action:   protocol.ActionGroupInvite,
+		GroupID:  groupID,
+		MemberID: carol.id,
+	})
+
+	invited = fmt.Sprintf("** Alice invited %s **", carol.id.Hex())
+	notice(alice, invited)
+	notice(bob, invited)
+	notice(carol, invited)
+
+	// -------------------------------------------------------------------------
+	// A message to the group reaches the members on both caps.
+
+	alice.sendChat(t, groupID, 4, "hello team")
+
+	for _, c := range []*client{bob, carol} {
+		var chatMsg protocol.ChatMessage
+		c.read(t, protocol.TypeChat, &chatMsg)
+
+		if chatMsg.From.ID != alice.id || chatMsg.Msg != "hello team" || chatMsg.Group == nil || chatMsg.Group.ID != groupID {
+			t.Fatalf("Should receive alice's group message, got %+v", chatMsg)
+		}
+
+		if len(chatMsg.Group.Members) != 3 {
+			t.Fatalf("Should list 3 members, got %d", len(chatMsg.Group.Members))
+		}
+	}
+
+	// -------------------------------------------------------------------------
+	// Someone who isn't a member can't send to the group.
+
+	mallory.sendChat(t, groupID, 1, "let me in")
+
+	var em protocol.ErrorMessage
+	mallory.read(t, protocol.TypeError, &em)
+
+	if em.Code != errs.FailedPrecondition {
+		t.Fatalf("Should get a %s error, got %+v", errs.FailedPrecondition, em)
+	}
+
+	// -------------------------------------------------------------------------
+	// Once Bob is removed he is told, and the group's messages no longer
+	// reach him.
+
+	alice.sendCommand(t, groupID, 5, protocol.Command{
+		Action:   protocol.ActionGroupRemove,
+		GroupID:  groupID,
+		MemberID: bob.id,
+	})
+
+	removed := fmt.Sprintf("** Alice removed %s **", bob.id.Hex())
+	notice(alice, removed)
+	notice(bob, removed)
+	notice(carol, removed)
+
+	alice.sendChat(t, groupID, 6, "bob is gone")
+
+	var chatMsg protocol.ChatMessage
+	carol.read(t, protocol.TypeChat, &chatMsg)
+
+	if chatMsg.Msg != "bob is gone" || len(chatMsg.Group.Members) != 2 {
+		t.Fatalf("Should receive alice's group message without bob, got %+v", chatMsg)
+	}
+
+	// The next frame Bob gets is a message sent to him after the group's.
+
+	alice.sendChat(t, bob.id, 1, "just you")
+
+	var direct protocol.ChatMessage
+	bob.read(t, protocol.TypeChat, &direct)
+
+	if direct.Group != nil || direct.Msg != "just you" {
+		t.Fatalf("Should not receive the group's message, got %+v", direct)
+	}
+}
+
+func Test_Drain(t *testing.T) {
+	t.Run("jetstream", func(t *testing.T) {
+		testDrain(t, func(t *testing.T, js jetstream.JetStream) chat.Bus {
+			bus, err := jsbus.New(context.Background(), newLogger(), js, subject)
+			if err != nil {
+				t.Fatalf("Should be able to create the bus: %s", err)
+			}
+			return bus
+		})
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		bus := membus.New()
+		testDrain(t, func(*testing.T, jetstream.JetStream) chat.Bus {
+			return bus
+		})
+	})
+
+	t.Run("local", func(t *testing.T) {
+		bus, err := localbus.New(localbus.Config{MaxLen: 100, AckWait: time.Second})
+		if err != nil {
+			t.Fatalf("Should be able to create the bus: %s", err)
+		}
+		testDrain(t, func(*testing.T, jetstream.JetStream) chat.Bus {
+			return bus
+		})
+	})
+}
+
+func testDrain(t *testing.T, newBus newBusFn) {
+	ns := startNATS(t)
+
+	url1, _, cap1 := startCap(t, ns, newBus)
+	url2, prs, _ := startCap(t, ns, newBus)
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url1)
+	bob.connect(t, url2)
+
+	waitOnline(t, prs, bob.id)
+
+	// -------------------------------------------------------------------------
+	// Alice is told to connect again when her cap is drained.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- cap1.Drain(ctx)
+	}()
+
+	alice.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := alice.conn.ReadMessage()
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != protocol.CloseReconnect {
+		t.Fatalf("Should be closed with code %d, got %v", protocol.CloseReconnect, err)
+	}
+
+	if err := <-drained; err != nil {
+		t.Fatalf("Should be able to drain the cap: %s", err)
+	}
+
+	if !cap1.ShuttingDown() {
+		t.Fatal("Should report the cap is shutting down")
+	}
+
+	// -------------------------------------------------------------------------
+	// The drained cap refuses new users, alice connects to the other cap.
+
+	if conn, _, err := websocket.DefaultDialer.Dial(url1, nil); err == nil {
+		conn.Close()
+		t.Fatal("Should not be able to connect to a drained cap")
+	}
+
+	alice.connect(t, url2)
+	waitOnline(t, prs, alice.id)
+
+	bob.sendChat(t, alice.id, 1, "welcome back")
+
+	var chatMsg protocol.ChatMessage
+	alice.read(t, protocol.TypeChat, &chatMsg)
+
+	if chatMsg.From.ID != bob.id || chatMsg.Msg != "welcome back" {
+		t.Fatalf("Should receive bob's message, got %+v", chatMsg)
+	}
+}
+
+func Test_Replay(t *testing.T) {
+	ns := startNATS(t)
+
+	url, prs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url)
+	bob.connect(t, url)
+
+	waitOnline(t, prs, bob.id)
+
+	alice.sendChat(t, bob.id, 1, "hello bob")
+
+	var chatMsg protocol.ChatMessage
+	bob.read(t, protocol.TypeChat, &chatMsg)
+
+	var st protocol.StatusMessage
+	alice.read(t, protocol.TypeStatus, &st)
+
+	// The same signed frame sent again must be rejected.
+
+	alice.sendChat(t, bob.id, 1, "hello bob")
+
+	var em protocol.ErrorMessage
+	alice.read(t, protocol.TypeError, &em)
+
+	if em.Code != errs.Aborted || em.ToID != bob.id || em.Nonce != 1 {
+		t.Fatalf("Should get an %s error for nonce 1, got %+v", errs.Aborted, em)
+	}
+
+	// The connection is still usable.
+
+	alice.sendChat(t, bob.id, 2, "still here")
+
+	bob.read(t, protocol.TypeChat, &chatMsg)
+
+	if chatMsg.From.Nonce != 2 || chatMsg.Msg != "still here" {
+		t.Fatalf("Should receive the next message, got %+v", chatMsg)
+	}
+}
+
+func Test_OfflineOrder(t *testing.T) {
+	ns := startNATS(t)
+
+	url, _, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url)
+
+	// -------------------------------------------------------------------------
+	// Messages are stored while bob is offline and keep coming while he
+	// connects, he receives them in the order they were sent.
+
+	const queued = 50
+
+	var nonce uint64
+	for range queued {
+		nonce++
+		alice.sendChat(t, bob.id, nonce, fmt.Sprintf("message %d", nonce))
+	}
+
+	connected := make(chan struct{})
+	go func() {
+		bob.connect(t, url)
+		close(connected)
+	}()
+
+send:
+	for {
+		nonce++
+		alice.sendChat(t, bob.id, nonce, fmt.Sprintf("message %d", nonce))
+
+		select {
+		case <-connected:
+			break send
+		default:
+		}
+	}
+
+	nonce++
+	alice.sendChat(t, bob.id, nonce, "last message")
+
+	var last uint64
+	for last != nonce {
+		var chatMsg protocol.ChatMessage
+		bob.read(t, protocol.TypeChat, &chatMsg)
+
+		if chatMsg.From.Nonce <= last {
+			t.Fatalf("Should receive message %d after message %d", chatMsg.From.Nonce, last)
+		}
+
+		if last < queued && chatMsg.From.Nonce != last+1 {
+			t.Fatalf("Should receive the queued message %d, got %d", last+1, chatMsg.From.Nonce)
+		}
+
+		last = chatMsg.From.Nonce
+	}
+}
+
+func Test_File(t *testing.T) {
+	ns := startNATS(t)
+
+	url, prs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url)
+	bob.connect(t, url)
+
+	waitOnline(t, prs, bob.id)
+
+	// -------------------------------------------------------------------------
+	// Every chunk is relayed, the sender gets a status for the whole file.
+
+	chunks := []string{"hello ", "file"}
+
+	for i, data := range chunks {
+		fc := protocol.FileChunk{
+			ID:    "1",
+			Name:  "hello.txt",
+			Size:  10,
+			Index: i,
+			Total: len(chunks),
+			Data:  []byte(data),
+		}
+
+		alice.sendFile(t, bob.id, uint64(i+1), fc)
+
+		var fm protocol.FileMessage
+		bob.read(t, protocol.TypeFile, &fm)
+
+		if fm.From.ID != alice.id || fm.Chunk.Index != i || string(fm.Chunk.Data) != data {
+			t.Fatalf("Should receive chunk %d, got %+v", i, fm.Chunk)
+		}
+	}
+
+	var st protocol.StatusMessage
+	alice.read(t, protocol.TypeStatus, &st)
+
+	if st.Nonce != 2 || st.Status != protocol.StatusDelivered {
+		t.Fatalf("Should get a %s status for nonce 2, got %+v", protocol.StatusDelivered, st)
+	}
+
+	// -------------------------------------------------------------------------
+	// Files larger than the cap accepts are rejected.
+
+	fc := protocol.FileChunk{
+		ID:    "2",
+		Name:  "big.bin",
+		Size:  1024*1024 + 1,
+		Total: 1,
+	}
+
+	alice.sendFile(t, bob.id, 3, fc)
+
+	var em protocol.ErrorMessage
+	alice.read(t, protocol.TypeError, &em)
+
+	if em.Code != errs.FailedPrecondition || em.Nonce != 3 {
+		t.Fatalf("Should get a %s error for nonce 3, got %+v", errs.FailedPrecondition, em)
+	}
+}
+
+func Test_Presence(t *testing.T) {
+	ns := startNATS(t)
+
+	newBus := func(t *testing.T, js jetstream.JetStream) chat.Bus {
+		bus, err := jsbus.New(context.Background(), newLogger(), js, subject)
+		if err != nil {
+			t.Fatalf("Should be able to create the bus: %s", err)
+		}
+		return bus
+	}
+
+	url1, _, _ := startCap(t, ns, newBus)
+	url2, _, _ := startCap(t, ns, newBus)
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url1)
+
+	// -------------------------------------------------------------------------
+	// Subscribing returns the current status right away.
+
+	alice.sendPresence(t, protocol.PresenceRequest{Subscribe: []common.Address{bob.id}})
+
+	var pm protocol.PresenceMessage
+	alice.read(t, protocol.TypePresence, &pm)
+
+	if pm.ID != bob.id || pm.Status != protocol.PresenceOffline {
+		t.Fatalf("Should see bob %s, got %+v", protocol.PresenceOffline, pm)
+	}
+
+	// -------------------------------------------------------------------------
+	// Changes on the other cap are pushed to the subscriber.
+
+	bob.connect(t, url2)
+
+	alice.read(t, protocol.TypePresence, &pm)
+
+	if pm.ID != bob.id || pm.Status != protocol.PresenceOnline {
+		t.Fatalf("Should see bob %s, got %+v", protocol.PresenceOnline, pm)
+	}
+
+	bob.sendPresence(t, protocol.PresenceRequest{Status: protocol.PresenceAway})
+
+	alice.read(t, protocol.TypePresence, &pm)
+
+	if pm.ID != bob.id || pm.Status != protocol.PresenceAway {
+		t.Fatalf("Should see bob %s, got %+v", protocol.PresenceAway, pm)
+	}
+
+	bob.conn.Close()
+
+	alice.read(t, protocol.TypePresence, &pm)
+
+	if pm.ID != bob.id || pm.Status != protocol.PresenceOffline || pm.LastSeen.IsZero() {
+		t.Fatalf("Should see bob %s with a last seen time, got %+v", protocol.PresenceOffline, pm)
+	}
+}
+
+func Test_HandshakeBadSignature(t *testing.T) {
+	ns := startNATS(t)
+
+	url, _, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	})
+
+	alice := newClient(t, "Alice")
+	mallory := newClient(t, "Mallory")
+
+	conn := dial(t, url)
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	// Mallory claims to be Alice.
+	hello := protocol.Hello{
+		ID:   alice.id,
+		Name: "Alice",
+	}
+
+	hello.Signature = mallory.sign(t, hello.SignedData(chlg.Challenge))
+	writeFrame(t, conn, protocol.TypeHello, hello)
+
+	var em protocol.ErrorMessage
+	readFrame(t, conn, protocol.TypeError, &em)
+
+	if em.Code != errs.Unauthenticated {
+		t.Fatalf("Should get an %s error, got %s", errs.Unauthenticated, em.Code)
+	}
+
+	_, _, err := conn.ReadMessage()
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != protocol.CloseUnauthenticated {
+		t.Fatalf("Should be closed with code %d, got %v", protocol.CloseUnauthenticated, err)
+	}
+}
+
+func Test_HandshakeVersion(t *testing.T) {
+	ns := startNATS(t)
+
+	url, _, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	})
+
+	// -------------------------------------------------------------------------
+	// A hello written with a version the cap can't read is refused with the
+	// unsupported version close code.
+
+	conn := dial(t, url)
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","version":99,"payload":{}}`)); err != nil {
+		t.Fatalf("Should be able to write the hello: %s", err)
+	}
+
+	var em protocol.ErrorMessage
+	readFrame(t, conn, protocol.TypeError, &em)
+
+	if em.Code != errs.FailedPrecondition {
+		t.Fatalf("Should get a %s error, got %s", errs.FailedPrecondition, em.Code)
+	}
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, protocol.CloseUnsupportedVersion) {
+		t.Fatalf("Should be closed with code %d, got %v", protocol.CloseUnsupportedVersion, err)
+	}
+
+	// -------------------------------------------------------------------------
+	// A frame of an unknown type instead of the hello breaks the protocol.
+
+	conn = dial(t, url)
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	writeFrame(t, conn, "future", struct{}{})
+	readFrame(t, conn, protocol.TypeError, &em)
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("Should be closed with code %d, got %v", websocket.CloseProtocolError, err)
+	}
+
+	// -------------------------------------------------------------------------
+	// Once connected, a frame of an unknown type is refused and the
+	// connection stays up.
+
+	alice := newClient(t, "Alice")
+	alice.connect(t, url)
+
+	writeFrame(t, alice.conn, "future", struct{}{})
+	alice.read(t, protocol.TypeError, &em)
+
+	if em.Code != errs.InvalidArgument {
+		t.Fatalf("Should get an %s error, got %s", errs.InvalidArgument, em.Code)
+	}
+
+	alice.sendChat(t, newClient(t, "Bob").id, 1, "still here")
+
+	var st protocol.StatusMessage
+	alice.read(t, protocol.TypeStatus, &st)
+
+	if st.Status != protocol.StatusQueued {
+		t.Fatalf("Should get a %s status, got %s", protocol.StatusQueued, st.Status)
+	}
+}
+
+func Test_HandshakeTimeout(t *testing.T) {
+	ns := startNATS(t)
+
+	m := newTestMetrics()
+
+	url, _, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = m
+	})
+
+	conn := dial(t, url)
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	// The client never answers the challenge.
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, protocol.CloseHandshakeTimeout) {
+		t.Fatalf("Should be closed with code %d, got %v", protocol.CloseHandshakeTimeout, err)
+	}
+
+	if n := m.count("handshake/" + chat.HandshakeTimeout); n != 1 {
+		t.Fatalf("Should count one handshake timeout, got %d", n)
+	}
+}
+
+func Test_ConnectionLeaks(t *testing.T) {
+	ns := startNATS(t)
+
+	url, _, c := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	})
+
+	// The first connection starts what the cap keeps running for its life.
+
+	warmup := newClient(t, "Warmup")
+	warmup.connect(t, url)
+	warmup.conn.Close()
+
+	waitDisconnected(t, c)
+
+	base := runtime.NumGoroutine()
+
+	const cycles = 50
+
+	for i := range cycles {
+
+		// A client that completes the handshake and then goes away.
+
+		usr := newClient(t, fmt.Sprintf("User%d", i))
+		usr.connect(t, url)
+		usr.conn.Close()
+
+		// A client that goes away before answering the challenge.
+
+		conn := dial(t, url)
+		conn.Close()
+
+		// A client that never answers the challenge.
+
+		conn = dial(t, url)
+
+		var chlg protocol.Challenge
+		readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, protocol.CloseHandshakeTimeout) {
+			t.Fatalf("Should be closed with code %d, got %v", protocol.CloseHandshakeTimeout, err)
+		}
+
+		conn.Close()
+	}
+
+	waitDisconnected(t, c)
+
+	// Goroutines of the test server and the nats client come and go, so a
+	// few more than before are allowed.
+
+	const slack = 10
+
+	var n int
+	for range 50 {
+		if n = runtime.NumGoroutine(); n <= base+slack {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	t.Fatalf("Should not leak goroutines after %d cycles, got %d, started with %d\n%s", cycles, n, base, buf)
+}
+
+func Test_Metrics(t *testing.T) {
+	ns := startNATS(t)
+
+	m := newTestMetrics()
+
+	url, prs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = m
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+	mallory := newClient(t, "Mallory")
+
+	alice.connect(t, url)
+	bob.connect(t, url)
+
+	waitOnline(t, prs, bob.id)
+
+	alice.sendChat(t, bob.id, 1, "hello bob")
+
+	var chatMsg protocol.ChatMessage
+	bob.read(t, protocol.TypeChat, &chatMsg)
+
+	var st protocol.StatusMessage
+	alice.read(t, protocol.TypeStatus, &st)
+
+	// Mallory signs a frame sent over Alice's connection.
+
+	req := protocol.ChatRequest{
+		ToID:      bob.id,
+		Msg:       "not from alice",
+		FromNonce: 2,
+	}
+
+	req.Signature = mallory.sign(t, req.SignedData())
+	writeFrame(t, alice.conn, protocol.TypeChat, req)
+
+	var em protocol.ErrorMessage
+	alice.read(t, protocol.TypeError, &em)
+
+	// Mallory claims to be Alice during the handshake.
+
+	conn := dial(t, url)
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	hello := protocol.Hello{
+		ID:   alice.id,
+		Name: "Alice",
+	}
+
+	hello.Signature = mallory.sign(t, hello.SignedData(chlg.Challenge))
+	writeFrame(t, conn, protocol.TypeHello, hello)
+
+	readFrame(t, conn, protocol.TypeError, &em)
+
+	exp := map[string]int{
+		"handshake/" + chat.HandshakeOK:              2,
+		"handshake/" + chat.HandshakeUnauthenticated: 1,
+		"routed/" + chat.RouteLocal:                  1,
+		"signature/" + chat.SourceClient:             1,
+	}
+
+	// The handshake is recorded once the cap is done with the connection.
+
+	for key, n := range exp {
+		var got int
+		for range 50 {
+			if got = m.count(key); got == n {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if got != n {
+			t.Fatalf("Should count %d %s, got %d", n, key, got)
+		}
+	}
+
+	if got := m.connectedUsers(); got != 2 {
+		t.Fatalf("Should have 2 connected users, got %d", got)
+	}
+
+	// -------------------------------------------------------------------------
+	// A client that stops answering pings times out on a cap that pings
+	// often. The client doesn't read, so its pings are never answered.
+
+	pm := newTestMetrics()
+
+	pingURL, pingPrs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = pm
+		cfg.Outbound.PingInterval = 50 * time.Millisecond
+	})
+
+	carol := newClient(t, "Carol")
+	carol.connect(t, pingURL)
+
+	waitOnline(t, pingPrs, carol.id)
+
+	var got int
+	for range 100 {
+		if got = pm.count("pingtimeout"); got == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got != 1 {
+		t.Fatalf("Should count 1 pingtimeout, got %d", got)
+	}
+}
+
+func Test_RateLimit(t *testing.T) {
+	ns := startNATS(t)
+
+	m := newTestMetrics()
+
+	url, prs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = m
+		cfg.Limiter = newLimiter(t, ns)
+		cfg.Limits = chat.Limits{
+			Messages:      chat.Limit{Rate: 0.001, Burst: 2},
+			Handshakes:    chat.Limit{Rate: 0.001, Burst: 2},
+			MaxViolations: 1,
+		}
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url)
+	bob.connect(t, url)
+
+	waitOnline(t, prs, bob.id)
+
+	// -------------------------------------------------------------------------
+	// Frames within the burst are delivered.
+
+	for nonce := range uint64(2) {
+		alice.sendChat(t, bob.id, nonce+1, "hello bob")
+
+		var chatMsg protocol.ChatMessage
+		bob.read(t, protocol.TypeChat, &chatMsg)
+
+		var st protocol.StatusMessage
+		alice.read(t, protocol.TypeStatus, &st)
+	}
+
+	// -------------------------------------------------------------------------
+	// The first violation is reported, the next one disconnects alice.
+
+	alice.sendChat(t, bob.id, 3, "too fast")
+
+	var em protocol.ErrorMessage
+	alice.read(t, protocol.TypeError, &em)
+
+	if em.Code != errs.TooManyRequests {
+		t.Fatalf("Should get a %s error, got %+v", errs.TooManyRequests, em)
+	}
+
+	alice.sendChat(t, bob.id, 4, "still too fast")
+	alice.read(t, protocol.TypeError, &em)
+
+	_, _, err := alice.conn.ReadMessage()
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != protocol.CloseRateLimited {
+		t.Fatalf("Should be closed with code %d, got %v", protocol.CloseRateLimited, err)
+	}
+
+	// -------------------------------------------------------------------------
+	// Both handshakes from this address were spent.
+
+	if conn, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		conn.Close()
+		t.Fatal("Should not be able to connect once the handshakes are spent")
+	}
+
+	if got := m.count("handshake/" + chat.HandshakeRateLimited); got != 1 {
+		t.Fatalf("Should count 1 rate limited handshake, got %d", got)
+	}
+}
+
+func Test_RateLimitFile(t *testing.T) {
+	ns := startNATS(t)
+
+	m := newTestMetrics()
+
+	const byteBurst = 256 * 1024
+
+	url, prs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = m
+		cfg.Limiter = newLimiter(t, ns)
+		cfg.Limits = chat.Limits{
+			Messages:      chat.Limit{Rate: 20, Burst: 5},
+			Bytes:         chat.Limit{Rate: 1024 * 1024, Burst: byteBurst},
+			MaxViolations: 1,
+		}
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url)
+	bob.connect(t, url)
+
+	waitOnline(t, prs, bob.id)
+
+	if alice.limits == nil || alice.limits.ByteBurst != byteBurst {
+		t.Fatalf("Should be welcomed with the limits, got %+v", alice.limits)
+	}
+
+	// -------------------------------------------------------------------------
+	// A file several times the byte burst is paced like the client does by
+	// the limits the cap announced, every chunk is delivered.
+
+	msgs := rate.NewLimiter(rate.Limit(alice.limits.MessageRate), alice.limits.MessageBurst/2)
+	bytes := rate.NewLimiter(rate.Limit(alice.limits.ByteRate), alice.limits.ByteBurst/2)
+
+	const total = 12
+
+	go func() {
+		for i := range total {
+			fc := protocol.FileChunk{
+				ID:    "1",
+				Name:  "big.bin",
+				Size:  total * protocol.MaxChunkSize,
+				Index: i,
+				Total: total,
+				Data:  make([]byte, protocol.MaxChunkSize),
+			}
+
+			req := protocol.FileRequest{
+				ToID:      bob.id,
+				Chunk:     fc,
+				FromNonce: uint64(i + 1),
+			}
+
+			req.Signature = alice.sign(t, req.SignedData())
+
+			data, err := protocol.Encode(protocol.TypeFile, req)
+			if err != nil {
+				t.Errorf("Should be able to encode the chunk: %s", err)
+				return
+			}
+
+			msgs.Wait(context.Background())
+			bytes.WaitN(context.Background(), len(data))
+
+			if err := alice.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				t.Errorf("Should be able to write the chunk: %s", err)
+				return
+			}
+		}
+	}()
+
+	for i := range total {
+		var fm protocol.FileMessage
+		bob.read(t, protocol.TypeFile, &fm)
+
+		if fm.Chunk.Index != i {
+			t.Fatalf("Should receive chunk %d, got %d", i, fm.Chunk.Index)
+		}
+	}
+
+	var st protocol.StatusMessage
+	alice.read(t, protocol.TypeStatus, &st)
+
+	if st.Nonce != total || st.Status != protocol.StatusDelivered {
+		t.Fatalf("Should get a %s status for nonce %d, got %+v", protocol.StatusDelivered, total, st)
+	}
+
+	if n := m.count("routed/" + chat.RouteLocal); n != total {
+		t.Fatalf("Should route every chunk, got %d", n)
+	}
+}
+
+func Test_SharedUsers(t *testing.T) {
+	ns := startNATS(t)
+
+	bus := membus.New()
+	newBus := func(*testing.T, jetstream.JetStream) chat.Bus {
+		return bus
+	}
+
+	shared := func(cfg *chat.Config) {
+		usrs, err := jsusers.New(context.Background(), cfg.Log, newJS(t, ns), subject+"-users", cfg.CapID, 30*time.Second)
+		if err != nil {
+			t.Fatalf("Should be able to create the users: %s", err)
+		}
+		cfg.Users = usrs
+	}
+
+	url1, prs, _ := startCap(t, ns, newBus, shared)
+	url2, _, _ := startCap(t, ns, newBus, shared)
+
+	alice := newClient(t, "Alice")
+	alice.connect(t, url1)
+
+	waitOnline(t, prs, alice.id)
+
+	// -------------------------------------------------------------------------
+	// Alice can't connect to the other cap while she is connected.
+
+	conn := dial(t, url2)
+
+	var chlg protocol.Challenge
+	readFrame(t, conn, protocol.TypeChallenge, &chlg)
+
+	hello := protocol.Hello{
+		ID:   alice.id,
+		Name: alice.name,
+	}
+
+	hello.Signature = alice.sign(t, hello.SignedData(chlg.Challenge))
+	writeFrame(t, conn, protocol.TypeHello, hello)
+
+	var em protocol.ErrorMessage
+	readFrame(t, conn, protocol.TypeError, &em)
+
+	if em.Code != errs.AlreadyExists {
+		t.Fatalf("Should get an %s error, got %+v", errs.AlreadyExists, em)
+	}
+
+	// -------------------------------------------------------------------------
+	// Once she left the first cap she can connect to the other one.
+
+	alice.conn.Close()
+
+	for range 50 {
+		if _, err := prs.Retrieve(context.Background(), alice.id); err != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	alice.connect(t, url2)
+}
+
+func Test_Devices(t *testing.T) {
+	ns := startNATS(t)
+
+	bus := membus.New()
+	newBus := func(*testing.T, jetstream.JetStream) chat.Bus {
+		return bus
+	}
+
+	url1, prs, _ := startCap(t, ns, newBus)
+	url2, _, _ := startCap(t, ns, newBus)
+
+	bob := newClient(t, "Bob")
+	laptop := newClient(t, "Alice").newDevice("laptop")
+	phone := laptop.newDevice("phone")
+
+	bob.connect(t, url1)
+	laptop.connect(t, url1)
+	phone.connect(t, url2)
+
+	for range 50 {
+		if devices, _ := prs.Retrieve(context.Background(), laptop.id); len(devices) == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// -------------------------------------------------------------------------
+	// A message to Alice reaches both of her devices.
+
+	bob.sendChat(t, laptop.id, 1, "hello alice")
+
+	for _, c := range []*client{laptop, phone} {
+		var chatMsg protocol.ChatMessage
+		c.read(t, protocol.TypeChat, &chatMsg)
+
+		if chatMsg.From.ID != bob.id || chatMsg.Msg != "hello alice" {
+			t.Fatalf("Should receive bob's message on the %s, got %+v", c.device, chatMsg)
+		}
+	}
+
+	var st protocol.StatusMessage
+	bob.read(t, protocol.TypeStatus, &st)
+
+	if st.Status != protocol.StatusDelivered {
+		t.Fatalf("Should get a %s status, got %s", protocol.StatusDelivered, st.Status)
+	}
+
+	// -------------------------------------------------------------------------
+	// Each device uses its own nonces and its messages are mirrored to the
+	// other device.
+
+	for _, pair := range [][2]*client{{laptop, phone}, {phone, laptop}} {
+		from, other := pair[0], pair[1]
+
+		from.sendChat(t, bob.id, 1, "hi from the "+from.device)
+
+		var chatMsg protocol.ChatMessage
+		bob.read(t, protocol.TypeChat, &chatMsg)
+
+		if chatMsg.From.Device != from.device || chatMsg.From.Nonce != 1 {
+			t.Fatalf("Should receive the message from the %s with nonce 1, got %+v", from.device, chatMsg)
+		}
+
+		from.read(t, protocol.TypeStatus, &st)
+
+		if st.Status != protocol.StatusDelivered {
+			t.Fatalf("Should get a %s status, got %s", protocol.StatusDelivered, st.Status)
+		}
+
+		var sm protocol.SentMessage
+		other.read(t, protocol.TypeSent, &sm)
+
+		if sm.Device != from.device || sm.ToID != bob.id || sm.Msg != "hi from the "+from.device {
+			t.Fatalf("Should receive the mirror of the %s's message, got %+v", from.device, sm)
+		}
+	}
+
+	// -------------------------------------------------------------------------
+	// A message stored for a user that is not connected keeps the device it
+	// was sent from.
+
+	carol := newClient(t, "Carol")
+
+	laptop.sendChat(t, carol.id, 2, "hello carol")
+
+	laptop.read(t, protocol.TypeStatus, &st)
+
+	if st.Status != protocol.StatusQueued {
+		t.Fatalf("Should get a %s status, got %s", protocol.StatusQueued, st.Status)
+	}
+
+	var sm protocol.SentMessage
+	phone.read(t, protocol.TypeSent, &sm)
+
+	carol.connect(t, url2)
+
+	var chatMsg protocol.ChatMessage
+	carol.read(t, protocol.TypeChat, &chatMsg)
+
+	if chatMsg.From.ID != laptop.id || chatMsg.From.Device != laptop.device || chatMsg.Msg != "hello carol" {
+		t.Fatalf("Should receive the laptop's queued message, got %+v", chatMsg)
+	}
+
+	// -------------------------------------------------------------------------
+	// The laptop lists the devices and revokes the phone.
+
+	laptop.sendDevice(t, protocol.DeviceRequest{Action: protocol.DeviceList})
+
+	var dm protocol.DevicesMessage
+	laptop.read(t, protocol.TypeDevice, &dm)
+
+	exp := []protocol.Device{{ID: "laptop", Current: true}, {ID: "phone"}}
+	if len(dm.Devices) != 2 || dm.Devices[0] != exp[0] || dm.Devices[1] != exp[1] {
+		t.Fatalf("Should list both devices, got %+v", dm.Devices)
+	}
+
+	laptop.sendDevice(t, protocol.DeviceRequest{Action: protocol.DeviceRevoke, Device: "phone"})
+
+	phone.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err := phone.conn.ReadMessage()
+	if !websocket.IsCloseError(err, protocol.CloseRevoked) {
+		t.Fatalf("Should be closed with code %d, got %v", protocol.CloseRevoked, err)
+	}
+}
+
+func Test_SlowConsumer(t *testing.T) {
+	ns := startNATS(t)
+
+	m := newTestMetrics()
+
+	url, prs, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = m
+		cfg.Outbound = chat.Outbound{QueueSize: 1, WriteTimeout: time.Minute}
+	})
+
+	alice := newClient(t, "Alice")
+	bob := newClient(t, "Bob")
+
+	alice.connect(t, url)
+	bob.connect(t, url)
+
+	waitOnline(t, prs, alice.id)
+
+	// Alice stops reading while Bob sends her large messages, once the socket
+	// buffers are full her queue fills up.
+
+	msg := strings.Repeat("x", 256*1024)
+
+	go func() {
+		for {
+			if _, _, err := bob.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for nonce := uint64(1); m.count("slowconsumer") == 0; nonce++ {
+		if nonce > 1000 {
+			t.Fatal("Should detect alice as a slow consumer")
+		}
+
+		bob.sendChat(t, alice.id, nonce, msg)
+		time.Sleep(time.Millisecond)
+	}
+
+	// The frames already queued are written before the close frame.
+
+	alice.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	for {
+		_, _, err := alice.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+
+		if !websocket.IsCloseError(err, protocol.CloseSlowConsumer) {
+			t.Fatalf("Should be closed with code %d, got %v", protocol.CloseSlowConsumer, err)
+		}
+		break
+	}
+
+	if n := m.count("slowconsumer"); n != 1 {
+		t.Fatalf("Should count one slow consumer, got %d", n)
+	}
+}
+
+func Test_Upgrader(t *testing.T) {
+	ns := startNATS(t)
+
+	m := newTestMetrics()
+
+	const origin = "https://chat.example.com"
+	const subprotocol = "usdl"
+	const maxSize = 1024
+
+	url, _, _ := startCap(t, ns, func(*testing.T, jetstream.JetStream) chat.Bus {
+		return membus.New()
+	}, func(cfg *chat.Config) {
+		cfg.Metrics = m
+		cfg.Upgrader = chat.Upgrader{
+			AllowedOrigins: []string{origin},
+			MaxMessageSize: maxSize,
+			Compression:    true,
+			Subprotocol:    subprotocol,
+		}
+	})
+
+	dialer := websocket.Dialer{
+		Subprotocols:      []string{subprotocol},
+		EnableCompression: true,
+	}
+
+	header := func(origin string) http.Header {
+		return http.Header{"Origin": []string{origin}}
+	}
+
+	// -------------------------------------------------------------------------
+	// A browser on another origin and a client without the subprotocol are
+	// refused before the upgrade.
+
+	if _, _, err := dialer.Dial(url, header("https://evil.example.com")); err == nil {
+		t.Fatal("Should not connect from an origin that is not allowed")
+	}
+
+	if n := m.count("handshake/" + chat.HandshakeOrigin); n != 1 {
+		t.Fatalf("Should count one refused origin, got %d", n)
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(url, header(origin)); err == nil {
+		t.Fatal("Should not connect without the subprotocol")
+	}
+
+	if n := m.count("handshake/" + chat.HandshakeSubprotocol); n != 1 {
+		t.Fatalf("Should count one missing subprotocol, got %d", n)
+	}
+
+	// -------------------------------------------------------------------------
+	// An allowed client gets the subprotocol and compression.
+
+	conn, resp, err := dialer.Dial(url, header(origin))
+	if err != nil {
+		t.Fatalf("Should be able to dial the cap: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if conn.Subprotocol() != subprotocol {
+		t.Fatalf("Should negotiate the %q subprotocol, got %q", subprotocol, conn.Subprotocol())
+	}
+
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Should negotiate compression, got %q", ext)
+	}
+
+	alice := newClient(t, "Alice")
+	alice.handshake(t, conn)
+
+	// -------------------------------------------------------------------------
+	// A frame larger than the limit is refused and the connection closed.
+
+	alice.sendChat(t, alice.id, 1, strings.Repeat("x", 2*maxSize))
+
+	var em protocol.ErrorMessage
+	alice.read(t, protocol.TypeError, &em)
+
+	if em.Code != errs.InvalidArgument {
+		t.Fatalf("Should get an %s error, got %s", errs.InvalidArgument, em.Code)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("Should be closed with code %d, got %v", websocket.CloseMessageTooBig, err)
+	}
+}
+
+// =============================================================================
+
+func startNATS(t *testing.T) *natsserver.Server {
+	t.Helper()
+
+	cfg := natsserver.Config{
+		Port:     -1,
+		StoreDir: t.TempDir(),
+	}
+
+	ns, err := natsserver.Start(cfg)
+	if err != nil {
+		t.Fatalf("Should be able to start nats: %s", err)
+	}
+	t.Cleanup(ns.Shutdown)
+
+	return ns
+}
+
+// startCap starts a cap connected to the nats server and returns the url
+// clients connect to.
+func startCap(t *testing.T, ns *natsserver.Server, newBus newBusFn, options ...func(cfg *chat.Config)) (string, *presence.Presence, *chat.Chat) {
+	t.Helper()
+
+	ctx := context.Background()
+	log := newLogger()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Should be able to connect to nats: %s", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Should be able to create jetstream: %s", err)
+	}
+
+	grps, err := groups.New(ctx, log, js, subject+"-groups")
+	if err != nil {
+		t.Fatalf("Should be able to create groups: %s", err)
+	}
+
+	prs, err := presence.New(ctx, log, js, subject+"-presence", 30*time.Second)
+	if err != nil {
+		t.Fatalf("Should be able to create presence: %s", err)
+	}
+
+	off, err := offline.New(ctx, log, js, subject+"-offline", time.Hour, 100)
+	if err != nil {
+		t.Fatalf("Should be able to create offline: %s", err)
+	}
+
+	nnc, err := nonces.New(ctx, log, js, subject+"-nonces")
+	if err != nil {
+		t.Fatalf("Should be able to create nonces: %s", err)
+	}
+
+	cfg := chat.Config{
+		Log:         log,
+		Bus:         newBus(t, js),
+		Subject:     subject,
+		CapID:       uuid.New(),
+		Users:       users.New(log),
+		Groups:      grps,
+		Presence:    prs,
+		Offline:     off,
+		Nonces:      nnc,
+		MaxFileSize: 1024 * 1024,
+	}
+
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	c, err := chat.New(cfg)
+	if err != nil {
+		t.Fatalf("Should be able to create chat: %s", err)
+	}
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		usr, err := c.Handshake(r.Context(), w, r)
+		if err != nil {
+			return
+		}
+		defer usr.Conn.Close()
+
+		c.ListenClient(r.Context(), usr)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), prs, c
+}
+
+// waitDisconnected waits for the cap to remove every user.
+func waitDisconnected(t *testing.T, c *chat.Chat) {
+	t.Helper()
+
+	for range 50 {
+		if len(c.Connections()) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Should remove every user, got %d", len(c.Connections()))
+}
+
+// newJS returns a jetstream connection to the nats server.
+func newJS(t *testing.T, ns *natsserver.Server) jetstream.JetStream {
+	t.Helper()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Should be able to connect to nats: %s", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Should be able to create jetstream: %s", err)
+	}
+
+	return js
+}
+
+// newLimiter returns a limiter backed by the nats server.
+func newLimiter(t *testing.T, ns *natsserver.Server) *limiter.Limiter {
+	t.Helper()
+
+	lmt, err := limiter.New(context.Background(), newLogger(), newJS(t, ns), subject+"-limits", time.Minute)
+	if err != nil {
+		t.Fatalf("Should be able to create the limiter: %s", err)
+	}
+
+	return lmt
+}
+
+func newLogger() *logger.Logger {
+	return logger.New(io.Discard, logger.LevelInfo, "TEST", func(context.Context) string { return "" })
+}
+
+func waitOnline(t *testing.T, prs *presence.Presence, id common.Address) {
+	t.Helper()
+
+	for range 50 {
+		if _, err := prs.Retrieve(context.Background(), id); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Should see %s online", id)
+}
+
+// =============================================================================
+
+// testMetrics counts what the cap records.
+type testMetrics struct {
+	mu        sync.Mutex
+	counts    map[string]int
+	connected int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counts: make(map[string]int),
+	}
+}
+
+func (m *testMetrics) inc(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[key]++
+}
+
+func (m *testMetrics) count(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counts[key]
+}
+
+func (m *testMetrics) connectedUsers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.connected
+}
+
+func (m *testMetrics) Connected(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connected = n
+}
+
+func (m *testMetrics) Handshake(result string)        { m.inc("handshake/" + result) }
+func (m *testMetrics) Routed(route string)            { m.inc("routed/" + route) }
+func (m *testMetrics) SignatureFailure(source string) { m.inc("signature/" + source) }
+func (m *testMetrics) BusPublish(d time.Duration)     { m.inc("publish") }
+func (m *testMetrics) PingTimeout()                   { m.inc("pingtimeout") }
+func (m *testMetrics) SlowConsumer()                  { m.inc("slowconsumer") }
+
+// =============================================================================
+
+type client struct {
+	name   string
+	id     common.Address
+	device string
+	pk     *ecdsa.PrivateKey
+	conn   *websocket.Conn
+	limits *protocol.Limits
+}
+
+func newClient(t *testing.T, name string) *client {
+	t.Helper()
+
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Should be able to generate a key: %s", err)
+	}
+
+	return &client{
+		name: name,
+		id:   crypto.PubkeyToAddress(pk.PublicKey),
+		pk:   pk,
+	}
+}
+
+// newDevice returns a client for another device of the same account.
+func (c *client) newDevice(device string) *client {
+	return &client{
+		name:   c.name,
+		id:     c.id,
+		device: device,
+		pk:     c.pk,
+	}
+}
+
+func (c *client) connect(t *testing.T, url string) {
+	t.Helper()
+
+	c.handshake(t, dial(t, url))
+}
+
+func (c *client) handshake(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	c.conn = conn
+
+	var chlg protocol.Challenge
+	c.read(t, protocol.TypeChallenge, &chlg)
+
+	hello := protocol.Hello{
+		ID:     c.id,
+		Name:   c.name,
+		Device: c.device,
+	}
+
+	hello.Signature = c.sign(t, hello.SignedData(chlg.Challenge))
+	writeFrame(t, c.conn, protocol.TypeHello, hello)
+
+	var welcome protocol.Welcome
+	c.read(t, protocol.TypeWelcome, &welcome)
+
+	c.limits = welcome.Limits
+}
+
+func (c *client) sendChat(t *testing.T, to common.Address, nonce uint64, msg string) {
+	t.Helper()
+
+	req := protocol.ChatRequest{
+		ToID:      to,
+		Msg:       msg,
+		FromNonce: nonce,
+	}
+
+	req.Signature = c.sign(t, req.SignedData())
+	writeFrame(t, c.conn, protocol.TypeChat, req)
+}
+
+func (c *client) sendFile(t *testing.T, to common.Address, nonce uint64, fc protocol.FileChunk) {
+	t.Helper()
+
+	req := protocol.FileRequest{
+		ToID:      to,
+		Chunk:     fc,
+		FromNonce: nonce,
+	}
+
+	req.Signature = c.sign(t, req.SignedData())
+	writeFrame(t, c.conn, protocol.TypeFile, req)
+}
+
+func (c *client) sendCommand(t *testing.T, to common.Address, nonce uint64, cmd protocol.Command) {
+	t.Helper()
+
+	req := protocol.CommandRequest{
+		ToID:      to,
+		Command:   cmd,
+		FromNonce: nonce,
+	}
+
+	req.Signature = c.sign(t, req.SignedData())
+	writeFrame(t, c.conn, protocol.TypeCommand, req)
+}
+
+func (c *client) sendPresence(t *testing.T, req protocol.PresenceRequest) {
+	t.Helper()
+
+	req.Signature = c.sign(t, req.SignedData())
+	writeFrame(t, c.conn, protocol.TypePresence, req)
+}
+
+func (c *client) sendDevice(t *testing.T, req protocol.DeviceRequest) {
+	t.Helper()
+
+	req.Signature = c.sign(t, req.SignedData())
+	writeFrame(t, c.conn, protocol.TypeDevice, req)
+}
+
+func (c *client) read(t *testing.T, typ protocol.Type, v any) {
+	t.Helper()
+
+	readFrame(t, c.conn, typ, v)
+}
+
+func (c *client) sign(t *testing.T, data any) protocol.Signature {
+	t.Helper()
+
+	v, r, s, err := signature.Sign(data, c.pk)
+	if err != nil {
+		t.Fatalf("Should be able to sign: %s", err)
+	}
+
+	return protocol.Signature{V: v, R: r, S: s}
+}
+
+// =============================================================================
+
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Should be able to dial the cap: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn, typ protocol.Type, v any) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Should be able to read a %s frame: %s", typ, err)
+	}
+
+	env, err := protocol.Decode(msg)
+	if err != nil {
+		t.Fatalf("Should be able to decode the frame: %s", err)
+	}
+
+	if env.Type != typ {
+		t.Fatalf("Should receive a %s frame, got %s: %s", typ, env.Type, env.Payload)
+	}
+
+	if err := env.Unmarshal(v); err != nil {
+		t.Fatalf("Should be able to unmarshal the %s frame: %s", typ, err)
+	}
+}
+
+func writeFrame(t *testing.T, conn *websocket.Conn, typ protocol.Type, payload any) {
+	t.Helper()
+
+	data, err := protocol.Encode(typ, payload)
+	if err != nil {
+		t.Fatalf("Should be able to encode a %s frame: %s", typ, err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("Should be able to write a %s frame: %s", typ, err)
+	}
+}
@@ -0,0 +1,29 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+)
+
+// Shutdown marks the cap as shutting down. The users already connected are
+// still served, but the cap reports it is not ready for new ones.
+func (c *Chat) Shutdown() {
+	c.shutdown.Store(true)
+}
+
+// ShuttingDown reports whether the cap is shutting down.
+func (c *Chat) ShuttingDown() bool {
+	return c.shutdown.Load()
+}
+
+// CheckPing returns an error if the loop pinging the users has not completed
+// a round recently, which means the connections are no longer maintained.
+func (c *Chat) CheckPing() error {
+	last := time.Unix(0, c.lastTick.Load())
+
+	if since := time.Since(last); since > 2*c.pingEvery {
+		return fmt.Errorf("ping loop last completed %s ago", since.Round(time.Second))
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Set of defaults used when the outbound settings are not provided.
+const (
+	defaultQueueSize    = 256
+	defaultWriteTimeout = 10 * time.Second
+	defaultPingInterval = 10 * time.Second
+)
+
+// Conn represents the websocket connection of a user's device. A websocket
+// connection supports one writer at a time, so frames are queued and written
+// by a single goroutine owned by the connection. A client that doesn't read
+// its frames fast enough fills the queue and is disconnected. Frames are read
+// by a single reader, the handshake and then the client's listen loop, using
+// read deadlines so a read never outlives its caller. Frames sent while the
+// handshake completes are held so they don't overtake the welcome and the
+// messages stored while the user was offline.
+type Conn struct {
+	ws           *websocket.Conn
+	writeTimeout time.Duration
+	readLimit    int64
+	canceled     atomic.Bool
+	queue        chan []byte
+	closing      chan struct{}
+	closeOnce    sync.Once
+	closeMsg     []byte
+	done         chan struct{}
+	mu           sync.Mutex
+	holding      bool
+	held         [][]byte
+}
+
+func newConn(ws *websocket.Conn, out Outbound, readLimit int64) *Conn {
+	c := Conn{
+		ws:           ws,
+		writeTimeout: out.WriteTimeout,
+		readLimit:    readLimit,
+		queue:        make(chan []byte, out.QueueSize),
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	go c.writer()
+
+	return &c
+}
+
+// RemoteAddr returns the address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// Close closes the connection once the frames already queued are written.
+// It waits for the writer to stop, which takes at most the write timeout
+// when the client stopped reading.
+func (c *Conn) Close() error {
+	c.shutdown(nil)
+	<-c.done
+
+	return nil
+}
+
+// =============================================================================
+
+// read reads the next frame from the client, waiting at most the specified
+// timeout. The context's error is returned when the read ended because the
+// context was canceled, ErrMessageTooBig when the frame is larger than the
+// read limit. The connection can't be read again after an error.
+func (c *Conn) read(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if err := c.extendRead(timeout); err != nil {
+		return nil, err
+	}
+
+	// The deadline is set before the context is checked, so a cancel that
+	// happened in between isn't lost.
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.readFrame()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// readFrame reads the next frame. No more than the read limit is read, so
+// the client can be told why its frame was refused before the connection is
+// closed.
+func (c *Conn) readFrame() ([]byte, error) {
+	_, r, err := c.ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.readLimit > 0 {
+		r = io.LimitReader(r, c.readLimit+1)
+	}
+
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.readLimit > 0 && int64(len(msg)) > c.readLimit {
+		return nil, ErrMessageTooBig
+	}
+
+	return msg, nil
+}
+
+// extendRead moves the read deadline the specified timeout away, unless the
+// read was canceled.
+func (c *Conn) extendRead(timeout time.Duration) error {
+	if c.canceled.Load() {
+		return nil
+	}
+
+	if err := c.ws.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	// The read may have been canceled while the deadline was moved.
+
+	if c.canceled.Load() {
+		return c.ws.SetReadDeadline(time.Now())
+	}
+
+	return nil
+}
+
+// watch ends the read in progress, and the ones that follow, once the context
+// is canceled. The returned function stops watching the context.
+func (c *Conn) watch(ctx context.Context) (stop func() bool) {
+	f := func() {
+		c.canceled.Store(true)
+		c.ws.SetReadDeadline(time.Now())
+	}
+
+	return context.AfterFunc(ctx, f)
+}
+
+// isTimeout reports whether a read or a write failed because its deadline
+// passed.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// send queues the frame for the writer, or keeps it until release is called
+// when frames are held. It returns ErrSlowConsumer the first time the queue is
+// found full, the connection is then closed. It returns ErrConnClosed once the
+// connection is closing.
+func (c *Conn) send(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.holding {
+		return c.enqueue(data)
+	}
+
+	select {
+	case <-c.closing:
+		return ErrConnClosed
+	default:
+	}
+
+	if len(c.held) >= cap(c.queue) {
+		return c.slowConsumer()
+	}
+
+	c.held = append(c.held, data)
+
+	return nil
+}
+
+// sendFirst queues the frame for the writer ahead of the frames being held.
+func (c *Conn) sendFirst(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.enqueue(data)
+}
+
+// hold keeps the frames sent from now on until release is called.
+func (c *Conn) hold() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holding = true
+}
+
+// release queues the frames held since hold was called, the frames sent after
+// that are queued right away again.
+func (c *Conn) release() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	held := c.held
+	c.holding = false
+	c.held = nil
+
+	select {
+	case <-c.closing:
+		return ErrConnClosed
+	default:
+	}
+
+	for _, data := range held {
+		if err := c.enqueue(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enqueue hands the frame to the writer without waiting for room in the
+// queue.
+func (c *Conn) enqueue(data []byte) error {
+	select {
+	case <-c.closing:
+		return ErrConnClosed
+	default:
+	}
+
+	select {
+	case c.queue <- data:
+		return nil
+	default:
+	}
+
+	return c.slowConsumer()
+}
+
+// slowConsumer closes the connection of a client that doesn't read its frames
+// fast enough.
+func (c *Conn) slowConsumer() error {
+	msg := websocket.FormatCloseMessage(protocol.CloseSlowConsumer, "too slow reading messages")
+	if !c.shutdown(msg) {
+		return ErrConnClosed
+	}
+
+	return ErrSlowConsumer
+}
+
+// closeWith closes the connection with the specified close frame once the
+// frames already queued are written. It doesn't wait for the writer.
+func (c *Conn) closeWith(code int, reason string) {
+	c.shutdown(websocket.FormatCloseMessage(code, reason))
+}
+
+// ping writes a ping control frame. Control frames can be written at the same
+// time as the writer writes a frame.
+func (c *Conn) ping() error {
+	return c.ws.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(c.writeTimeout))
+}
+
+// shutdown tells the writer to stop and reports whether this call did it.
+// The close frame is written last when one is specified.
+func (c *Conn) shutdown(closeMsg []byte) bool {
+	var first bool
+
+	c.closeOnce.Do(func() {
+		c.closeMsg = closeMsg
+		close(c.closing)
+		first = true
+	})
+
+	return first
+}
+
+// writer writes the queued frames until the connection is closed or a write
+// fails. A write that doesn't complete within the write timeout fails.
+func (c *Conn) writer() {
+	defer close(c.done)
+	defer c.ws.Close()
+
+	for {
+		select {
+		case data := <-c.queue:
+			if err := c.write(data); err != nil {
+				c.shutdown(nil)
+				return
+			}
+
+		case <-c.closing:
+			if !c.flush() {
+				return
+			}
+
+			if c.closeMsg != nil {
+				c.ws.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(c.writeTimeout))
+			}
+
+			return
+		}
+	}
+}
+
+// flush writes the frames left in the queue and reports whether they were
+// all written.
+func (c *Conn) flush() bool {
+	for {
+		select {
+		case data := <-c.queue:
+			if err := c.write(data); err != nil {
+				return false
+			}
+
+		default:
+			return true
+		}
+	}
+}
+
+func (c *Conn) write(data []byte) error {
+	if err := c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// maxDeviceLen is the longest device id a client can pick.
+const maxDeviceLen = 64
+
+// validDevice reports whether the device id can be used. Device ids are part
+// of the keys the cap stores, so only letters, digits, dashes and underscores
+// are accepted. No device means the client predates devices.
+func validDevice(device string) bool {
+	if len(device) > maxDeviceLen {
+		return false
+	}
+
+	f := func(r rune) bool {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return false
+		case r == '-', r == '_':
+			return false
+		}
+		return true
+	}
+
+	return strings.IndexFunc(device, f) == -1
+}
+
+// deviceRequest lists the devices of the user's account that are connected or
+// disconnects one of them. A device connected to a different cap is
+// disconnected by that cap, which verifies the request again.
+func (c *Chat) deviceRequest(ctx context.Context, from User, inMsg incomingMessage) error {
+	req := *inMsg.Device
+
+	devices, err := c.presence.Retrieve(ctx, from.ID)
+	if err != nil {
+		return fmt.Errorf("retrieve: %w", err)
+	}
+
+	switch req.Action {
+	case protocol.DeviceList:
+		dm := protocol.DevicesMessage{
+			Devices: make([]protocol.Device, 0, len(devices)),
+		}
+
+		for device := range devices {
+			d := protocol.Device{
+				ID:      device,
+				Current: device == from.Device,
+			}
+
+			dm.Devices = append(dm.Devices, d)
+		}
+
+		slices.SortFunc(dm.Devices, func(a, b protocol.Device) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+
+		m := outgoingMessage{
+			Type:    protocol.TypeDevice,
+			Payload: dm,
+		}
+
+		if err := c.writeMessage(ctx, from, m); err != nil {
+			return fmt.Errorf("write devices: %w", err)
+		}
+
+		return nil
+
+	case protocol.DeviceRevoke:
+		if req.Device == from.Device {
+			return errors.New("the device in use can't be revoked")
+		}
+
+		capID, exists := devices[req.Device]
+		if !exists {
+			return fmt.Errorf("device %q: %w", req.Device, ErrNotExists)
+		}
+
+		if capID == c.capID {
+			return c.revokeLocal(ctx, Session{ID: from.ID, Device: req.Device})
+		}
+
+		if err := c.sendMessageCap(ctx, capID, from, inMsg); err != nil {
+			return fmt.Errorf("bussend: %w", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown device action %q", req.Action)
+}
+
+// revokeLocal closes the connection of the user's device connected to this
+// cap. The client is told not to connect again on its own.
+func (c *Chat) revokeLocal(ctx context.Context, s Session) error {
+	conn, exists := c.users.Connections()[s]
+	if !exists {
+		return fmt.Errorf("device %q: %w", s.Device, ErrNotExists)
+	}
+
+	c.closeConn(conn.Conn, protocol.CloseRevoked, "device revoked by another device")
+
+	c.log.Info(ctx, "chat-revoke", "id", s.ID, "device", s.Device)
+
+	return nil
+}
+
+// =============================================================================
+
+// mirror tells the sender's other devices about a chat message one of them
+// sent, wherever they are connected. Mirrors are not stored for devices that
+// are not connected.
+func (c *Chat) mirror(ctx context.Context, from User, inMsg incomingMessage, grp *protocol.Group) {
+	if inMsg.Type != protocol.TypeChat {
+		return
+	}
+
+	c.mirrorLocal(ctx, from, inMsg, grp)
+
+	rt := c.locate(ctx, []common.Address{from.ID})
+
+	subjects := make([]string, 0, len(rt.caps))
+	for _, capID := range rt.caps {
+		subjects = append(subjects, capSubject(c.subject, capID))
+	}
+
+	if rt.broadcast {
+		subjects = []string{c.subject}
+	}
+
+	if len(subjects) == 0 {
+		return
+	}
+
+	busMsg := busMessage{
+		CapID:           c.capID,
+		FromID:          from.ID,
+		FromName:        from.Name,
+		FromDevice:      from.Device,
+		Mirror:          true,
+		incomingMessage: inMsg,
+	}
+
+	d, err := json.Marshal(busMsg)
+	if err != nil {
+		c.log.Info(ctx, "chat-mirror", "ERROR", err)
+		return
+	}
+
+	for _, subject := range subjects {
+		if err := c.busPublish(ctx, subject, d); err != nil {
+			c.log.Info(ctx, "chat-mirror", "subject", subject, "ERROR", err)
+		}
+	}
+}
+
+// mirrorLocal writes the mirror of the message to the sender's other devices
+// connected to this cap.
+func (c *Chat) mirrorLocal(ctx context.Context, from User, inMsg incomingMessage, grp *protocol.Group) {
+	devices, err := c.users.Retrieve(ctx, from.ID)
+	if err != nil {
+		if !errors.Is(err, ErrNotExists) {
+			c.log.Info(ctx, "chat-mirror", "id", from.ID, "ERROR", err)
+		}
+		return
+	}
+
+	devices = slices.DeleteFunc(devices, func(usr User) bool {
+		return usr.Device == from.Device
+	})
+
+	m := outgoingMessage{
+		Type: protocol.TypeSent,
+		Payload: protocol.SentMessage{
+			Device:    from.Device,
+			ToID:      inMsg.ToID,
+			Msg:       inMsg.Msg,
+			Encrypted: inMsg.Encrypted,
+			Nonce:     inMsg.FromNonce,
+			Group:     grp,
+		},
+	}
+
+	c.writeDevices(ctx, devices, m)
+}
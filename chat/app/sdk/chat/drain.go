@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+)
+
+// Drain moves the users connected to this cap to other caps and stops the
+// cap's background work. New handshakes are refused, every connected device
+// is closed with a reason telling the client to connect again, and the cap
+// waits for the devices to be removed. Bus messages already handed to the cap
+// are then handled before the subscription and the ping loop are stopped.
+// Messages for users that left are kept in the offline store until they
+// connect again.
+func (c *Chat) Drain(ctx context.Context) error {
+	c.shutdown.Store(true)
+
+	c.log.Info(ctx, "chat-drain", "status", "closing connections", "users", len(c.users.Connections()))
+
+	// A handshake in progress when the drain started adds its user later, so
+	// the connections are checked until none are left.
+
+	const reason = "cap shutting down, connect again"
+	const checkEvery = 50 * time.Millisecond
+
+	closed := make(map[Session]bool)
+
+	var err error
+
+	for {
+		conns := c.users.Connections()
+		if len(conns) == 0 {
+			break
+		}
+
+		for s, conn := range conns {
+			if closed[s] {
+				continue
+			}
+
+			c.closeConn(conn.Conn, protocol.CloseReconnect, reason)
+			closed[s] = true
+		}
+
+		select {
+		case <-time.After(checkEvery):
+			continue
+
+		case <-ctx.Done():
+			err = fmt.Errorf("waiting on %d users: %w", len(conns), ctx.Err())
+		}
+
+		break
+	}
+
+	c.log.Info(ctx, "chat-drain", "status", "draining bus")
+
+	if berr := c.bus.Drain(ctx, c.capID.String()); berr != nil && err == nil {
+		err = fmt.Errorf("bus drain: %w", berr)
+	}
+
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+
+	c.log.Info(ctx, "chat-drain", "status", "complete", "users", len(closed))
+
+	return err
+}
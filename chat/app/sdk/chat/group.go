@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// groupCommand executes the group management command sent by the client and
+// notifies every affected member.
+func (c *Chat) groupCommand(ctx context.Context, from User, inMsg incomingMessage) error {
+	cmd := *inMsg.Command
+
+	var grp Group
+	var err error
+
+	switch cmd.Action {
+	case protocol.ActionGroupCreate:
+		if cmd.Name == "" {
+			return errors.New("group name cannot be empty")
+		}
+
+		grp = Group{
+			ID:      cmd.GroupID,
+			Name:    cmd.Name,
+			OwnerID: from.ID,
+			Members: []common.Address{from.ID},
+		}
+
+		err = c.groups.Create(ctx, grp)
+
+	case protocol.ActionGroupInvite:
+		grp, err = c.groups.Retrieve(ctx, cmd.GroupID)
+		if err != nil {
+			return fmt.Errorf("retrieve: %w", err)
+		}
+
+		if !grp.IsMember(from.ID) {
+			return ErrNotMember
+		}
+
+		grp, err = c.groups.AddMember(ctx, cmd.GroupID, cmd.MemberID)
+
+	case protocol.ActionGroupRemove:
+		grp, err = c.groups.Retrieve(ctx, cmd.GroupID)
+		if err != nil {
+			return fmt.Errorf("retrieve: %w", err)
+		}
+
+		// Members can remove themselves, only the owner can remove others.
+		if from.ID != cmd.MemberID && from.ID != grp.OwnerID {
+			return fmt.Errorf("only the owner can remove members")
+		}
+
+		grp, err = c.groups.RemoveMember(ctx, cmd.GroupID, cmd.MemberID)
+
+	default:
+		return fmt.Errorf("unknown group action %q", cmd.Action)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", cmd.Action, err)
+	}
+
+	c.log.Info(ctx, "LOC: group command", "action", cmd.Action, "from", from.ID, "group", grp.ID, "member", cmd.MemberID)
+
+	// -------------------------------------------------------------------------
+
+	m := groupNotice(from, grp, cmd)
+
+	// Notices are not stored for members that are offline, they learn about
+	// the group from the next message sent to it.
+
+	recipients := groupRecipients(grp, cmd)
+
+	c.sendLocal(ctx, common.Address{}, recipients, m)
+
+	if rt := c.locate(ctx, recipients); len(rt.caps) > 0 || rt.broadcast {
+		if err := c.sendRoute(ctx, from, inMsg, rt); err != nil {
+			return fmt.Errorf("bussend: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// groupNotifyBus notifies the local members affected by a group command that
+// was executed on a different cap.
+func (c *Chat) groupNotifyBus(ctx context.Context, from User, cmd protocol.Command) {
+	grp, err := c.groups.Retrieve(ctx, cmd.GroupID)
+	if err != nil {
+		c.log.Info(ctx, "bus-groupretrieve", "ERROR", err)
+		return
+	}
+
+	c.sendLocal(ctx, common.Address{}, groupRecipients(grp, cmd), groupNotice(from, grp, cmd))
+
+	c.log.Info(ctx, "BUS: group notice sent over web socket", "from", from.ID, "group", grp.ID, "action", cmd.Action)
+}
+
+// sendGroupMessage sends the message to every member of the group connected
+// to this cap. The other members are handled by sendRemote and the sender's
+// other devices get a mirror.
+func (c *Chat) sendGroupMessage(ctx context.Context, from User, grp Group, inMsg incomingMessage) error {
+	if inMsg.Type != protocol.TypeChat {
+		return fmt.Errorf("only chat messages can be sent to a group")
+	}
+
+	if !grp.IsMember(from.ID) {
+		return ErrNotMember
+	}
+
+	og := newOutgoingGroup(grp)
+
+	local := c.sendLocal(ctx, from.ID, grp.Members, newOutgoingMessage(from, inMsg, og))
+	if len(local) > 0 {
+		c.metrics.Routed(RouteLocal)
+	}
+
+	c.mirror(ctx, from, inMsg, og)
+
+	others := slices.DeleteFunc(slices.Clone(grp.Members), func(id common.Address) bool {
+		return id == from.ID
+	})
+
+	if len(others) > 0 {
+		if status := c.sendRemote(ctx, from, inMsg, others, local); status == protocol.StatusFailed {
+			return fmt.Errorf("unable to reach every member")
+		}
+	}
+
+	c.log.Info(ctx, "LOC: group msg sent over web socket", "from", from.ID, "group", grp.ID)
+
+	return nil
+}
+
+// sendLocal writes the message to every device of the recipients connected
+// to this cap, skipping the sender. It returns the recipients the message was
+// written to. Their devices connected to a different cap are not handled.
+func (c *Chat) sendLocal(ctx context.Context, fromID common.Address, recipients []common.Address, m outgoingMessage) []common.Address {
+	var local []common.Address
+
+	for _, id := range recipients {
+		if id == fromID {
+			continue
+		}
+
+		devices, err := c.users.Retrieve(ctx, id)
+		if err != nil {
+			if !errors.Is(err, ErrNotExists) {
+				c.log.Info(ctx, "chat-sendlocal", "id", id, "ERROR", err)
+			}
+			continue
+		}
+
+		if c.writeDevices(ctx, devices, m) > 0 {
+			local = append(local, id)
+		}
+	}
+
+	return local
+}
+
+// =============================================================================
+
+func newOutgoingGroup(grp Group) *protocol.Group {
+	return &protocol.Group{
+		ID:      grp.ID,
+		Name:    grp.Name,
+		Members: grp.Members,
+	}
+}
+
+// groupRecipients returns the users that must be told about the command. A
+// removed member is no longer part of the group but still needs to know.
+func groupRecipients(grp Group, cmd protocol.Command) []common.Address {
+	if cmd.Action == protocol.ActionGroupRemove && !slices.Contains(grp.Members, cmd.MemberID) {
+		return append(slices.Clone(grp.Members), cmd.MemberID)
+	}
+
+	return grp.Members
+}
+
+func groupNotice(from User, grp Group, cmd protocol.Command) outgoingMessage {
+	var msg string
+
+	switch cmd.Action {
+	case protocol.ActionGroupCreate:
+		msg = fmt.Sprintf("** %s created the group **", from.Name)
+
+	case protocol.ActionGroupInvite:
+		msg = fmt.Sprintf("** %s invited %s **", from.Name, cmd.MemberID.Hex())
+
+	case protocol.ActionGroupRemove:
+		msg = fmt.Sprintf("** %s removed %s **", from.Name, cmd.MemberID.Hex())
+		if from.ID == cmd.MemberID {
+			msg = fmt.Sprintf("** %s left the group **", from.Name)
+		}
+	}
+
+	return outgoingMessage{
+		Type: protocol.TypeChat,
+		Payload: protocol.ChatMessage{
+			From: protocol.From{
+				ID:   from.ID,
+				Name: from.Name,
+			},
+			Msg:   msg,
+			Group: newOutgoingGroup(grp),
+		},
+	}
+}
@@ -0,0 +1,168 @@
+// Package groups provides group storage management backed by a JetStream
+// key/value bucket so every cap sees the same membership.
+package groups
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// maxRetries is the number of times an update is retried when another cap
+// changed the group at the same time.
+const maxRetries = 5
+
+// Groups provides group storage management.
+type Groups struct {
+	log *logger.Logger
+	kv  jetstream.KeyValue
+}
+
+// New creates a new group storage using the specified bucket.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, bucket string) (*Groups, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	g := Groups{
+		log: log,
+		kv:  kv,
+	}
+
+	return &g, nil
+}
+
+// Create adds a new group to the storage.
+func (g *Groups) Create(ctx context.Context, grp chat.Group) error {
+	data, err := json.Marshal(grp)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if _, err := g.kv.Create(ctx, grp.ID.Hex(), data); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chat.ErrGroupExists
+		}
+		return fmt.Errorf("create: %w", err)
+	}
+
+	g.log.Debug(ctx, "chat-creategroup", "name", grp.Name, "id", grp.ID, "owner", grp.OwnerID)
+
+	return nil
+}
+
+// AddMember adds the user to the specified group.
+func (g *Groups) AddMember(ctx context.Context, groupID common.Address, userID common.Address) (chat.Group, error) {
+	f := func(grp chat.Group) (chat.Group, error) {
+		if grp.IsMember(userID) {
+			return chat.Group{}, chat.ErrExists
+		}
+
+		grp.Members = append(grp.Members, userID)
+
+		return grp, nil
+	}
+
+	grp, err := g.update(ctx, groupID, f)
+	if err != nil {
+		return chat.Group{}, err
+	}
+
+	g.log.Debug(ctx, "chat-addmember", "group", groupID, "id", userID)
+
+	return grp, nil
+}
+
+// RemoveMember removes the user from the specified group.
+func (g *Groups) RemoveMember(ctx context.Context, groupID common.Address, userID common.Address) (chat.Group, error) {
+	f := func(grp chat.Group) (chat.Group, error) {
+		idx := slices.Index(grp.Members, userID)
+		if idx == -1 {
+			return chat.Group{}, chat.ErrNotMember
+		}
+
+		grp.Members = slices.Delete(grp.Members, idx, idx+1)
+
+		return grp, nil
+	}
+
+	grp, err := g.update(ctx, groupID, f)
+	if err != nil {
+		return chat.Group{}, err
+	}
+
+	g.log.Debug(ctx, "chat-removemember", "group", groupID, "id", userID)
+
+	return grp, nil
+}
+
+// Retrieve retrieves a group from the storage.
+func (g *Groups) Retrieve(ctx context.Context, groupID common.Address) (chat.Group, error) {
+	grp, _, err := g.get(ctx, groupID)
+	if err != nil {
+		return chat.Group{}, err
+	}
+
+	return grp, nil
+}
+
+// =============================================================================
+
+func (g *Groups) get(ctx context.Context, groupID common.Address) (chat.Group, uint64, error) {
+	entry, err := g.kv.Get(ctx, groupID.Hex())
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return chat.Group{}, 0, chat.ErrGroupNotExists
+		}
+		return chat.Group{}, 0, fmt.Errorf("get: %w", err)
+	}
+
+	var grp chat.Group
+	if err := json.Unmarshal(entry.Value(), &grp); err != nil {
+		return chat.Group{}, 0, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return grp, entry.Revision(), nil
+}
+
+// update applies the change to the latest version of the group. If another
+// cap changed the group in the meantime, the change is applied again.
+func (g *Groups) update(ctx context.Context, groupID common.Address, change func(grp chat.Group) (chat.Group, error)) (chat.Group, error) {
+	for range maxRetries {
+		grp, revision, err := g.get(ctx, groupID)
+		if err != nil {
+			return chat.Group{}, err
+		}
+
+		grp, err = change(grp)
+		if err != nil {
+			return chat.Group{}, err
+		}
+
+		data, err := json.Marshal(grp)
+		if err != nil {
+			return chat.Group{}, fmt.Errorf("marshal: %w", err)
+		}
+
+		if _, err := g.kv.Update(ctx, groupID.Hex(), data, revision); err != nil {
+			if errors.Is(err, jetstream.ErrKeyExists) {
+				continue
+			}
+			return chat.Group{}, fmt.Errorf("update: %w", err)
+		}
+
+		return grp, nil
+	}
+
+	return chat.Group{}, fmt.Errorf("update: too many concurrent changes to group %s", groupID)
+}
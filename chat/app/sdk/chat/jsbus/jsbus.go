@@ -0,0 +1,143 @@
+// Package jsbus provides a bus implementation backed by a JetStream stream.
+package jsbus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Bus manages the stream the caps exchange messages on.
+type Bus struct {
+	log       *logger.Logger
+	js        jetstream.JetStream
+	stream    jetstream.Stream
+	mu        sync.Mutex
+	consumers map[string]jetstream.ConsumeContext
+}
+
+// New constructs a bus on a stream with the specified name. The stream
+// captures the subject with the same name and every subject below it.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, name string) (*Bus, error) {
+	s, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     name,
+		Subjects: []string{name, name + ".>"},
+		MaxAge:   24 * time.Hour,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create stream: %w", err)
+	}
+
+	b := Bus{
+		log:       log,
+		js:        js,
+		stream:    s,
+		consumers: make(map[string]jetstream.ConsumeContext),
+	}
+
+	return &b, nil
+}
+
+// Publish adds the message to the stream.
+func (b *Bus) Publish(ctx context.Context, subject string, data []byte) error {
+	if _, err := b.js.Publish(ctx, subject, data); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+
+	return nil
+}
+
+// Subscribe creates a durable consumer with the specified name that receives
+// the new messages published on the subjects, one at a time.
+func (b *Bus) Subscribe(ctx context.Context, name string, subjects []string, handler func(msg chat.BusMessage)) error {
+	c, err := b.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:        name,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+		FilterSubjects: subjects,
+	})
+	if err != nil {
+		return fmt.Errorf("create consumer: %w", err)
+	}
+
+	f := func(msg jetstream.Msg) {
+		handler(msg)
+	}
+
+	cc, err := c.Consume(f, jetstream.PullMaxMessages(1))
+	if err != nil {
+		return fmt.Errorf("consume: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if old, exists := b.consumers[name]; exists {
+		old.Stop()
+	}
+
+	b.consumers[name] = cc
+
+	return nil
+}
+
+// Drain stops pulling messages for the consumer with the specified name and
+// waits for the handler to finish with the messages already pulled. The
+// messages that were not acknowledged stay with the durable consumer.
+func (b *Bus) Drain(ctx context.Context, name string) error {
+	b.mu.Lock()
+	cc, exists := b.consumers[name]
+	delete(b.consumers, name)
+	b.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("consumer %q not found", name)
+	}
+
+	cc.Drain()
+
+	select {
+	case <-cc.Closed():
+		return nil
+
+	case <-ctx.Done():
+		cc.Stop()
+		return ctx.Err()
+	}
+}
+
+// Info returns the state of the stream and of the consumer with the specified
+// name.
+func (b *Bus) Info(ctx context.Context, name string) (chat.BusInfo, error) {
+	si, err := b.stream.Info(ctx)
+	if err != nil {
+		return chat.BusInfo{}, fmt.Errorf("stream info: %w", err)
+	}
+
+	c, err := b.stream.Consumer(ctx, name)
+	if err != nil {
+		return chat.BusInfo{}, fmt.Errorf("consumer: %w", err)
+	}
+
+	ci, err := c.Info(ctx)
+	if err != nil {
+		return chat.BusInfo{}, fmt.Errorf("consumer info: %w", err)
+	}
+
+	info := chat.BusInfo{
+		Stream:      si.Config.Name,
+		Messages:    si.State.Msgs,
+		Bytes:       si.State.Bytes,
+		Consumer:    ci.Name,
+		Pending:     ci.NumPending,
+		AckPending:  ci.NumAckPending,
+		Redelivered: ci.NumRedelivered,
+	}
+
+	return info, nil
+}
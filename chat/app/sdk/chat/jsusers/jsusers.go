@@ -0,0 +1,208 @@
+// Package jsusers provides user storage shared by every cap, using a
+// JetStream key/value bucket. Each device of a user can only be connected to
+// one cap at a time across the cluster, the devices of a user can be spread
+// over several caps. The sockets themselves stay with the cap that owns them.
+package jsusers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/users"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// entry represents what is stored for a connected device.
+type entry struct {
+	CapID    uuid.UUID `json:"capID"`
+	Name     string    `json:"name"`
+	LastPong time.Time `json:"lastPong"`
+}
+
+// Users provides user storage management.
+type Users struct {
+	log   *logger.Logger
+	kv    jetstream.KeyValue
+	capID uuid.UUID
+	local *users.Users
+}
+
+// New creates a new user storage using the specified bucket for the cap with
+// the specified id. Entries are refreshed every time the user answers a ping
+// and expire when they are not refreshed within the ttl, so the users of a cap
+// that died can connect to another cap.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, bucket string, capID uuid.UUID, ttl time.Duration) (*Users, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+		TTL:    ttl,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	u := Users{
+		log:   log,
+		kv:    kv,
+		capID: capID,
+		local: users.New(log),
+	}
+
+	return &u, nil
+}
+
+// Add claims the user's device for this cap and adds it to the local storage.
+// It returns chat.ErrExists when the device is connected to any cap. An entry
+// left by this cap before it restarted is claimed again.
+func (u *Users) Add(ctx context.Context, usr chat.User) error {
+	data, err := json.Marshal(entry{CapID: u.capID, Name: usr.Name, LastPong: usr.LastPong})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	key := sessionKey(usr.Session())
+
+	if _, err := u.kv.Create(ctx, key, data); err != nil {
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return fmt.Errorf("create: %w", err)
+		}
+
+		if err := u.claim(ctx, usr.Session(), data); err != nil {
+			return err
+		}
+	}
+
+	if err := u.local.Add(ctx, usr); err != nil {
+		return err
+	}
+
+	u.log.Debug(ctx, "chat-adduser", "status", "claimed", "id", usr.ID, "device", usr.Device, "capID", u.capID)
+
+	return nil
+}
+
+// UpdateLastPing updates a user device's ping date/time.
+func (u *Users) UpdateLastPing(ctx context.Context, s chat.Session) error {
+	return u.local.UpdateLastPing(ctx, s)
+}
+
+// UpdateLastPong updates a user device's pong date/time and refreshes the
+// device's entry so it doesn't expire.
+func (u *Users) UpdateLastPong(ctx context.Context, s chat.Session) (chat.User, error) {
+	usr, err := u.local.UpdateLastPong(ctx, s)
+	if err != nil {
+		return chat.User{}, err
+	}
+
+	data, err := json.Marshal(entry{CapID: u.capID, Name: usr.Name, LastPong: usr.LastPong})
+	if err != nil {
+		return chat.User{}, fmt.Errorf("marshal: %w", err)
+	}
+
+	if _, err := u.kv.Put(ctx, sessionKey(s), data); err != nil {
+		return chat.User{}, fmt.Errorf("put: %w", err)
+	}
+
+	return usr, nil
+}
+
+// Remove removes a user's device from the local storage and releases the
+// device's entry if this cap still owns it.
+func (u *Users) Remove(ctx context.Context, s chat.Session) {
+	u.local.Remove(ctx, s)
+
+	key := sessionKey(s)
+
+	kve, err := u.kv.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, jetstream.ErrKeyNotFound) {
+			u.log.Info(ctx, "chat-removeuser", "id", s.ID, "device", s.Device, "ERROR", err)
+		}
+		return
+	}
+
+	var e entry
+	if err := json.Unmarshal(kve.Value(), &e); err != nil {
+		u.log.Info(ctx, "chat-removeuser", "id", s.ID, "device", s.Device, "ERROR", err)
+		return
+	}
+
+	if e.CapID != u.capID {
+		return
+	}
+
+	if err := u.kv.Delete(ctx, key, jetstream.LastRevision(kve.Revision())); err != nil {
+		u.log.Info(ctx, "chat-removeuser", "id", s.ID, "device", s.Device, "ERROR", err)
+	}
+}
+
+// Connections returns the devices connected to this cap with their
+// connections. A connection that is not valid shouldn't be used.
+func (u *Users) Connections() map[chat.Session]chat.Connection {
+	return u.local.Connections()
+}
+
+// Retrieve retrieves the devices of a user connected to this cap. Devices
+// connected to other caps are left out since their sockets are not here.
+func (u *Users) Retrieve(ctx context.Context, userID common.Address) ([]chat.User, error) {
+	return u.local.Retrieve(ctx, userID)
+}
+
+// =============================================================================
+
+// claim replaces an existing entry if it was left by this cap.
+func (u *Users) claim(ctx context.Context, s chat.Session, data []byte) error {
+	key := sessionKey(s)
+
+	kve, err := u.kv.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return fmt.Errorf("get: %w", err)
+		}
+
+		// The other cap released the user in the meantime.
+		if _, err := u.kv.Create(ctx, key, data); err != nil {
+			return chat.ErrExists
+		}
+
+		return nil
+	}
+
+	var e entry
+	if err := json.Unmarshal(kve.Value(), &e); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	if e.CapID != u.capID {
+		return chat.ErrExists
+	}
+
+	if _, exists := u.local.Connections()[s]; exists {
+		return chat.ErrExists
+	}
+
+	if _, err := u.kv.Update(ctx, key, data, kve.Revision()); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return chat.ErrExists
+		}
+		return fmt.Errorf("update: %w", err)
+	}
+
+	return nil
+}
+
+// sessionKey returns the key of the device's entry. Clients that don't send a
+// device keep the key used before devices existed.
+func sessionKey(s chat.Session) string {
+	if s.Device == "" {
+		return s.ID.Hex()
+	}
+
+	return s.ID.Hex() + "." + s.Device
+}
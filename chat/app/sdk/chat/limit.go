@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"golang.org/x/time/rate"
+)
+
+// nopLimiter is used when no limiter is configured.
+type nopLimiter struct{}
+
+func (nopLimiter) Take(context.Context, string, Limit, int) error { return nil }
+
+// =============================================================================
+
+// allowFrame takes a message and the size of the frame from the user's
+// buckets. The cap keeps serving users when the limiter storage fails.
+func (c *Chat) allowFrame(ctx context.Context, from User, size int) error {
+	if err := c.take(ctx, "messages."+from.ID.Hex(), c.limits.Messages, 1); err != nil {
+		return err
+	}
+
+	return c.take(ctx, "bytes."+from.ID.Hex(), c.limits.Bytes, size)
+}
+
+// allowHandshake takes a handshake from the bucket of the remote IP.
+func (c *Chat) allowHandshake(ctx context.Context, r *http.Request) error {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return c.take(ctx, "handshakes."+ip, c.limits.Handshakes, 1)
+}
+
+// frameLimits returns the limits the user's frames are taken from, so the
+// client can pace its frames. Nothing is returned when frames are not limited.
+func (c *Chat) frameLimits() *protocol.Limits {
+	if c.limits.Messages.Burst <= 0 && c.limits.Bytes.Burst <= 0 {
+		return nil
+	}
+
+	l := protocol.Limits{
+		MessageRate:  c.limits.Messages.Rate,
+		MessageBurst: max(c.limits.Messages.Burst, 0),
+		ByteRate:     c.limits.Bytes.Rate,
+		ByteBurst:    max(c.limits.Bytes.Burst, 0),
+	}
+
+	return &l
+}
+
+func (c *Chat) take(ctx context.Context, key string, limit Limit, n int) error {
+	if limit.Burst <= 0 {
+		return nil
+	}
+
+	err := c.limiter.Take(ctx, key, limit, n)
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.Is(err, ErrRateLimited):
+		return err
+	}
+
+	c.log.Info(ctx, "chat-ratelimit", "key", key, "ERROR", err)
+
+	return nil
+}
+
+// newStrikes returns the bucket a connection's violations are taken from.
+// Once it is empty the user is disconnected.
+func (c *Chat) newStrikes() *rate.Limiter {
+	maxViolations := c.limits.MaxViolations
+	if maxViolations <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(maxViolations)), maxViolations)
+}
@@ -0,0 +1,145 @@
+// Package limiter provides token bucket rate limiting, using a JetStream
+// key/value bucket shared by every cap.
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// maxRetries is the number of times an update is retried when another cap
+// changed the bucket at the same time.
+const maxRetries = 5
+
+// bucket represents the state of a token bucket.
+type bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// Limiter provides rate limit management.
+type Limiter struct {
+	log *logger.Logger
+	kv  jetstream.KeyValue
+}
+
+// New creates a new limiter using the specified bucket. Token buckets that
+// are not used within the ttl expire, which is the same as a full bucket as
+// long as the ttl is longer than the time a bucket takes to refill.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, bucket string, ttl time.Duration) (*Limiter, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+		TTL:    ttl,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	l := Limiter{
+		log: log,
+		kv:  kv,
+	}
+
+	return &l, nil
+}
+
+// Take removes n tokens from the bucket with the specified key. The bucket
+// starts full and refills at the limit's rate up to its burst. When the bucket
+// doesn't hold enough tokens nothing is removed and chat.ErrRateLimited is
+// returned.
+func (l *Limiter) Take(ctx context.Context, key string, limit chat.Limit, n int) error {
+	key = kvKey(key)
+
+	for range maxRetries {
+		err := l.take(ctx, key, limit, n)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+
+		return err
+	}
+
+	return fmt.Errorf("take: too many concurrent changes to %s", key)
+}
+
+// =============================================================================
+
+func (l *Limiter) take(ctx context.Context, key string, limit chat.Limit, n int) error {
+	now := time.Now()
+
+	b := bucket{
+		Tokens:  float64(limit.Burst),
+		Updated: now,
+	}
+
+	var revision uint64
+
+	entry, err := l.kv.Get(ctx, key)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(entry.Value(), &b); err != nil {
+			return fmt.Errorf("unmarshal: %w", err)
+		}
+
+		revision = entry.Revision()
+
+	case !errors.Is(err, jetstream.ErrKeyNotFound):
+		return fmt.Errorf("get: %w", err)
+	}
+
+	if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens = min(float64(limit.Burst), b.Tokens+elapsed.Seconds()*limit.Rate)
+	}
+
+	b.Updated = now
+
+	if b.Tokens < float64(n) {
+		return fmt.Errorf("%w: %s", chat.ErrRateLimited, key)
+	}
+
+	b.Tokens -= float64(n)
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	switch revision {
+	case 0:
+		_, err = l.kv.Create(ctx, key, data)
+	default:
+		_, err = l.kv.Update(ctx, key, data, revision)
+	}
+
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+
+	l.log.Debug(ctx, "chat-ratelimit", "key", key, "tokens", b.Tokens)
+
+	return nil
+}
+
+// kvKey replaces the characters a key/value bucket doesn't accept in keys,
+// like the colons of an IPv6 address.
+func kvKey(key string) string {
+	f := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '=', r == '/':
+			return r
+		}
+		return '_'
+	}
+
+	return strings.Map(f, key)
+}
@@ -0,0 +1,324 @@
+// Package localbus provides a bus implementation modeled on Redis Streams for
+// running caps in a single process. Published messages are appended to a log
+// with increasing ids. Every subscription behaves like a consumer group: it
+// has its own position in the log and a list of pending entries it was given
+// but has not acknowledged. Pending entries that are not acknowledged in time
+// are delivered again. The log is trimmed to a maximum length.
+package localbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+)
+
+// Config represents the settings for the bus.
+type Config struct {
+	MaxLen  int
+	AckWait time.Duration
+}
+
+// Bus manages the log and the consumer groups reading from it.
+type Bus struct {
+	maxLen  int
+	ackWait time.Duration
+
+	mu      sync.Mutex
+	entries []entry
+	lastID  uint64
+	groups  map[string]*group
+}
+
+// New constructs a bus.
+func New(cfg Config) (*Bus, error) {
+	if cfg.MaxLen <= 0 {
+		return nil, errors.New("max len must be greater than zero")
+	}
+
+	if cfg.AckWait <= 0 {
+		return nil, errors.New("ack wait must be greater than zero")
+	}
+
+	b := Bus{
+		maxLen:  cfg.MaxLen,
+		ackWait: cfg.AckWait,
+		groups:  make(map[string]*group),
+	}
+
+	return &b, nil
+}
+
+// Publish appends the message to the log, like XADD with MAXLEN.
+func (b *Bus) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+
+	b.entries = append(b.entries, entry{
+		id:      b.lastID,
+		subject: subject,
+		data:    slices.Clone(data),
+	})
+
+	if n := len(b.entries) - b.maxLen; n > 0 {
+		b.entries = slices.Delete(b.entries, 0, n)
+	}
+
+	for _, grp := range b.groups {
+		grp.wake()
+	}
+
+	return nil
+}
+
+// Subscribe starts delivering the entries published on the subjects to the
+// handler, one at a time. A new group starts at the end of the log, an
+// existing group continues from its position with another consumer.
+func (b *Bus) Subscribe(ctx context.Context, name string, subjects []string, handler func(msg chat.BusMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	grp, exists := b.groups[name]
+	if !exists {
+		grp = &group{
+			lastID:  b.lastID,
+			pending: make(map[uint64]time.Time),
+			notify:  make(chan struct{}, 1),
+		}
+		b.groups[name] = grp
+	}
+
+	grp.subjects = slices.Clone(subjects)
+
+	if grp.stop == nil {
+		grp.stop = make(chan struct{})
+	}
+
+	grp.consumers.Add(1)
+	go b.consume(grp, grp.stop, handler)
+
+	return nil
+}
+
+// Drain stops the consumers of the group with the specified name once they
+// are done with the entries they claimed, and waits for them. The group keeps
+// its position and pending entries, so subscribing again continues from there.
+func (b *Bus) Drain(ctx context.Context, name string) error {
+	b.mu.Lock()
+
+	grp, exists := b.groups[name]
+	if !exists {
+		b.mu.Unlock()
+		return fmt.Errorf("group %q not found", name)
+	}
+
+	if grp.stop != nil {
+		close(grp.stop)
+		grp.stop = nil
+	}
+
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		grp.consumers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Info returns the size of the log and the state of the group with the
+// specified name, like XINFO STREAM and XINFO GROUPS.
+func (b *Bus) Info(ctx context.Context, name string) (chat.BusInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	grp, exists := b.groups[name]
+	if !exists {
+		return chat.BusInfo{}, fmt.Errorf("group %q not found", name)
+	}
+
+	info := chat.BusInfo{
+		Stream:     "local",
+		Messages:   uint64(len(b.entries)),
+		Consumer:   name,
+		AckPending: len(grp.pending),
+	}
+
+	for _, e := range b.entries {
+		info.Bytes += uint64(len(e.data))
+
+		if e.id > grp.lastID && slices.Contains(grp.subjects, e.subject) {
+			info.Pending++
+		}
+	}
+
+	return info, nil
+}
+
+// =============================================================================
+
+func (b *Bus) consume(grp *group, stop <-chan struct{}, handler func(msg chat.BusMessage)) {
+	defer grp.consumers.Done()
+
+	ticker := time.NewTicker(b.ackWait)
+	defer ticker.Stop()
+
+	for {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			e, ok := b.next(grp)
+			if !ok {
+				break
+			}
+
+			handler(message{bus: b, grp: grp, entry: e})
+		}
+
+		select {
+		case <-grp.notify:
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// next claims the next entry for the group. Pending entries whose ack wait
+// expired are claimed before new entries, like XAUTOCLAIM.
+func (b *Bus) next(grp *group) (entry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	for _, id := range grp.expired(now) {
+		e, ok := b.entry(id)
+		if !ok {
+			// The entry was trimmed from the log.
+			delete(grp.pending, id)
+			continue
+		}
+
+		grp.pending[id] = now.Add(b.ackWait)
+		return e, true
+	}
+
+	for _, e := range b.entries {
+		if e.id <= grp.lastID {
+			continue
+		}
+
+		grp.lastID = e.id
+
+		if slices.Contains(grp.subjects, e.subject) {
+			grp.pending[e.id] = now.Add(b.ackWait)
+			return e, true
+		}
+	}
+
+	return entry{}, false
+}
+
+func (b *Bus) entry(id uint64) (entry, bool) {
+	idx, found := slices.BinarySearchFunc(b.entries, id, func(e entry, id uint64) int {
+		switch {
+		case e.id < id:
+			return -1
+		case e.id > id:
+			return 1
+		}
+		return 0
+	})
+
+	if !found {
+		return entry{}, false
+	}
+
+	return b.entries[idx], true
+}
+
+func (b *Bus) ack(grp *group, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(grp.pending, id)
+}
+
+// =============================================================================
+
+type entry struct {
+	id      uint64
+	subject string
+	data    []byte
+}
+
+type group struct {
+	subjects  []string
+	lastID    uint64
+	pending   map[uint64]time.Time
+	notify    chan struct{}
+	stop      chan struct{}
+	consumers sync.WaitGroup
+}
+
+func (g *group) wake() {
+	select {
+	case g.notify <- struct{}{}:
+	default:
+	}
+}
+
+// expired returns the ids of the pending entries whose ack wait expired, in
+// the order they were published.
+func (g *group) expired(now time.Time) []uint64 {
+	var ids []uint64
+
+	for id, deadline := range g.pending {
+		if now.After(deadline) {
+			ids = append(ids, id)
+		}
+	}
+
+	slices.Sort(ids)
+
+	return ids
+}
+
+type message struct {
+	bus *Bus
+	grp *group
+	entry
+}
+
+func (m message) Subject() string {
+	return m.subject
+}
+
+func (m message) Data() []byte {
+	return m.data
+}
+
+func (m message) Ack() error {
+	m.bus.ack(m.grp, m.id)
+	return nil
+}
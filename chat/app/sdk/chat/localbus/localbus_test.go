@@ -0,0 +1,204 @@
+package localbus_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat/localbus"
+)
+
+func Test_Redeliver(t *testing.T) {
+	bus, err := localbus.New(localbus.Config{MaxLen: 10, AckWait: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Should be able to create the bus: %s", err)
+	}
+
+	ch := make(chan chat.BusMessage, 10)
+
+	if err := bus.Subscribe(context.Background(), "cap", []string{"a"}, func(msg chat.BusMessage) { ch <- msg }); err != nil {
+		t.Fatalf("Should be able to subscribe: %s", err)
+	}
+
+	bus.Publish(context.Background(), "b", []byte("skipped"))
+	bus.Publish(context.Background(), "a", []byte("first"))
+
+	msg := receive(t, ch)
+	if string(msg.Data()) != "first" {
+		t.Fatalf("Should receive the first message, got %q", msg.Data())
+	}
+
+	// The message was not acknowledged so it must be delivered again.
+
+	msg = receive(t, ch)
+	if string(msg.Data()) != "first" {
+		t.Fatalf("Should receive the first message again, got %q", msg.Data())
+	}
+
+	msg.Ack()
+
+	bus.Publish(context.Background(), "a", []byte("second"))
+
+	msg = receive(t, ch)
+	if string(msg.Data()) != "second" {
+		t.Fatalf("Should receive the second message, got %q", msg.Data())
+	}
+
+	msg.Ack()
+
+	select {
+	case msg := <-ch:
+		t.Fatalf("Should not receive acknowledged messages again, got %q", msg.Data())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_Trim(t *testing.T) {
+	bus, err := localbus.New(localbus.Config{MaxLen: 2, AckWait: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Should be able to create the bus: %s", err)
+	}
+
+	ch := make(chan chat.BusMessage, 10)
+	block := make(chan struct{})
+
+	handler := func(msg chat.BusMessage) {
+		ch <- msg
+		<-block
+	}
+
+	if err := bus.Subscribe(context.Background(), "cap", []string{"a"}, handler); err != nil {
+		t.Fatalf("Should be able to subscribe: %s", err)
+	}
+
+	bus.Publish(context.Background(), "a", []byte("1"))
+	receive(t, ch)
+
+	// While the consumer is busy the log is trimmed past the first message.
+
+	for _, v := range []string{"2", "3", "4"} {
+		bus.Publish(context.Background(), "a", []byte(v))
+	}
+
+	close(block)
+
+	for _, exp := range []string{"3", "4"} {
+		msg := receive(t, ch)
+		if string(msg.Data()) != exp {
+			t.Fatalf("Should receive message %s, got %q", exp, msg.Data())
+		}
+		msg.Ack()
+	}
+}
+
+func Test_Info(t *testing.T) {
+	bus, err := localbus.New(localbus.Config{MaxLen: 10, AckWait: time.Second})
+	if err != nil {
+		t.Fatalf("Should be able to create the bus: %s", err)
+	}
+
+	ch := make(chan chat.BusMessage, 10)
+	block := make(chan struct{})
+	defer close(block)
+
+	handler := func(msg chat.BusMessage) {
+		ch <- msg
+		<-block
+	}
+
+	if err := bus.Subscribe(context.Background(), "cap", []string{"a"}, handler); err != nil {
+		t.Fatalf("Should be able to subscribe: %s", err)
+	}
+
+	bus.Publish(context.Background(), "a", []byte("1"))
+	receive(t, ch)
+
+	// The consumer is busy with the first message, the others are waiting.
+
+	bus.Publish(context.Background(), "b", []byte("2"))
+	bus.Publish(context.Background(), "a", []byte("3"))
+	bus.Publish(context.Background(), "a", []byte("4"))
+
+	info, err := bus.Info(context.Background(), "cap")
+	if err != nil {
+		t.Fatalf("Should be able to get the info: %s", err)
+	}
+
+	exp := chat.BusInfo{
+		Stream:     "local",
+		Messages:   4,
+		Bytes:      4,
+		Consumer:   "cap",
+		Pending:    2,
+		AckPending: 1,
+	}
+
+	if info != exp {
+		t.Fatalf("Should get the expected info, got %+v, exp %+v", info, exp)
+	}
+
+	if _, err := bus.Info(context.Background(), "unknown"); err == nil {
+		t.Fatal("Should not get the info of an unknown group")
+	}
+}
+
+func Test_Drain(t *testing.T) {
+	bus, err := localbus.New(localbus.Config{MaxLen: 10, AckWait: time.Second})
+	if err != nil {
+		t.Fatalf("Should be able to create the bus: %s", err)
+	}
+
+	ch := make(chan chat.BusMessage, 10)
+	handler := func(msg chat.BusMessage) { ch <- msg }
+
+	if err := bus.Subscribe(context.Background(), "cap", []string{"a"}, handler); err != nil {
+		t.Fatalf("Should be able to subscribe: %s", err)
+	}
+
+	bus.Publish(context.Background(), "a", []byte("1"))
+	receive(t, ch).Ack()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := bus.Drain(ctx, "cap"); err != nil {
+		t.Fatalf("Should be able to drain: %s", err)
+	}
+
+	// A drained group is not given new messages until it subscribes again.
+
+	bus.Publish(context.Background(), "a", []byte("2"))
+
+	select {
+	case msg := <-ch:
+		t.Fatalf("Should not receive messages once drained, got %q", msg.Data())
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := bus.Subscribe(context.Background(), "cap", []string{"a"}, handler); err != nil {
+		t.Fatalf("Should be able to subscribe again: %s", err)
+	}
+
+	msg := receive(t, ch)
+	if string(msg.Data()) != "2" {
+		t.Fatalf("Should continue with the second message, got %q", msg.Data())
+	}
+
+	if err := bus.Drain(ctx, "unknown"); err == nil {
+		t.Fatal("Should not drain an unknown group")
+	}
+}
+
+func receive(t *testing.T, ch chan chat.BusMessage) chat.BusMessage {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("Should receive a message")
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package membus provides an in-memory bus implementation for tests. Messages
+// are delivered to the subscriptions in the same process and acks are
+// ignored.
+package membus
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+)
+
+// Bus delivers messages between subscriptions in the same process.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[string]*subscription
+}
+
+// New constructs an in-memory bus.
+func New() *Bus {
+	return &Bus{
+		subs: make(map[string]*subscription),
+	}
+}
+
+// Publish hands the message to every subscription that includes the subject.
+func (b *Bus) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	msg := message{
+		subject: subject,
+		data:    data,
+	}
+
+	for _, sub := range b.subs {
+		if !slices.Contains(sub.subjects, subject) {
+			continue
+		}
+
+		select {
+		case sub.ch <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Subscribe starts delivering the messages published on the subjects to the
+// handler, one at a time. Subscribing again with the same name replaces the
+// subjects and handler of the existing subscription.
+func (b *Bus) Subscribe(ctx context.Context, name string, subjects []string, handler func(msg chat.BusMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub, exists := b.subs[name]; exists {
+		close(sub.ch)
+	}
+
+	const bufferSize = 1024
+
+	sub := subscription{
+		subjects: slices.Clone(subjects),
+		ch:       make(chan message, bufferSize),
+		done:     make(chan struct{}),
+	}
+
+	b.subs[name] = &sub
+
+	go func() {
+		defer close(sub.done)
+
+		for msg := range sub.ch {
+			handler(msg)
+		}
+	}()
+
+	return nil
+}
+
+// Drain removes the subscription with the specified name and waits for the
+// handler to finish with the messages already published to it.
+func (b *Bus) Drain(ctx context.Context, name string) error {
+	b.mu.Lock()
+
+	sub, exists := b.subs[name]
+	if !exists {
+		b.mu.Unlock()
+		return fmt.Errorf("subscription %q not found", name)
+	}
+
+	delete(b.subs, name)
+	close(sub.ch)
+
+	b.mu.Unlock()
+
+	select {
+	case <-sub.done:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Info returns the number of messages waiting to be handled by the
+// subscription with the specified name. Messages are not kept once they are
+// delivered.
+func (b *Bus) Info(ctx context.Context, name string) (chat.BusInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	sub, exists := b.subs[name]
+	if !exists {
+		return chat.BusInfo{}, fmt.Errorf("subscription %q not found", name)
+	}
+
+	info := chat.BusInfo{
+		Stream:   "memory",
+		Consumer: name,
+		Pending:  uint64(len(sub.ch)),
+	}
+
+	return info, nil
+}
+
+// =============================================================================
+
+type subscription struct {
+	subjects []string
+	ch       chan message
+	done     chan struct{}
+}
+
+type message struct {
+	subject string
+	data    []byte
+}
+
+func (m message) Subject() string {
+	return m.subject
+}
+
+func (m message) Data() []byte {
+	return m.data
+}
+
+func (m message) Ack() error {
+	return nil
+}
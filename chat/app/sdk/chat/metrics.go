@@ -0,0 +1,73 @@
+package chat
+
+import (
+	"context"
+	"time"
+)
+
+// Set of handshake results reported to the metrics.
+const (
+	HandshakeOK                 = "ok"
+	HandshakeUpgrade            = "upgrade"
+	HandshakeOrigin             = "origin"
+	HandshakeSubprotocol        = "subprotocol"
+	HandshakeIO                 = "io"
+	HandshakeTimeout            = "timeout"
+	HandshakeUnsupportedVersion = "unsupported_version"
+	HandshakeBadFrame           = "bad_frame"
+	HandshakeUnauthenticated    = "unauthenticated"
+	HandshakeAlreadyConnected   = "already_connected"
+	HandshakeShuttingDown       = "shutting_down"
+	HandshakeRateLimited        = "rate_limited"
+)
+
+// Set of routes a message takes out of the cap.
+const (
+	RouteLocal = "local"
+	RouteBus   = "bus"
+)
+
+// Set of places a frame with a bad signature comes from.
+const (
+	SourceClient = "client"
+	SourceBus    = "bus"
+)
+
+// Metrics defines the set of behavior for recording what the cap is doing.
+type Metrics interface {
+	Connected(n int)
+	Handshake(result string)
+	Routed(route string)
+	SignatureFailure(source string)
+	BusPublish(d time.Duration)
+	PingTimeout()
+	SlowConsumer()
+}
+
+// nopMetrics is used when no metrics are configured.
+type nopMetrics struct{}
+
+func (nopMetrics) Connected(int)              {}
+func (nopMetrics) Handshake(string)           {}
+func (nopMetrics) Routed(string)              {}
+func (nopMetrics) SignatureFailure(string)    {}
+func (nopMetrics) BusPublish(d time.Duration) {}
+func (nopMetrics) PingTimeout()               {}
+func (nopMetrics) SlowConsumer()              {}
+
+// =============================================================================
+
+// busPublish publishes on the bus and records how long it took.
+func (c *Chat) busPublish(ctx context.Context, subject string, data []byte) error {
+	start := time.Now()
+	defer func() {
+		c.metrics.BusPublish(time.Since(start))
+	}()
+
+	return c.bus.Publish(ctx, subject, data)
+}
+
+// updateConnected records the number of users connected to this cap.
+func (c *Chat) updateConnected() {
+	c.metrics.Connected(len(c.users.Connections()))
+}
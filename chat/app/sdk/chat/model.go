@@ -1,53 +1,178 @@
 package chat
 
 import (
-	"math/big"
+	"slices"
 	"time"
 
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
-// User represents a user in the chat system.
+// User represents a user in the chat system. A user connected from several
+// devices has one value per device.
 type User struct {
-	ID       common.Address  `json:"id"`
-	Name     string          `json:"name"`
-	LastPing time.Time       `json:"lastPing"`
-	LastPong time.Time       `json:"lastPong"`
-	Conn     *websocket.Conn `json:"-"`
+	ID       common.Address `json:"id"`
+	Name     string         `json:"name"`
+	Device   string         `json:"device"`
+	LastPing time.Time      `json:"lastPing"`
+	LastPong time.Time      `json:"lastPong"`
+	Conn     *Conn          `json:"-"`
 }
 
-// Connection represents a connection to a user.
+// Session returns what identifies the connection of the user's device.
+func (u User) Session() Session {
+	return Session{ID: u.ID, Device: u.Device}
+}
+
+// Session identifies the connection of one device of a user.
+type Session struct {
+	ID     common.Address
+	Device string
+}
+
+// Connection represents a connection to a user's device.
 type Connection struct {
-	Conn     *websocket.Conn
+	Name     string
+	Conn     *Conn
 	LastPing time.Time
 	LastPong time.Time
 }
 
+// Group represents a set of users that share the same messages.
+type Group struct {
+	ID      common.Address   `json:"id"`
+	Name    string           `json:"name"`
+	OwnerID common.Address   `json:"ownerID"`
+	Members []common.Address `json:"members"`
+}
+
+// IsMember reports whether the user is a member of the group.
+func (g Group) IsMember(userID common.Address) bool {
+	return slices.Contains(g.Members, userID)
+}
+
+// BusInfo represents the state of the bus and of a cap's subscription to it.
+// Pending is the number of messages published for the subscription that were
+// not delivered yet, AckPending the number delivered but not acknowledged.
+type BusInfo struct {
+	Stream      string `json:"stream"`
+	Messages    uint64 `json:"messages"`
+	Bytes       uint64 `json:"bytes"`
+	Consumer    string `json:"consumer"`
+	Pending     uint64 `json:"pending"`
+	AckPending  int    `json:"ackPending"`
+	Redelivered int    `json:"redelivered"`
+}
+
+// Limit represents a token bucket that refills at Rate tokens per second up
+// to Burst tokens. A limit with no burst is not enforced.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limits represents the rate limits enforced by the cap. Messages and Bytes
+// are counted per user, Handshakes per remote IP. A user that breaks the
+// limits more than MaxViolations times in a minute is disconnected.
+type Limits struct {
+	Messages      Limit
+	Bytes         Limit
+	Handshakes    Limit
+	MaxViolations int
+}
+
+// Outbound represents how frames are written to a client. A client with
+// QueueSize frames waiting to be written is too slow and is disconnected. A
+// frame that can't be written within WriteTimeout closes the connection. The
+// client is pinged every PingInterval, nothing read from it for two intervals
+// closes the connection.
+type Outbound struct {
+	QueueSize    int
+	WriteTimeout time.Duration
+	PingInterval time.Duration
+}
+
+// Upgrader represents how connections are upgraded to websockets. Browsers
+// can only connect from the allowed origins, the cap's own origin when none
+// are specified. A frame larger than MaxMessageSize closes the connection, no
+// limit is enforced when it's zero. Compression enables permessage-deflate
+// when the client supports it. Clients must offer the Subprotocol when one is
+// specified.
+type Upgrader struct {
+	AllowedOrigins  []string
+	MaxMessageSize  int64
+	Compression     bool
+	ReadBufferSize  int
+	WriteBufferSize int
+	Subprotocol     string
+}
+
+// UserStatus represents whether a user is connected and when the user was
+// last seen.
+type UserStatus struct {
+	Status   string
+	LastSeen time.Time
+}
+
+// incomingMessage is the cap's view of a frame sent
+// by a client. It keeps everything the client signed so the signature can be
+// verified again by the other caps.
 type incomingMessage struct {
-	ToID      common.Address `json:"toID"`
-	Msg       string         `json:"msg"`
-	FromNonce uint64         `json:"fromNonce"`
-	V         *big.Int       `json:"v"`
-	R         *big.Int       `json:"r"`
-	S         *big.Int       `json:"s"`
+	Type      protocol.Type             `json:"type"`
+	ToID      common.Address            `json:"toID"`
+	Msg       string                    `json:"msg,omitempty"`
+	Encrypted bool                      `json:"encrypted,omitempty"`
+	Command   *protocol.Command         `json:"command,omitempty"`
+	Receipt   *protocol.Receipt         `json:"receipt,omitempty"`
+	File      *protocol.FileChunk       `json:"file,omitempty"`
+	Presence  *protocol.PresenceRequest `json:"presence,omitempty"`
+	Device    *protocol.DeviceRequest   `json:"device,omitempty"`
+	FromNonce uint64                    `json:"fromNonce"`
+	protocol.Signature
 }
 
-type outgoingUser struct {
-	ID    common.Address `json:"id"`
-	Name  string         `json:"name"`
-	Nonce uint64         `json:"nonce"`
+// isGroupCommand reports whether the message must be executed by the cap.
+func (m incomingMessage) isGroupCommand() bool {
+	if m.Type != protocol.TypeCommand {
+		return false
+	}
+
+	switch m.Command.Action {
+	case protocol.ActionGroupCreate, protocol.ActionGroupInvite, protocol.ActionGroupRemove:
+		return true
+	}
+
+	return false
+}
+
+// needsStatus reports whether the sender is told what happened to the
+// message. A file is reported once, when its last chunk is sent.
+func (m incomingMessage) needsStatus() bool {
+	switch m.Type {
+	case protocol.TypeReceipt:
+		return false
+
+	case protocol.TypeFile:
+		return m.File.Last()
+	}
+
+	return true
 }
 
+// outgoingMessage is a frame waiting to be written to a client.
 type outgoingMessage struct {
-	From outgoingUser `json:"from"`
-	Msg  string       `json:"msg"`
+	Type    protocol.Type
+	Payload any
 }
 
+// busMessage is a message handed to other caps. A mirror is a copy of the
+// message for the sender's other devices.
 type busMessage struct {
-	CapID    uuid.UUID      `json:"capID"`
-	FromID   common.Address `json:"fromID"`
-	FromName string         `json:"fromName"`
+	CapID      uuid.UUID      `json:"capID"`
+	FromID     common.Address `json:"fromID"`
+	FromName   string         `json:"fromName"`
+	FromDevice string         `json:"fromDevice,omitempty"`
+	Mirror     bool           `json:"mirror,omitempty"`
 	incomingMessage
 }
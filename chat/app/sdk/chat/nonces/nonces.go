@@ -0,0 +1,101 @@
+// Package nonces provides support for tracking the last nonce each device of
+// a user sent to each recipient, using a JetStream key/value bucket shared by
+// every cap.
+package nonces
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// maxRetries is the number of times an update is retried when another cap
+// changed the nonce at the same time.
+const maxRetries = 5
+
+// Nonces provides nonce management.
+type Nonces struct {
+	log *logger.Logger
+	kv  jetstream.KeyValue
+}
+
+// New creates a new nonce storage using the specified bucket.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, bucket string) (*Nonces, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	n := Nonces{
+		log: log,
+		kv:  kv,
+	}
+
+	return &n, nil
+}
+
+// Advance records the nonce as the last one the user's device sent to the
+// recipient. The nonce must be greater than the last one recorded, otherwise
+// the frame is a replay or arrived out of order and chat.ErrInvalidNonce is
+// returned. Clients that don't send a device keep the nonces recorded before
+// devices existed.
+func (n *Nonces) Advance(ctx context.Context, from chat.Session, toID common.Address, nonce uint64) error {
+	key := fmt.Sprintf("%s.%s", from.ID.Hex(), toID.Hex())
+	if from.Device != "" {
+		key = fmt.Sprintf("%s.%s.%s", from.ID.Hex(), from.Device, toID.Hex())
+	}
+	value := []byte(strconv.FormatUint(nonce, 10))
+
+	for range maxRetries {
+		err := n.store(ctx, key, value, nonce)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+
+		return err
+	}
+
+	return fmt.Errorf("advance: too many concurrent changes to %s", key)
+}
+
+// =============================================================================
+
+func (n *Nonces) store(ctx context.Context, key string, value []byte, nonce uint64) error {
+	entry, err := n.kv.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return fmt.Errorf("get: %w", err)
+		}
+
+		if _, err := n.kv.Create(ctx, key, value); err != nil {
+			return fmt.Errorf("create: %w", err)
+		}
+
+		return nil
+	}
+
+	last, err := strconv.ParseUint(string(entry.Value()), 10, 64)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	if nonce <= last {
+		return fmt.Errorf("%w: got %d, last %d", chat.ErrInvalidNonce, nonce, last)
+	}
+
+	if _, err := n.kv.Update(ctx, key, value, entry.Revision()); err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
+	n.log.Debug(ctx, "chat-advancenonce", "key", key, "nonce", nonce)
+
+	return nil
+}
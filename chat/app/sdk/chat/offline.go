@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func (c *Chat) storeOffline(ctx context.Context, from User, userID common.Address, inMsg incomingMessage) error {
+	d, err := c.marshalBusMessage(from, inMsg)
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+
+	if err := c.offline.Store(ctx, userID, d); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+
+	c.log.Info(ctx, "LOC: msg stored for offline user", "from", from.ID, "to", userID)
+
+	return nil
+}
+
+// deliverOffline returns a function that writes messages stored while the
+// user was offline to the user's web socket, ahead of the messages held while
+// the handshake completes.
+func (c *Chat) deliverOffline(ctx context.Context, to User) func(data []byte) error {
+	f := func(data []byte) error {
+		var busMsg busMessage
+		if err := json.Unmarshal(data, &busMsg); err != nil {
+			c.log.Info(ctx, "offline-unmarshal", "ERROR", err)
+			return nil
+		}
+
+		from := User{
+			ID:     busMsg.FromID,
+			Name:   busMsg.FromName,
+			Device: busMsg.FromDevice,
+		}
+
+		var grp *protocol.Group
+		if g, err := c.groups.Retrieve(ctx, busMsg.ToID); err == nil {
+			grp = newOutgoingGroup(g)
+		}
+
+		m := newOutgoingMessage(from, busMsg.incomingMessage, grp)
+
+		if err := c.writeFirst(ctx, to, m); err != nil {
+			return err
+		}
+
+		c.log.Info(ctx, "OFFLINE: msg sent over web socket", "from", busMsg.FromID, "to", to.ID)
+
+		return nil
+	}
+
+	return f
+}
+
+// sendStatus tells the sender what happened to a direct message.
+func (c *Chat) sendStatus(ctx context.Context, from User, inMsg incomingMessage, status string) {
+	m := outgoingMessage{
+		Type: protocol.TypeStatus,
+		Payload: protocol.StatusMessage{
+			ToID:   inMsg.ToID,
+			Nonce:  inMsg.FromNonce,
+			Status: status,
+		},
+	}
+
+	if err := c.writeMessage(ctx, from, m); err != nil {
+		c.log.Info(ctx, "chat-sendstatus", "id", from.ID, "ERROR", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Package offline provides storage for messages sent to users that are not
+// connected to any cap, using a JetStream stream with a subject per user.
+package offline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fetchSize is the number of messages fetched at a time while draining.
+const fetchSize = 100
+
+// Offline provides offline message storage.
+type Offline struct {
+	log     *logger.Logger
+	js      jetstream.JetStream
+	stream  jetstream.Stream
+	name    string
+	maxMsgs int64
+}
+
+// New creates a new offline store using the specified stream name. Messages
+// older than maxAge are discarded and each user can hold at most maxMsgs
+// messages.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, name string, maxAge time.Duration, maxMsgs int64) (*Offline, error) {
+	s, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:                 name,
+		Subjects:             []string{name + ".*"},
+		MaxAge:               maxAge,
+		MaxMsgsPerSubject:    maxMsgs,
+		Discard:              jetstream.DiscardNew,
+		DiscardNewPerSubject: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create js: %w", err)
+	}
+
+	o := Offline{
+		log:     log,
+		js:      js,
+		stream:  s,
+		name:    name,
+		maxMsgs: maxMsgs,
+	}
+
+	return &o, nil
+}
+
+// Store saves the message for the user. If the user's quota is used up,
+// ErrQuotaExceeded is returned.
+func (o *Offline) Store(ctx context.Context, userID common.Address, data []byte) error {
+	subject := o.subject(userID)
+
+	info, err := o.stream.Info(ctx, jetstream.WithSubjectFilter(subject))
+	if err != nil {
+		return fmt.Errorf("stream info: %w", err)
+	}
+
+	if int64(info.State.Subjects[subject]) >= o.maxMsgs {
+		return chat.ErrQuotaExceeded
+	}
+
+	if _, err := o.js.Publish(ctx, subject, data); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+
+	o.log.Debug(ctx, "chat-offlinestore", "id", userID)
+
+	return nil
+}
+
+// Drain hands every stored message for the user to the deliver function in
+// the order they were stored. Delivered messages are removed from storage.
+// If deliver fails, the remaining messages are kept for the next time.
+func (o *Offline) Drain(ctx context.Context, userID common.Address, deliver func(data []byte) error) error {
+	subject := o.subject(userID)
+
+	cons, err := o.js.OrderedConsumer(ctx, o.name, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{subject},
+	})
+	if err != nil {
+		return fmt.Errorf("ordered consumer: %w", err)
+	}
+
+	// The consumer is only needed for this drain, the server would otherwise
+	// keep it until it's inactive for a while.
+
+	defer func() {
+		if err := o.stream.DeleteConsumer(ctx, cons.CachedInfo().Name); err != nil {
+			o.log.Info(ctx, "chat-offlinedrain", "id", userID, "ERROR", err)
+		}
+	}()
+
+	info, err := cons.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("consumer info: %w", err)
+	}
+
+	pending := info.NumPending
+
+	var lastSeq uint64
+	var deliverErr error
+
+drain:
+	for pending > 0 {
+		batch, err := cons.Fetch(fetchSize, jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			return fmt.Errorf("fetch: %w", err)
+		}
+
+		var fetched int
+		for msg := range batch.Messages() {
+			fetched++
+
+			meta, err := msg.Metadata()
+			if err != nil {
+				deliverErr = fmt.Errorf("metadata: %w", err)
+				break drain
+			}
+
+			if err := deliver(msg.Data()); err != nil {
+				deliverErr = fmt.Errorf("deliver: %w", err)
+				break drain
+			}
+
+			lastSeq = meta.Sequence.Stream
+			pending = meta.NumPending
+		}
+
+		if err := batch.Error(); err != nil {
+			return fmt.Errorf("batch: %w", err)
+		}
+
+		if fetched == 0 {
+			break
+		}
+	}
+
+	// Remove everything up to and including the last delivered message.
+	if lastSeq > 0 {
+		if err := o.stream.Purge(ctx, jetstream.WithPurgeSubject(subject), jetstream.WithPurgeSequence(lastSeq+1)); err != nil {
+			return fmt.Errorf("purge: %w", err)
+		}
+	}
+
+	return deliverErr
+}
+
+func (o *Offline) subject(userID common.Address) string {
+	return fmt.Sprintf("%s.%s", o.name, userID.Hex())
+}
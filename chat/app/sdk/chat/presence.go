@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// presenceEvent is published on the bus when the status of a user connected
+// to a cap changes.
+type presenceEvent struct {
+	CapID    uuid.UUID                `json:"capID"`
+	Presence protocol.PresenceMessage `json:"presence"`
+}
+
+// watchers tracks which local users are subscribed to the status of which
+// users. A subscription is shared by every device of the subscriber.
+type watchers struct {
+	mu      sync.RWMutex
+	watched map[common.Address]map[common.Address]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		watched: make(map[common.Address]map[common.Address]struct{}),
+	}
+}
+
+func (w *watchers) add(subscriberID common.Address, userIDs []common.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, userID := range userIDs {
+		subs, exists := w.watched[userID]
+		if !exists {
+			subs = make(map[common.Address]struct{})
+			w.watched[userID] = subs
+		}
+
+		subs[subscriberID] = struct{}{}
+	}
+}
+
+func (w *watchers) remove(subscriberID common.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for userID, subs := range w.watched {
+		delete(subs, subscriberID)
+
+		if len(subs) == 0 {
+			delete(w.watched, userID)
+		}
+	}
+}
+
+func (w *watchers) subscribers(userID common.Address) []common.Address {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	ids := make([]common.Address, 0, len(w.watched[userID]))
+	for id := range w.watched[userID] {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// =============================================================================
+
+// presenceRequest changes the user's status and subscribes the user to the
+// status of other users. The current status of every subscribed user is sent
+// right away so the client doesn't have to wait for the next change.
+func (c *Chat) presenceRequest(ctx context.Context, from User, req protocol.PresenceRequest) error {
+	if req.Status != "" {
+		switch req.Status {
+		case protocol.PresenceOnline, protocol.PresenceAway:
+		default:
+			return fmt.Errorf("status %q is not supported", req.Status)
+		}
+
+		if err := c.presence.SetStatus(ctx, from.ID, req.Status); err != nil {
+			return fmt.Errorf("set status: %w", err)
+		}
+
+		c.announce(ctx, from.ID)
+	}
+
+	if len(req.Subscribe) == 0 {
+		return nil
+	}
+
+	c.watchers.add(from.ID, req.Subscribe)
+
+	for _, userID := range req.Subscribe {
+		us, err := c.presence.Status(ctx, userID)
+		if err != nil {
+			c.log.Info(ctx, "chat-presencerequest", "id", userID, "ERROR", err)
+			continue
+		}
+
+		m := outgoingMessage{
+			Type:    protocol.TypePresence,
+			Payload: newPresenceMessage(userID, us),
+		}
+
+		if err := c.writeMessage(ctx, from, m); err != nil {
+			return fmt.Errorf("write presence: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// announce tells the local subscribers and the other caps about the current
+// status of the user.
+func (c *Chat) announce(ctx context.Context, userID common.Address) {
+	us, err := c.presence.Status(ctx, userID)
+	if err != nil {
+		c.log.Info(ctx, "chat-announce", "id", userID, "ERROR", err)
+		return
+	}
+
+	pm := newPresenceMessage(userID, us)
+
+	c.notifyPresence(ctx, pm)
+
+	evt := presenceEvent{
+		CapID:    c.capID,
+		Presence: pm,
+	}
+
+	d, err := json.Marshal(evt)
+	if err != nil {
+		c.log.Info(ctx, "chat-announce", "id", userID, "ERROR", err)
+		return
+	}
+
+	if err := c.busPublish(ctx, presenceSubject(c.subject), d); err != nil {
+		c.log.Info(ctx, "chat-announce", "id", userID, "ERROR", err)
+	}
+}
+
+// presenceNotifyBus delivers a status change announced by another cap to the
+// local subscribers.
+func (c *Chat) presenceNotifyBus(ctx context.Context, data []byte) {
+	var evt presenceEvent
+	if err := json.Unmarshal(data, &evt); err != nil {
+		c.log.Info(ctx, "bus-presenceunmarshal", "ERROR", err)
+		return
+	}
+
+	if evt.CapID == c.capID {
+		return
+	}
+
+	c.notifyPresence(ctx, evt.Presence)
+}
+
+// notifyPresence writes the status change to every device of the local
+// subscribers.
+func (c *Chat) notifyPresence(ctx context.Context, pm protocol.PresenceMessage) {
+	m := outgoingMessage{
+		Type:    protocol.TypePresence,
+		Payload: pm,
+	}
+
+	for _, subscriberID := range c.watchers.subscribers(pm.ID) {
+		devices, err := c.users.Retrieve(ctx, subscriberID)
+		if err != nil {
+			continue
+		}
+
+		c.writeDevices(ctx, devices, m)
+	}
+}
+
+// presenceSubject returns the subject the caps announce status changes on.
+func presenceSubject(subject string) string {
+	return subject + ".presence"
+}
+
+func newPresenceMessage(userID common.Address, us UserStatus) protocol.PresenceMessage {
+	return protocol.PresenceMessage{
+		ID:       userID,
+		Status:   us.Status,
+		LastSeen: us.LastSeen,
+	}
+}
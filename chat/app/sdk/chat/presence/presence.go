@@ -0,0 +1,287 @@
+// Package presence provides support for tracking which caps the devices of a
+// user are connected to, using a JetStream key/value bucket shared by every
+// cap.
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ardanlabs/usdl/chat/foundation/logger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// maxRetries is the number of times an update is retried when another cap
+// changed the entry at the same time.
+const maxRetries = 5
+
+// entry represents what is stored for a connected user. Every device of the
+// user records the cap it is connected to.
+type entry struct {
+	Devices map[string]device `json:"devices"`
+	Status  string            `json:"status"`
+}
+
+// device represents a connected device of the user. A device that was not
+// seen within the ttl belongs to a cap that died and is ignored.
+type device struct {
+	CapID uuid.UUID `json:"capID"`
+	Seen  time.Time `json:"seen"`
+}
+
+// Presence provides presence management.
+type Presence struct {
+	log  *logger.Logger
+	kv   jetstream.KeyValue
+	seen jetstream.KeyValue
+	ttl  time.Duration
+}
+
+// New creates a new presence registry using the specified bucket. Entries
+// that are not refreshed within the ttl expire, so users held by a cap that
+// died without cleaning up are eventually reported as offline. The time a
+// user was last seen is kept in a second bucket that doesn't expire.
+func New(ctx context.Context, log *logger.Logger, js jetstream.JetStream, bucket string, ttl time.Duration) (*Presence, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket,
+		TTL:    ttl,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create kv: %w", err)
+	}
+
+	seen, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket + "-seen",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("nats create seen kv: %w", err)
+	}
+
+	p := Presence{
+		log:  log,
+		kv:   kv,
+		seen: seen,
+		ttl:  ttl,
+	}
+
+	return &p, nil
+}
+
+// Set records the user's device as connected to the specified cap. Calling
+// Set again refreshes the device. The status the user picked is kept while
+// any of the user's devices is connected.
+func (p *Presence) Set(ctx context.Context, userID common.Address, deviceID string, capID uuid.UUID) error {
+	f := func(e *entry) bool {
+		if len(e.Devices) == 0 {
+			e.Status = protocol.PresenceOnline
+		}
+
+		e.Devices[deviceID] = device{
+			CapID: capID,
+			Seen:  time.Now(),
+		}
+
+		return true
+	}
+
+	return p.update(ctx, userID, f)
+}
+
+// SetStatus records the status the user picked, which applies to every
+// device of the user.
+func (p *Presence) SetStatus(ctx context.Context, userID common.Address, status string) error {
+	f := func(e *entry) bool {
+		e.Status = status
+		return true
+	}
+
+	return p.update(ctx, userID, f)
+}
+
+// Delete removes the user's device if it is still owned by the specified cap.
+// The device may have already reconnected to a different cap. The entry is
+// removed with the user's last device.
+func (p *Presence) Delete(ctx context.Context, userID common.Address, deviceID string, capID uuid.UUID) error {
+	f := func(e *entry) bool {
+		d, exists := e.Devices[deviceID]
+		if !exists || d.CapID != capID {
+			p.log.Debug(ctx, "chat-presencedelete", "id", userID, "device", deviceID, "status", "owned by a different cap")
+			return false
+		}
+
+		delete(e.Devices, deviceID)
+
+		return true
+	}
+
+	return p.update(ctx, userID, f)
+}
+
+// Retrieve returns the cap each connected device of the user is connected
+// to.
+func (p *Presence) Retrieve(ctx context.Context, userID common.Address) (map[string]uuid.UUID, error) {
+	e, _, err := p.get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.Devices) == 0 {
+		return nil, chat.ErrNotExists
+	}
+
+	devices := make(map[string]uuid.UUID, len(e.Devices))
+	for id, d := range e.Devices {
+		devices[id] = d.CapID
+	}
+
+	return devices, nil
+}
+
+// Status returns whether the user is connected and when they were last seen.
+func (p *Presence) Status(ctx context.Context, userID common.Address) (chat.UserStatus, error) {
+	e, _, err := p.get(ctx, userID)
+	if err == nil && len(e.Devices) == 0 {
+		err = chat.ErrNotExists
+	}
+
+	switch {
+	case err == nil:
+		us := chat.UserStatus{
+			Status:   e.Status,
+			LastSeen: time.Now(),
+		}
+		return us, nil
+
+	case !errors.Is(err, chat.ErrNotExists):
+		return chat.UserStatus{}, err
+	}
+
+	us := chat.UserStatus{
+		Status: protocol.PresenceOffline,
+	}
+
+	kve, err := p.seen.Get(ctx, userID.Hex())
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return us, nil
+		}
+		return chat.UserStatus{}, fmt.Errorf("get seen: %w", err)
+	}
+
+	if err := us.LastSeen.UnmarshalText(kve.Value()); err != nil {
+		return chat.UserStatus{}, fmt.Errorf("parse seen: %w", err)
+	}
+
+	return us, nil
+}
+
+// =============================================================================
+
+// get returns the user's entry without the devices that were not seen
+// within the ttl.
+func (p *Presence) get(ctx context.Context, userID common.Address) (entry, uint64, error) {
+	kve, err := p.kv.Get(ctx, userID.Hex())
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return entry{}, 0, chat.ErrNotExists
+		}
+		return entry{}, 0, fmt.Errorf("get: %w", err)
+	}
+
+	var e entry
+	if err := json.Unmarshal(kve.Value(), &e); err != nil {
+		return entry{}, 0, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	for id, d := range e.Devices {
+		if time.Since(d.Seen) > p.ttl {
+			delete(e.Devices, id)
+		}
+	}
+
+	return e, kve.Revision(), nil
+}
+
+// update applies the change to the user's entry. The change is applied again
+// when another cap changed the entry at the same time. An entry left without
+// devices is removed.
+func (p *Presence) update(ctx context.Context, userID common.Address, f func(e *entry) bool) error {
+	for range maxRetries {
+		err := p.store(ctx, userID, f)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+
+		return err
+	}
+
+	return fmt.Errorf("update: too many concurrent changes to %s", userID.Hex())
+}
+
+func (p *Presence) store(ctx context.Context, userID common.Address, f func(e *entry) bool) error {
+	e, revision, err := p.get(ctx, userID)
+	if err != nil && !errors.Is(err, chat.ErrNotExists) {
+		return err
+	}
+
+	if e.Devices == nil {
+		e.Devices = make(map[string]device)
+	}
+
+	if !f(&e) {
+		return nil
+	}
+
+	key := userID.Hex()
+
+	if len(e.Devices) == 0 {
+		if revision == 0 {
+			return nil
+		}
+
+		if err := p.kv.Delete(ctx, key, jetstream.LastRevision(revision)); err != nil {
+			return fmt.Errorf("delete: %w", err)
+		}
+
+		return p.touch(ctx, userID)
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	switch revision {
+	case 0:
+		_, err = p.kv.Create(ctx, key, data)
+	default:
+		_, err = p.kv.Update(ctx, key, data, revision)
+	}
+
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+
+	return p.touch(ctx, userID)
+}
+
+// touch records the user was seen now.
+func (p *Presence) touch(ctx context.Context, userID common.Address) error {
+	now, err := time.Now().UTC().MarshalText()
+	if err != nil {
+		return fmt.Errorf("marshal seen: %w", err)
+	}
+
+	if _, err := p.seen.Put(ctx, userID.Hex(), now); err != nil {
+		return fmt.Errorf("put seen: %w", err)
+	}
+
+	return nil
+}
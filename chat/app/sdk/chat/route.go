@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+)
+
+// route describes where the devices of the recipients of a message that are
+// not connected to this cap can be found. Offline recipients have no device
+// connected to another cap.
+type route struct {
+	caps      []uuid.UUID
+	offline   []common.Address
+	broadcast bool
+}
+
+// locate uses the presence registry to find the caps the devices of the
+// recipients are connected to. A recipient the registry can't tell us about
+// forces the message to be broadcast to every cap.
+func (c *Chat) locate(ctx context.Context, recipients []common.Address) route {
+	var rt route
+
+	for _, id := range recipients {
+		devices, err := c.presence.Retrieve(ctx, id)
+		switch {
+		case err == nil:
+			var remote bool
+
+			for _, capID := range devices {
+				// The devices connected to us were handled already. The
+				// registry can also still point to us for a moment after a
+				// device disconnected.
+				if capID == c.capID {
+					continue
+				}
+
+				remote = true
+
+				if !slices.Contains(rt.caps, capID) {
+					rt.caps = append(rt.caps, capID)
+				}
+			}
+
+			if !remote {
+				rt.offline = append(rt.offline, id)
+			}
+
+		case errors.Is(err, ErrNotExists):
+			rt.offline = append(rt.offline, id)
+
+		default:
+			c.log.Info(ctx, "chat-presence", "id", id, "ERROR", err)
+			rt.broadcast = true
+		}
+	}
+
+	return rt
+}
+
+// sendRoute hands the message to the caps in the route. Each cap is only sent
+// the message once, no matter how many recipients it holds.
+func (c *Chat) sendRoute(ctx context.Context, from User, inMsg incomingMessage, rt route) error {
+	if rt.broadcast {
+		return c.sendMessageBus(ctx, from, inMsg)
+	}
+
+	for _, capID := range rt.caps {
+		if err := c.sendMessageCap(ctx, capID, from, inMsg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendRemote handles the devices of the recipients that are not connected to
+// this cap. The message is handed to the caps the devices are connected to
+// and is stored for later when a recipient is not connected at all. The local
+// recipients are the ones the message was written to already. The returned
+// status describes what happened to the message.
+func (c *Chat) sendRemote(ctx context.Context, from User, inMsg incomingMessage, recipients []common.Address, local []common.Address) string {
+	rt := c.locate(ctx, recipients)
+
+	var queued, failed int
+
+	for _, id := range rt.offline {
+		if slices.Contains(local, id) {
+			continue
+		}
+
+		if err := c.storeOffline(ctx, from, id, inMsg); err != nil {
+			c.log.Info(ctx, "chat-offlinestore", "id", id, "ERROR", err)
+			failed++
+			continue
+		}
+		queued++
+	}
+
+	if len(rt.caps) > 0 || rt.broadcast {
+		if err := c.sendRoute(ctx, from, inMsg, rt); err != nil {
+			c.log.Info(ctx, "chat-bussend", "ERROR", err)
+			failed++
+		}
+	}
+
+	switch {
+	case failed > 0:
+		return protocol.StatusFailed
+	case queued > 0:
+		return protocol.StatusQueued
+	default:
+		return protocol.StatusDelivered
+	}
+}
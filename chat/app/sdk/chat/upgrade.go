@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/gorilla/websocket"
+)
+
+// newUpgrader returns the upgrader used for every handshake.
+func (c *Chat) newUpgrader() websocket.Upgrader {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    c.upgrade.ReadBufferSize,
+		WriteBufferSize:   c.upgrade.WriteBufferSize,
+		EnableCompression: c.upgrade.Compression,
+		CheckOrigin:       c.checkOrigin,
+	}
+
+	if c.upgrade.Subprotocol != "" {
+		upgrader.Subprotocols = []string{c.upgrade.Subprotocol}
+	}
+
+	return upgrader
+}
+
+// checkUpgrade verifies the request can be upgraded to a websocket. It runs
+// before the upgrade, so the client gets the error as the response.
+func (c *Chat) checkUpgrade(r *http.Request) (string, error) {
+	if !c.checkOrigin(r) {
+		return HandshakeOrigin, errs.Newf(errs.PermissionDenied, "origin %q not allowed", r.Header.Get("Origin"))
+	}
+
+	if c.upgrade.Subprotocol != "" && !slices.Contains(websocket.Subprotocols(r), c.upgrade.Subprotocol) {
+		return HandshakeSubprotocol, errs.Newf(errs.FailedPrecondition, "subprotocol %q required", c.upgrade.Subprotocol)
+	}
+
+	return "", nil
+}
+
+// checkOrigin reports whether a browser on the request's origin can connect.
+// Requests without an origin don't come from a browser and are accepted. With
+// no allowed origins configured, only the cap's own origin is accepted.
+func (c *Chat) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(c.upgrade.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	_, allowed := web.AllowedOrigin(c.upgrade.AllowedOrigins, origin)
+
+	return allowed
+}
@@ -2,6 +2,8 @@ package users
 
 import (
 	"context"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,10 +12,11 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
-// Users provides user storage management.
+// Users provides user storage management. A user connected from several
+// devices is stored once per device.
 type Users struct {
 	log     *logger.Logger
-	users   map[common.Address]chat.User
+	users   map[common.Address]map[string]chat.User
 	muUsers sync.RWMutex
 }
 
@@ -21,107 +24,129 @@ type Users struct {
 func New(log *logger.Logger) *Users {
 	u := Users{
 		log:   log,
-		users: make(map[common.Address]chat.User),
+		users: make(map[common.Address]map[string]chat.User),
 	}
 
 	return &u
 }
 
-// Add adds a new user to the storage.
+// Add adds a new user's device to the storage.
 func (u *Users) Add(ctx context.Context, usr chat.User) error {
 	u.muUsers.Lock()
 	defer u.muUsers.Unlock()
 
-	if _, exists := u.users[usr.ID]; exists {
+	devices, exists := u.users[usr.ID]
+	if !exists {
+		devices = make(map[string]chat.User)
+		u.users[usr.ID] = devices
+	}
+
+	if _, exists := devices[usr.Device]; exists {
 		return chat.ErrExists
 	}
 
-	u.users[usr.ID] = usr
+	devices[usr.Device] = usr
 
-	u.log.Debug(ctx, "chat-adduser", "name", usr.Name, "id", usr.ID)
+	u.log.Debug(ctx, "chat-adduser", "name", usr.Name, "id", usr.ID, "device", usr.Device)
 
 	return nil
 }
 
-// UpdateLastPing updates a user value's ping date/time.
-func (u *Users) UpdateLastPing(ctx context.Context, userID common.Address) error {
+// UpdateLastPing updates a user device's ping date/time.
+func (u *Users) UpdateLastPing(ctx context.Context, s chat.Session) error {
 	u.muUsers.Lock()
 	defer u.muUsers.Unlock()
 
-	usr, exists := u.users[userID]
+	usr, exists := u.users[s.ID][s.Device]
 	if !exists {
 		return chat.ErrNotExists
 	}
 
 	usr.LastPing = time.Now()
-	u.users[usr.ID] = usr
+	u.users[s.ID][s.Device] = usr
 
-	u.log.Debug(ctx, "chat-updping", "name", usr.Name, "id", usr.ID, "lastPing", usr.LastPing)
+	u.log.Debug(ctx, "chat-updping", "name", usr.Name, "id", usr.ID, "device", usr.Device, "lastPing", usr.LastPing)
 
 	return nil
 }
 
-// UpdateLastPong updates a user value's pong date/time.
-func (u *Users) UpdateLastPong(ctx context.Context, userID common.Address) (chat.User, error) {
+// UpdateLastPong updates a user device's pong date/time.
+func (u *Users) UpdateLastPong(ctx context.Context, s chat.Session) (chat.User, error) {
 	u.muUsers.Lock()
 	defer u.muUsers.Unlock()
 
-	usr, exists := u.users[userID]
+	usr, exists := u.users[s.ID][s.Device]
 	if !exists {
 		return chat.User{}, chat.ErrNotExists
 	}
 
 	usr.LastPong = time.Now()
-	u.users[usr.ID] = usr
+	u.users[s.ID][s.Device] = usr
 
-	u.log.Debug(ctx, "chat-updpong", "name", usr.Name, "id", usr.ID, "lastPong", usr.LastPong)
+	u.log.Debug(ctx, "chat-updpong", "name", usr.Name, "id", usr.ID, "device", usr.Device, "lastPong", usr.LastPong)
 
 	return usr, nil
 }
 
-// Remove removes a user from the storage.
-func (u *Users) Remove(ctx context.Context, userID common.Address) {
+// Remove removes a user's device from the storage.
+func (u *Users) Remove(ctx context.Context, s chat.Session) {
 	u.muUsers.Lock()
 	defer u.muUsers.Unlock()
 
-	usr, exists := u.users[userID]
+	usr, exists := u.users[s.ID][s.Device]
 	if !exists {
-		u.log.Debug(ctx, "chat-removeuser", "userID", userID, "status", "does not exists")
+		u.log.Debug(ctx, "chat-removeuser", "userID", s.ID, "device", s.Device, "status", "does not exists")
 		return
 	}
 
-	delete(u.users, userID)
+	delete(u.users[s.ID], s.Device)
+	if len(u.users[s.ID]) == 0 {
+		delete(u.users, s.ID)
+	}
 
-	u.log.Debug(ctx, "chat-removeuser", "name", usr.Name, "id", usr.ID)
+	u.log.Debug(ctx, "chat-removeuser", "name", usr.Name, "id", usr.ID, "device", usr.Device)
 }
 
-// Connections returns all the know users with their connections. A connection
-// that is not valid shouldn't be used.
-func (u *Users) Connections() map[common.Address]chat.Connection {
+// Connections returns all the know devices with their connections. A
+// connection that is not valid shouldn't be used.
+func (u *Users) Connections() map[chat.Session]chat.Connection {
 	u.muUsers.RLock()
 	defer u.muUsers.RUnlock()
 
-	m := make(map[common.Address]chat.Connection)
-	for id, usr := range u.users {
-		m[id] = chat.Connection{
-			Conn:     usr.Conn,
-			LastPing: usr.LastPing,
-			LastPong: usr.LastPong,
+	m := make(map[chat.Session]chat.Connection)
+	for _, devices := range u.users {
+		for _, usr := range devices {
+			m[usr.Session()] = chat.Connection{
+				Name:     usr.Name,
+				Conn:     usr.Conn,
+				LastPing: usr.LastPing,
+				LastPong: usr.LastPong,
+			}
 		}
 	}
 
 	return m
 }
 
-// Retrieve retrieves a user from the storage.
-func (u *Users) Retrieve(ctx context.Context, userID common.Address) (chat.User, error) {
+// Retrieve retrieves every device of a user from the storage, ordered by
+// device.
+func (u *Users) Retrieve(ctx context.Context, userID common.Address) ([]chat.User, error) {
 	u.muUsers.RLock()
 	defer u.muUsers.RUnlock()
 
-	usr, exists := u.users[userID]
+	devices, exists := u.users[userID]
 	if !exists {
-		return chat.User{}, chat.ErrNotExists
+		return nil, chat.ErrNotExists
 	}
 
-	return usr, nil
+	usrs := make([]chat.User, 0, len(devices))
+	for _, usr := range devices {
+		usrs = append(usrs, usr)
+	}
+
+	slices.SortFunc(usrs, func(a, b chat.User) int {
+		return strings.Compare(a.Device, b.Device)
+	})
+
+	return usrs, nil
 }
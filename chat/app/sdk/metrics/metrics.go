@@ -0,0 +1,114 @@
+// Package metrics provides the metrics collected by the cap.
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/foundation/metrics"
+)
+
+// Metrics holds the metrics collected by the cap. It implements the chat
+// metrics sink and records the requests handled by the mid.Metrics
+// middleware.
+type Metrics struct {
+	reg              *metrics.Registry
+	connected        *metrics.Gauge
+	handshakes       *metrics.Counter
+	routed           *metrics.Counter
+	signatureFailure *metrics.Counter
+	busPublish       *metrics.Histogram
+	pingTimeouts     *metrics.Counter
+	slowConsumers    *metrics.Counter
+	requests         *metrics.Counter
+	requestDuration  *metrics.Histogram
+	sessionDuration  *metrics.Histogram
+}
+
+// sessionBuckets are the histogram buckets, in seconds, for how long a
+// websocket stays connected.
+var sessionBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+
+// New constructs the metrics.
+func New() *Metrics {
+	reg := metrics.New()
+
+	m := Metrics{
+		reg:              reg,
+		connected:        reg.Gauge("cap_connected_users", "Number of users connected to the cap."),
+		handshakes:       reg.Counter("cap_handshakes_total", "Number of handshakes by result.", "result"),
+		routed:           reg.Counter("cap_messages_routed_total", "Number of messages sent to local users or over the bus.", "route"),
+		signatureFailure: reg.Counter("cap_signature_failures_total", "Number of frames rejected for a bad signature by source.", "source"),
+		busPublish:       reg.Histogram("cap_bus_publish_seconds", "Time taken to publish a message on the bus.", nil),
+		pingTimeouts:     reg.Counter("cap_ping_timeouts_total", "Number of users dropped for not answering pings."),
+		slowConsumers:    reg.Counter("cap_slow_consumers_total", "Number of users dropped for not reading their messages fast enough."),
+		requests:         reg.Counter("http_requests_total", "Number of requests by route and status.", "method", "route", "status"),
+		requestDuration:  reg.Histogram("http_request_duration_seconds", "Time taken to handle a request by route.", nil, "method", "route"),
+		sessionDuration:  reg.Histogram("http_websocket_session_seconds", "Time a websocket stayed connected by route.", sessionBuckets, "route"),
+	}
+
+	return &m
+}
+
+// Connected records the number of users connected to the cap.
+func (m *Metrics) Connected(n int) {
+	m.connected.Set(float64(n))
+}
+
+// Handshake records the result of a handshake.
+func (m *Metrics) Handshake(result string) {
+	m.handshakes.Inc(result)
+}
+
+// Routed records the route a message took out of the cap.
+func (m *Metrics) Routed(route string) {
+	m.routed.Inc(route)
+}
+
+// SignatureFailure records a frame rejected for a bad signature.
+func (m *Metrics) SignatureFailure(source string) {
+	m.signatureFailure.Inc(source)
+}
+
+// BusPublish records the time taken to publish a message on the bus.
+func (m *Metrics) BusPublish(d time.Duration) {
+	m.busPublish.Observe(d.Seconds())
+}
+
+// PingTimeout records a user dropped for not answering pings.
+func (m *Metrics) PingTimeout() {
+	m.pingTimeouts.Inc()
+}
+
+// SlowConsumer records a user dropped for not reading its messages fast
+// enough.
+func (m *Metrics) SlowConsumer() {
+	m.slowConsumers.Inc()
+}
+
+// Request records a handled request. The route is the pattern that matched
+// the request, not the path, so the number of series stays bounded. A request
+// switched to a websocket returns when the connection closes, so its duration
+// is recorded as a session and kept out of the request latencies.
+func (m *Metrics) Request(method string, route string, status int, d time.Duration) {
+	m.requests.Inc(method, route, strconv.Itoa(status))
+
+	if status == http.StatusSwitchingProtocols {
+		m.sessionDuration.Observe(d.Seconds(), route)
+		return
+	}
+
+	m.requestDuration.Observe(d.Seconds(), method, route)
+}
+
+// Encode implements the encoder interface.
+func (m *Metrics) Encode() ([]byte, string, error) {
+	var b bytes.Buffer
+	if _, err := m.reg.WriteTo(&b); err != nil {
+		return nil, "", err
+	}
+
+	return b.Bytes(), "text/plain; version=0.0.4; charset=utf-8", nil
+}
@@ -0,0 +1,34 @@
+package mid
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+)
+
+// Token makes sure the request carries the specified bearer token in the
+// Authorization header.
+func Token(token string) web.MidFunc {
+	m := func(next web.HandlerFunc) web.HandlerFunc {
+		h := func(ctx context.Context, r *http.Request) web.Encoder {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				return errs.Newf(errs.Unauthenticated, "expected authorization header format: Bearer <token>")
+			}
+
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				return errs.Newf(errs.Unauthenticated, "invalid token")
+			}
+
+			return next(ctx, r)
+		}
+
+		return h
+	}
+
+	return m
+}
@@ -0,0 +1,68 @@
+package mid_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ardanlabs/usdl/chat/app/sdk/mid"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+)
+
+func Test_Token(t *testing.T) {
+	var called bool
+	next := func(ctx context.Context, r *http.Request) web.Encoder {
+		called = true
+		return nil
+	}
+
+	h := mid.Token("secret")(next)
+
+	tests := []struct {
+		name   string
+		header string
+		pass   bool
+	}{
+		{"missing", "", false},
+		{"scheme", "Basic secret", false},
+		{"wrong", "Bearer guess", false},
+		{"prefix", "Bearer secretx", false},
+		{"correct", "Bearer secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+
+			r := httptest.NewRequest(http.MethodGet, "/admin/cap", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			resp := h(context.Background(), r)
+
+			if called != tt.pass {
+				t.Fatalf("Should only call the handler with the right token, called %v", called)
+			}
+
+			if tt.pass {
+				if resp != nil {
+					t.Fatalf("Should return the handler's response, got %v", resp)
+				}
+				return
+			}
+
+			var appErr *errs.Error
+			if err, ok := resp.(error); !ok || !errors.As(err, &appErr) || appErr.Code != errs.Unauthenticated {
+				t.Fatalf("Should get an %s error, got %v", errs.Unauthenticated, resp)
+			}
+
+			if appErr.HTTPStatus() != http.StatusUnauthorized {
+				t.Fatalf("Should answer with status %d, got %d", http.StatusUnauthorized, appErr.HTTPStatus())
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/metrics"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+)
+
+// Metrics records the number of requests and how long they took.
+func Metrics(m *metrics.Metrics) web.MidFunc {
+	mid := func(next web.HandlerFunc) web.HandlerFunc {
+		h := func(ctx context.Context, r *http.Request) web.Encoder {
+			now := time.Now()
+
+			resp := next(ctx, r)
+
+			// The pattern holds the method, which is recorded on its own.
+			route := r.Pattern
+			if _, path, found := strings.Cut(route, " "); found {
+				route = path
+			}
+
+			m.Request(r.Method, route, httpStatus(resp), time.Since(now))
+
+			return resp
+		}
+
+		return h
+	}
+
+	return mid
+}
+
+// httpStatus returns the status code the response is sent with. A handler
+// that returns no response already wrote it, which for the chat routes means
+// the connection was switched to a websocket.
+func httpStatus(resp web.Encoder) int {
+	switch v := resp.(type) {
+	case nil:
+		return http.StatusNoContent
+
+	case web.NoResponse:
+		return http.StatusSwitchingProtocols
+
+	case interface{ HTTPStatus() int }:
+		return v.HTTPStatus()
+
+	case error:
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusOK
+}
@@ -0,0 +1,59 @@
+package mid_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/metrics"
+	"github.com/ardanlabs/usdl/chat/app/sdk/mid"
+	"github.com/ardanlabs/usdl/chat/foundation/web"
+)
+
+func Test_MetricsSession(t *testing.T) {
+	m := metrics.New()
+
+	connect := func(ctx context.Context, r *http.Request) web.Encoder {
+		return web.NewNoResponse()
+	}
+
+	users := func(ctx context.Context, r *http.Request) web.Encoder {
+		return nil
+	}
+
+	call := func(h web.HandlerFunc, pattern string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Pattern = pattern
+
+		mid.Metrics(m)(h)(context.Background(), r)
+	}
+
+	call(connect, "GET /connect")
+	call(users, "GET /admin/users")
+
+	b, _, err := m.Encode()
+	if err != nil {
+		t.Fatalf("Should be able to encode the metrics: %s", err)
+	}
+	out := string(b)
+
+	tests := []struct {
+		line  string
+		found bool
+	}{
+		{`http_requests_total{method="GET",route="/connect",status="101"} 1`, true},
+		{`http_websocket_session_seconds_count{route="/connect"} 1`, true},
+		{`http_request_duration_seconds_count{method="GET",route="/connect"}`, false},
+		{`http_request_duration_seconds_count{method="GET",route="/admin/users"} 1`, true},
+		{`http_websocket_session_seconds_count{route="/admin/users"}`, false},
+	}
+
+	for _, tt := range tests {
+		if strings.Contains(out, tt.line) != tt.found {
+			t.Logf("got: %s", out)
+			t.Fatalf("Should find %v for %s", tt.found, tt.line)
+		}
+	}
+}
@@ -3,23 +3,52 @@ package mux
 
 import (
 	"context"
+	"embed"
 	"net/http"
 
+	"github.com/ardanlabs/usdl/chat/app/domain/adminapp"
 	"github.com/ardanlabs/usdl/chat/app/domain/chatapp"
+	"github.com/ardanlabs/usdl/chat/app/domain/checkapp"
 	"github.com/ardanlabs/usdl/chat/app/sdk/chat"
+	"github.com/ardanlabs/usdl/chat/app/sdk/metrics"
 	"github.com/ardanlabs/usdl/chat/app/sdk/mid"
 	"github.com/ardanlabs/usdl/chat/foundation/logger"
 	"github.com/ardanlabs/usdl/chat/foundation/web"
+	"github.com/nats-io/nats.go"
 )
 
-// Config contains all the mandatory systems required by handlers.
+// Options represent optional parameters.
+type Options struct {
+	static     embed.FS
+	staticDir  string
+	staticPath string
+}
+
+// WithFileServer provides support for serving the static files of a browser
+// client from the specified directory of the file system.
+func WithFileServer(static embed.FS, dir string, path string) func(opts *Options) {
+	return func(opts *Options) {
+		opts.static = static
+		opts.staticDir = dir
+		opts.staticPath = path
+	}
+}
+
+// Config contains all the mandatory systems required by handlers. The admin
+// routes are only available when an admin token is provided. CORS is only
+// enabled when origins are provided.
 type Config struct {
-	Log  *logger.Logger
-	Chat *chat.Chat
+	Build       string
+	Log         *logger.Logger
+	NATS        *nats.Conn
+	Chat        *chat.Chat
+	Metrics     *metrics.Metrics
+	AdminToken  string
+	CORSOrigins []string
 }
 
 // WebAPI constructs a http.Handler with all application routes bound.
-func WebAPI(cfg Config) http.Handler {
+func WebAPI(cfg Config, options ...func(opts *Options)) http.Handler {
 	logger := func(ctx context.Context, msg string, args ...any) {
 		cfg.Log.Info(ctx, msg, args...)
 	}
@@ -28,10 +57,43 @@ func WebAPI(cfg Config) http.Handler {
 		logger,
 		mid.Logger(cfg.Log),
 		mid.Errors(cfg.Log),
+		mid.Metrics(cfg.Metrics),
 		mid.Panics(),
 	)
 
+	if len(cfg.CORSOrigins) > 0 {
+		app.EnableCORS(cfg.CORSOrigins)
+	}
+
+	var opts Options
+	for _, option := range options {
+		option(&opts)
+	}
+
+	checkapp.Routes(app, checkapp.Config{
+		Build:   cfg.Build,
+		Log:     cfg.Log,
+		NATS:    cfg.NATS,
+		Chat:    cfg.Chat,
+		Metrics: cfg.Metrics,
+	})
+
 	chatapp.Routes(app, cfg.Log, cfg.Chat)
 
+	if cfg.AdminToken != "" {
+		adminapp.Routes(app, adminapp.Config{
+			Log:   cfg.Log,
+			Chat:  cfg.Chat,
+			Build: cfg.Build,
+			Token: cfg.AdminToken,
+		})
+	}
+
+	if opts.staticDir != "" {
+		if err := app.FileServer(opts.static, opts.staticDir, opts.staticPath); err != nil {
+			cfg.Log.Error(context.Background(), "mux", "status", "file server", "ERROR", err)
+		}
+	}
+
 	return app
 }
@@ -0,0 +1,376 @@
+package protocol
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/errs"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Set of command actions. Group actions are executed by the cap, the other
+// actions are relayed to the recipient.
+const (
+	ActionGroupCreate = "group-create"
+	ActionGroupInvite = "group-invite"
+	ActionGroupRemove = "group-remove"
+	ActionShareKey    = "share-key"
+)
+
+// Set of receipt states a recipient reports back to the sender.
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Set of delivery statuses a cap reports back to the sender.
+const (
+	StatusDelivered = "delivered"
+	StatusQueued    = "queued"
+	StatusFailed    = "failed"
+)
+
+// Set of presence statuses. Clients pick between online and away, the cap
+// reports offline once a user disconnects.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Set of device actions. A client can list the devices of its account that
+// are connected and disconnect one of them.
+const (
+	DeviceList   = "list"
+	DeviceRevoke = "revoke"
+)
+
+// MaxChunkSize is the largest amount of file data a single file frame may
+// carry. Files are split into chunks of at most this size.
+const MaxChunkSize = 64 * 1024
+
+// Signature represents the signature values produced by the signature package.
+type Signature struct {
+	V *big.Int `json:"v"`
+	R *big.Int `json:"r"`
+	S *big.Int `json:"s"`
+}
+
+// =============================================================================
+// Handshake frames.
+
+// Challenge is sent by the cap when a client connects. The client must sign
+// the challenge to prove it owns the account it claims.
+type Challenge struct {
+	Challenge string `json:"challenge"`
+	Versions  []int  `json:"versions"`
+}
+
+// Hello is sent by the client in response to the challenge. An account can
+// be connected from several devices at once, each device picks an id it keeps
+// between connections. Clients that don't send a device are treated as a
+// single device.
+type Hello struct {
+	ID     common.Address `json:"id"`
+	Name   string         `json:"name"`
+	Device string         `json:"device,omitempty"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the challenge.
+func (h Hello) SignedData(challenge string) any {
+	if h.Device == "" {
+		return struct {
+			ID        common.Address
+			Challenge string
+		}{
+			ID:        h.ID,
+			Challenge: challenge,
+		}
+	}
+
+	return struct {
+		ID        common.Address
+		Device    string
+		Challenge string
+	}{
+		ID:        h.ID,
+		Device:    h.Device,
+		Challenge: challenge,
+	}
+}
+
+// Welcome is sent by the cap once the handshake is complete. Limits are the
+// rate limits the cap enforces for the user, a client that keeps its frames
+// within them is never refused.
+type Welcome struct {
+	Name   string  `json:"name"`
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// Limits represents the token buckets a cap takes a user's frames from. Every
+// frame takes one message and its size in bytes. Rates are per second and a
+// bucket with no burst is not enforced.
+type Limits struct {
+	MessageRate  float64 `json:"messageRate,omitempty"`
+	MessageBurst int     `json:"messageBurst,omitempty"`
+	ByteRate     float64 `json:"byteRate,omitempty"`
+	ByteBurst    int     `json:"byteBurst,omitempty"`
+}
+
+// =============================================================================
+// Client to cap frames.
+
+// ChatRequest is sent by a client to deliver a message to a user or group.
+type ChatRequest struct {
+	ToID      common.Address `json:"toID"`
+	Msg       string         `json:"msg"`
+	Encrypted bool           `json:"encrypted"`
+	FromNonce uint64         `json:"fromNonce"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the request.
+func (r ChatRequest) SignedData() any {
+	return struct {
+		ToID      common.Address
+		Msg       string
+		Encrypted bool
+		FromNonce uint64
+	}{
+		ToID:      r.ToID,
+		Msg:       r.Msg,
+		Encrypted: r.Encrypted,
+		FromNonce: r.FromNonce,
+	}
+}
+
+// Command represents an action requested by a client.
+type Command struct {
+	Action   string         `json:"action"`
+	GroupID  common.Address `json:"groupID"`
+	Name     string         `json:"name,omitempty"`
+	MemberID common.Address `json:"memberID"`
+	Key      string         `json:"key,omitempty"`
+}
+
+// CommandRequest is sent by a client to execute a command. Group commands
+// are addressed to the group, other commands to the user they are for.
+type CommandRequest struct {
+	ToID      common.Address `json:"toID"`
+	Command   Command        `json:"command"`
+	FromNonce uint64         `json:"fromNonce"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the request.
+func (r CommandRequest) SignedData() any {
+	return struct {
+		ToID      common.Address
+		Command   Command
+		FromNonce uint64
+	}{
+		ToID:      r.ToID,
+		Command:   r.Command,
+		FromNonce: r.FromNonce,
+	}
+}
+
+// Receipt reports how far the messages up to the nonce have progressed. Every
+// device of the sender uses its own nonces, the device tells which of them
+// the receipt is about.
+type Receipt struct {
+	Nonce  uint64 `json:"nonce"`
+	State  string `json:"state"`
+	Device string `json:"device,omitempty"`
+}
+
+// ReceiptRequest is sent by a client to acknowledge messages it received.
+type ReceiptRequest struct {
+	ToID      common.Address `json:"toID"`
+	Receipt   Receipt        `json:"receipt"`
+	FromNonce uint64         `json:"fromNonce"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the request.
+func (r ReceiptRequest) SignedData() any {
+	return struct {
+		ToID      common.Address
+		Receipt   Receipt
+		FromNonce uint64
+	}{
+		ToID:      r.ToID,
+		Receipt:   r.Receipt,
+		FromNonce: r.FromNonce,
+	}
+}
+
+// FileChunk carries one piece of a file. Every chunk repeats the file's name,
+// size and hash so the receiver can validate the transfer from any chunk.
+type FileChunk struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Hash  string `json:"hash"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+	Data  []byte `json:"data"`
+}
+
+// Last reports whether this is the final chunk of the file.
+func (fc FileChunk) Last() bool {
+	return fc.Index == fc.Total-1
+}
+
+// FileRequest is sent by a client to deliver a chunk of a file to a user.
+// Every chunk is signed and uses its own nonce.
+type FileRequest struct {
+	ToID      common.Address `json:"toID"`
+	Chunk     FileChunk      `json:"chunk"`
+	FromNonce uint64         `json:"fromNonce"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the request.
+func (r FileRequest) SignedData() any {
+	return struct {
+		ToID      common.Address
+		Chunk     FileChunk
+		FromNonce uint64
+	}{
+		ToID:      r.ToID,
+		Chunk:     r.Chunk,
+		FromNonce: r.FromNonce,
+	}
+}
+
+// PresenceRequest is sent by a client to change its own status and to
+// subscribe to the status of other users. The cap replies with the current
+// status of each subscribed user and then pushes every change.
+type PresenceRequest struct {
+	Status    string           `json:"status,omitempty"`
+	Subscribe []common.Address `json:"subscribe,omitempty"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the request.
+func (r PresenceRequest) SignedData() any {
+	return struct {
+		Status    string
+		Subscribe []common.Address
+	}{
+		Status:    r.Status,
+		Subscribe: r.Subscribe,
+	}
+}
+
+// DeviceRequest is sent by a client to list the devices of its account that
+// are connected, or to disconnect one of them.
+type DeviceRequest struct {
+	Action string `json:"action"`
+	Device string `json:"device,omitempty"`
+	Signature
+}
+
+// SignedData returns the data the client signs for the request.
+func (r DeviceRequest) SignedData() any {
+	return struct {
+		Action string
+		Device string
+	}{
+		Action: r.Action,
+		Device: r.Device,
+	}
+}
+
+// =============================================================================
+// Cap to client frames.
+
+// From identifies the user that sent a frame. The nonce belongs to the
+// device the frame was sent from.
+type From struct {
+	ID     common.Address `json:"id"`
+	Name   string         `json:"name"`
+	Device string         `json:"device,omitempty"`
+	Nonce  uint64         `json:"nonce"`
+}
+
+// Group describes the group a frame was sent to.
+type Group struct {
+	ID      common.Address   `json:"id"`
+	Name    string           `json:"name"`
+	Members []common.Address `json:"members"`
+}
+
+// ChatMessage delivers a message to a client. Messages sent to a group carry
+// the group, which includes membership notices from the cap.
+type ChatMessage struct {
+	From      From   `json:"from"`
+	Msg       string `json:"msg"`
+	Encrypted bool   `json:"encrypted"`
+	Group     *Group `json:"group,omitempty"`
+}
+
+// CommandMessage delivers a command from another user.
+type CommandMessage struct {
+	From    From    `json:"from"`
+	Command Command `json:"command"`
+}
+
+// ReceiptMessage delivers a receipt from another user.
+type ReceiptMessage struct {
+	From    From    `json:"from"`
+	Receipt Receipt `json:"receipt"`
+}
+
+// FileMessage delivers a chunk of a file from another user.
+type FileMessage struct {
+	From  From      `json:"from"`
+	Chunk FileChunk `json:"chunk"`
+}
+
+// SentMessage tells the other devices of an account about a message one of
+// the devices sent. An encrypted message can only be read by the recipient.
+type SentMessage struct {
+	Device    string         `json:"device"`
+	ToID      common.Address `json:"toID"`
+	Msg       string         `json:"msg"`
+	Encrypted bool           `json:"encrypted"`
+	Nonce     uint64         `json:"nonce"`
+	Group     *Group         `json:"group,omitempty"`
+}
+
+// StatusMessage tells the sender what the cap did with a message.
+type StatusMessage struct {
+	ToID   common.Address `json:"toID"`
+	Nonce  uint64         `json:"nonce"`
+	Status string         `json:"status"`
+}
+
+// PresenceMessage tells a client whether a contact is connected.
+type PresenceMessage struct {
+	ID       common.Address `json:"id"`
+	Status   string         `json:"status"`
+	LastSeen time.Time      `json:"lastSeen"`
+}
+
+// Device describes a device of the account that is connected.
+type Device struct {
+	ID      string `json:"id"`
+	Current bool   `json:"current"`
+}
+
+// DevicesMessage lists the devices of the account that are connected.
+type DevicesMessage struct {
+	Devices []Device `json:"devices"`
+}
+
+// ErrorMessage tells a client a frame it sent could not be processed. When
+// the error is about a message, the recipient and nonce identify it.
+type ErrorMessage struct {
+	Code    errs.ErrCode   `json:"code"`
+	Message string         `json:"message"`
+	ToID    common.Address `json:"toID"`
+	Nonce   uint64         `json:"nonce"`
+}
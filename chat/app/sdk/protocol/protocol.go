@@ -0,0 +1,108 @@
+// Package protocol defines the frames exchanged between a cap and its clients
+// over the websocket. Every frame is wrapped in an envelope that carries the
+// frame type and the protocol version it was written with.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Version is the protocol version written by this package.
+const Version = 1
+
+// Versions is the set of protocol versions this package can read.
+var Versions = []int{1}
+
+// Set of close codes used when a cap closes a connection. Codes in the range
+// of 4000-4999 are reserved for applications by RFC 6455.
+const (
+	CloseUnsupportedVersion = 4000
+	CloseUnauthenticated    = 4001
+	CloseAlreadyConnected   = 4002
+	CloseKicked             = 4003
+	CloseReconnect          = 4004
+	CloseRateLimited        = 4005
+	CloseRevoked            = 4006
+	CloseSlowConsumer       = 4007
+	CloseHandshakeTimeout   = 4008
+)
+
+// ErrUnsupportedVersion is returned when a frame was written with a version of
+// the protocol this package can't read.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Type represents the kind of frame carried by an envelope.
+type Type string
+
+// Set of frame types.
+const (
+	TypeChallenge Type = "challenge"
+	TypeHello     Type = "hello"
+	TypeWelcome   Type = "welcome"
+	TypeChat      Type = "chat"
+	TypeCommand   Type = "command"
+	TypeReceipt   Type = "receipt"
+	TypeFile      Type = "file"
+	TypeStatus    Type = "status"
+	TypePresence  Type = "presence"
+	TypeDevice    Type = "device"
+	TypeSent      Type = "sent"
+	TypeError     Type = "error"
+)
+
+// Envelope represents a single frame sent over the websocket.
+type Envelope struct {
+	Type    Type            `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Encode wraps the payload into an envelope of the specified type and returns
+// the frame ready to be written to the websocket.
+func Encode(typ Type, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+
+	env := Envelope{
+		Type:    typ,
+		Version: Version,
+		Payload: data,
+	}
+
+	return json.Marshal(env)
+}
+
+// Decode reads the envelope from the frame. Frames that don't carry a type or
+// that were written with an unsupported version return ErrUnsupportedVersion,
+// which is what happens when talking to clients that predate the envelope.
+func Decode(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, fmt.Errorf("unmarshal envelope: %w", err)
+	}
+
+	if env.Type == "" || !Supported(env.Version) {
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.Version)
+	}
+
+	return env, nil
+}
+
+// Supported reports whether the version of the protocol can be read.
+func Supported(version int) bool {
+	return slices.Contains(Versions, version)
+}
+
+// Unmarshal decodes the payload into the specified value.
+func (env Envelope) Unmarshal(v any) error {
+	if err := json.Unmarshal(env.Payload, v); err != nil {
+		return fmt.Errorf("unmarshal %s payload: %w", env.Type, err)
+	}
+
+	return nil
+}
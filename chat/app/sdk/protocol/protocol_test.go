@@ -0,0 +1,101 @@
+package protocol_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/app/sdk/protocol"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func Test_EncodeDecode(t *testing.T) {
+	req := protocol.ChatRequest{
+		ToID:      common.HexToAddress("0x1"),
+		Msg:       "hello bob",
+		FromNonce: 1,
+	}
+
+	data, err := protocol.Encode(protocol.TypeChat, req)
+	if err != nil {
+		t.Fatalf("Should be able to encode the frame: %s", err)
+	}
+
+	env, err := protocol.Decode(data)
+	if err != nil {
+		t.Fatalf("Should be able to decode the frame: %s", err)
+	}
+
+	if env.Type != protocol.TypeChat || env.Version != protocol.Version {
+		t.Fatalf("Should get a %s frame of version %d, got a %s frame of version %d", protocol.TypeChat, protocol.Version, env.Type, env.Version)
+	}
+
+	var got protocol.ChatRequest
+	if err := env.Unmarshal(&got); err != nil {
+		t.Fatalf("Should be able to unmarshal the payload: %s", err)
+	}
+
+	if got.ToID != req.ToID || got.Msg != req.Msg || got.FromNonce != req.FromNonce {
+		t.Logf("got: %+v", got)
+		t.Logf("exp: %+v", req)
+		t.Fatalf("Should get back the same request.")
+	}
+}
+
+func Test_DecodeUnknownType(t *testing.T) {
+	data, err := protocol.Encode("future", map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatalf("Should be able to encode the frame: %s", err)
+	}
+
+	// The envelope is understood, the reader decides what to do with a type
+	// it doesn't know.
+
+	env, err := protocol.Decode(data)
+	if err != nil {
+		t.Fatalf("Should be able to decode a frame of an unknown type: %s", err)
+	}
+
+	if env.Type != "future" {
+		t.Fatalf("Should keep the frame's type, got %s", env.Type)
+	}
+}
+
+func Test_DecodeUnsupportedVersion(t *testing.T) {
+	frames := map[string]string{
+		"newer":   `{"type":"chat","version":99,"payload":{}}`,
+		"missing": `{"type":"chat","payload":{}}`,
+		"legacy":  `{"toID":"0x1","msg":"hello bob","fromNonce":1}`,
+	}
+
+	for name, frame := range frames {
+		t.Run(name, func(t *testing.T) {
+			_, err := protocol.Decode([]byte(frame))
+			if !errors.Is(err, protocol.ErrUnsupportedVersion) {
+				t.Fatalf("Should get %q, got %v", protocol.ErrUnsupportedVersion, err)
+			}
+		})
+	}
+}
+
+func Test_DecodeBadFrame(t *testing.T) {
+	_, err := protocol.Decode([]byte("not json"))
+	if err == nil {
+		t.Fatal("Should not be able to decode a frame that isn't json")
+	}
+
+	if errors.Is(err, protocol.ErrUnsupportedVersion) {
+		t.Fatalf("Should not report a bad frame as an unsupported version: %s", err)
+	}
+}
+
+func Test_Supported(t *testing.T) {
+	for _, v := range protocol.Versions {
+		if !protocol.Supported(v) {
+			t.Fatalf("Should support version %d", v)
+		}
+	}
+
+	if protocol.Supported(protocol.Version + 1) {
+		t.Fatalf("Should not support version %d", protocol.Version+1)
+	}
+}
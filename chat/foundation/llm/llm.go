@@ -0,0 +1,121 @@
+// Package llm provides support for talking to a model server that implements
+// the OpenAI chat completions API, like Ollama or OpenAI itself.
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Set of roles a message in a conversation can have.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Message represents one message in a conversation.
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Config represents the settings for the client. The URL is the base url of
+// the model server, the client adds the chat completions path.
+type Config struct {
+	URL     string
+	Model   string
+	APIKey  string
+	Timeout time.Duration
+}
+
+// Client represents a client for a model server.
+type Client struct {
+	url    string
+	model  string
+	apiKey string
+	http   *http.Client
+}
+
+// New constructs a client for the model server.
+func New(cfg Config) (*Client, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	if cfg.Model == "" {
+		return nil, errors.New("model is required")
+	}
+
+	cln := Client{
+		url:    strings.TrimSuffix(cfg.URL, "/") + "/v1/chat/completions",
+		model:  cfg.Model,
+		apiKey: cfg.APIKey,
+		http: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+	}
+
+	return &cln, nil
+}
+
+// Chat sends the conversation to the model and returns the model's reply.
+func (cln *Client) Chat(ctx context.Context, msgs []Message) (string, error) {
+	req := struct {
+		Model    string    `json:"model"`
+		Messages []Message `json:"messages"`
+		Stream   bool      `json:"stream"`
+	}{
+		Model:    cln.model,
+		Messages: msgs,
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("marshal: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, cln.url, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("new request: %w", err)
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	if cln.apiKey != "" {
+		r.Header.Set("Authorization", "Bearer "+cln.apiKey)
+	}
+
+	resp, err := cln.http.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message Message `json:"message"`
+		} `json:"choices"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", fmt.Errorf("decode: %w", err)
+	}
+
+	if len(completion.Choices) == 0 {
+		return "", errors.New("no choices returned")
+	}
+
+	return completion.Choices[0].Message.Content, nil
+}
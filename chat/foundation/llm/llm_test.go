@@ -0,0 +1,78 @@
+package llm_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/foundation/llm"
+)
+
+func Test_Chat(t *testing.T) {
+	var got struct {
+		Model    string        `json:"model"`
+		Messages []llm.Message `json:"messages"`
+	}
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		json.NewDecoder(r.Body).Decode(&got)
+
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi there"}}]}`))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	defer srv.Close()
+
+	cln, err := llm.New(llm.Config{URL: srv.URL, Model: "test-model", APIKey: "secret"})
+	if err != nil {
+		t.Fatalf("Should be able to create the client: %s", err)
+	}
+
+	msgs := []llm.Message{
+		{Role: llm.RoleSystem, Content: "be brief"},
+		{Role: llm.RoleUser, Content: "hello"},
+	}
+
+	reply, err := cln.Chat(context.Background(), msgs)
+	if err != nil {
+		t.Fatalf("Should be able to chat: %s", err)
+	}
+
+	if reply != "hi there" {
+		t.Fatalf("Should get the model's reply, got %q", reply)
+	}
+
+	if got.Model != "test-model" || len(got.Messages) != 2 || got.Messages[1].Content != "hello" {
+		t.Fatalf("Should send the model and conversation, got %+v", got)
+	}
+}
+
+func Test_ChatError(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not found", http.StatusNotFound)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	defer srv.Close()
+
+	cln, err := llm.New(llm.Config{URL: srv.URL, Model: "missing"})
+	if err != nil {
+		t.Fatalf("Should be able to create the client: %s", err)
+	}
+
+	if _, err := cln.Chat(context.Background(), nil); err == nil {
+		t.Fatal("Should get an error for a failed request")
+	}
+}
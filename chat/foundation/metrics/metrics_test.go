@@ -0,0 +1,64 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ardanlabs/usdl/chat/foundation/metrics"
+)
+
+func Test_WriteTo(t *testing.T) {
+	reg := metrics.New()
+
+	users := reg.Gauge("users", "Connected users.")
+	msgs := reg.Counter("messages_total", "Messages \"routed\".", "route")
+	latency := reg.Histogram("latency_seconds", "Latency.", []float64{0.5, 0.1})
+
+	users.Set(3)
+	msgs.Inc("local")
+	msgs.Add(2, "bus")
+	msgs.Inc("local")
+	latency.Observe(0.05)
+	latency.Observe(0.3)
+	latency.Observe(2)
+
+	exp := `# HELP users Connected users.
+# TYPE users gauge
+users 3
+# HELP messages_total Messages "routed".
+# TYPE messages_total counter
+messages_total{route="bus"} 2
+messages_total{route="local"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="0.5"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.35
+latency_seconds_count 3
+`
+
+	var b strings.Builder
+	if _, err := reg.WriteTo(&b); err != nil {
+		t.Fatalf("Should be able to write the metrics: %s", err)
+	}
+
+	if got := b.String(); got != exp {
+		t.Fatalf("Should get the expected output:\ngot:\n%s\nexp:\n%s", got, exp)
+	}
+}
+
+func Test_LabelEscaping(t *testing.T) {
+	reg := metrics.New()
+
+	c := reg.Counter("requests_total", "Requests.", "path")
+	c.Inc("a\"b\\c\nd")
+
+	var b strings.Builder
+	reg.WriteTo(&b)
+
+	exp := `requests_total{path="a\"b\\c\nd"} 1`
+	if !strings.Contains(b.String(), exp) {
+		t.Fatalf("Should escape the label value, got:\n%s", b.String())
+	}
+}
@@ -0,0 +1,63 @@
+// Package natsserver provides support for running a NATS server with
+// JetStream enabled inside the process.
+package natsserver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Config represents the settings for an embedded server.
+type Config struct {
+	Host     string
+	Port     int
+	StoreDir string
+}
+
+// Server represents a NATS server running inside the process.
+type Server struct {
+	srv *server.Server
+}
+
+// Start starts a NATS server with JetStream enabled, storing its data in the
+// configured store dir. A port of -1 picks a random port, which is useful for
+// tests that run several servers.
+func Start(cfg Config) (*Server, error) {
+	opts := server.Options{
+		Host:      cfg.Host,
+		Port:      cfg.Port,
+		JetStream: true,
+		StoreDir:  cfg.StoreDir,
+		NoSigs:    true,
+		NoLog:     true,
+	}
+
+	srv, err := server.NewServer(&opts)
+	if err != nil {
+		return nil, fmt.Errorf("new server: %w", err)
+	}
+
+	go srv.Start()
+
+	const startTimeout = 5 * time.Second
+	if !srv.ReadyForConnections(startTimeout) {
+		srv.Shutdown()
+		return nil, errors.New("server not ready for connections")
+	}
+
+	return &Server{srv: srv}, nil
+}
+
+// ClientURL returns the url clients use to connect to the server.
+func (s *Server) ClientURL() string {
+	return s.srv.ClientURL()
+}
+
+// Shutdown stops the server and waits for it to finish.
+func (s *Server) Shutdown() {
+	s.srv.Shutdown()
+	s.srv.WaitForShutdown()
+}
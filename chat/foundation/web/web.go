@@ -80,12 +80,8 @@ func (a *App) corsHandler(webHandler HandlerFunc) HandlerFunc {
 		// then if the Origin value is in the list, set the
 		// Access-Control-Allow-Origin value to the same value as the Origin.
 
-		reqOrigin := r.Header.Get("Origin")
-		for _, origin := range a.origins {
-			if origin == "*" || origin == reqOrigin {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				break
-			}
+		if origin, allowed := AllowedOrigin(a.origins, r.Header.Get("Origin")); allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
 		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, GET, OPTIONS, PUT, DELETE")
@@ -98,6 +94,19 @@ func (a *App) corsHandler(webHandler HandlerFunc) HandlerFunc {
 	return h
 }
 
+// AllowedOrigin reports whether the request origin is in the set of allowed
+// origins and returns the allowed origin that matched. An allowed origin of
+// "*" matches every origin.
+func AllowedOrigin(origins []string, reqOrigin string) (string, bool) {
+	for _, origin := range origins {
+		if origin == "*" || origin == reqOrigin {
+			return origin, true
+		}
+	}
+
+	return "", false
+}
+
 // HandlerFuncNoMid sets a handler function for a given HTTP method and path
 // pair to the application server mux. Does not include the application
 // middleware or OTEL tracing.